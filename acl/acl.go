@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Wireleap
+
+// Package acl implements access control by source address for forwarders.
+package acl
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logInterval is the minimum interval between logged denials, so floods of
+// denied datagrams do not flood the log as well.
+const logInterval = time.Second
+
+// T decides which source addresses connections and datagrams are accepted
+// from. A nil *T accepts everything.
+type T struct {
+	allow, deny []*net.IPNet
+	// number of denied attempts, accessed atomically
+	denied uint64
+	// unix nanoseconds of last logged denial, accessed atomically
+	logged int64
+}
+
+// Parse parses comma-separated lists of IP addresses and CIDR ranges.
+func Parse(allow, deny string) (t *T, err error) {
+	t = &T{}
+	if t.allow, err = parseNets(allow); err != nil {
+		return nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+	if t.deny, err = parseNets(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny list: %w", err)
+	}
+	return
+}
+
+func parseNets(s string) (r []*net.IPNet, err error) {
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither an IP address nor a CIDR range", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			r = append(r, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, n)
+	}
+	return
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits returns whether ip is accepted: it must not be denied and, if an
+// allow list is set, it must be allowed.
+func (t *T) Permits(ip net.IP) bool {
+	if t == nil {
+		return true
+	}
+	if contains(t.deny, ip) {
+		return false
+	}
+	return len(t.allow) == 0 || contains(t.allow, ip)
+}
+
+// Reject counts a denied attempt (what, e.g. "SOCKSv5 tcp connection") from
+// addr and logs it unless another one was logged less than logInterval ago.
+func (t *T) Reject(what string, addr net.Addr) {
+	n := atomic.AddUint64(&t.denied, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&t.logged)
+	if now-last < int64(logInterval) || !atomic.CompareAndSwapInt64(&t.logged, last, now) {
+		return
+	}
+	log.Printf("%s from %s denied by access control (%d denied in total)", what, addr, n)
+}
+
+// Denied returns the number of denied attempts so far.
+func (t *T) Denied() uint64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&t.denied)
+}
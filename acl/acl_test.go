@@ -0,0 +1,100 @@
+// Copyright (c) 2022 Wireleap
+
+package acl
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPermits(t *testing.T) {
+	for _, tc := range []struct {
+		allow, deny string
+		permitted   []string
+		denied      []string
+	}{
+		{
+			// no lists: everything goes
+			permitted: []string{"127.0.0.1", "192.168.1.2", "::1", "fd00::1"},
+		},
+		{
+			allow:     "127.0.0.1, 192.168.1.0/24",
+			permitted: []string{"127.0.0.1", "192.168.1.2", "192.168.1.255"},
+			denied:    []string{"127.0.0.2", "192.168.2.1", "::1", "fd00::1"},
+		},
+		{
+			deny:      "192.168.1.99,fd00::/8",
+			permitted: []string{"127.0.0.1", "192.168.1.2", "::1"},
+			denied:    []string{"192.168.1.99", "fd00::1", "fdff::1"},
+		},
+		{
+			// deny overrides allow
+			allow:     "192.168.1.0/24",
+			deny:      "192.168.1.99, 192.168.1.128/25",
+			permitted: []string{"192.168.1.2", "192.168.1.127"},
+			denied:    []string{"192.168.1.99", "192.168.1.128", "192.168.1.200", "10.0.0.1"},
+		},
+		{
+			// IPv4-mapped IPv6 addresses match IPv4 entries and vice versa
+			allow:     "::ffff:10.0.0.0/104, ::ffff:192.168.1.2",
+			deny:      "10.0.0.99",
+			permitted: []string{"10.1.2.3", "::ffff:10.1.2.3", "192.168.1.2", "::ffff:192.168.1.2"},
+			denied:    []string{"10.0.0.99", "::ffff:10.0.0.99", "11.0.0.1", "::ffff:11.0.0.1", "::a01:203"},
+		},
+	} {
+		acls, err := Parse(tc.allow, tc.deny)
+		if err != nil {
+			t.Errorf("allow %q deny %q: %s", tc.allow, tc.deny, err)
+			continue
+		}
+		for _, s := range tc.permitted {
+			if !acls.Permits(net.ParseIP(s)) {
+				t.Errorf("allow %q deny %q: %s denied", tc.allow, tc.deny, s)
+			}
+		}
+		for _, s := range tc.denied {
+			if acls.Permits(net.ParseIP(s)) {
+				t.Errorf("allow %q deny %q: %s permitted", tc.allow, tc.deny, s)
+			}
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		allow, deny, err string
+	}{
+		{"10.0.0.0/33", "", "invalid allow list"},
+		{"", "10.0.0.0/", "invalid deny list"},
+		{"", "fd00::/129", "invalid deny list"},
+		{"localhost", "", "neither an IP address nor a CIDR range"},
+		{"127.0.0.1,", "10.0.0.1;10.0.0.2", "invalid deny list"},
+		{"10.0.0.1/8/8", "", "invalid allow list"},
+	} {
+		if _, err := Parse(tc.allow, tc.deny); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("allow %q deny %q: got error %v, expected %q", tc.allow, tc.deny, err, tc.err)
+		}
+	}
+}
+
+func TestNil(t *testing.T) {
+	var acls *T
+	if !acls.Permits(net.ParseIP("192.0.2.1")) || acls.Denied() != 0 {
+		t.Error("nil ACL does not accept everything")
+	}
+}
+
+func TestDenied(t *testing.T) {
+	acls, err := Parse("", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	for i := 0; i < 3; i++ {
+		acls.Reject("test connection", addr)
+	}
+	if n := acls.Denied(); n != 3 {
+		t.Errorf("got %d denied, expected 3", n)
+	}
+}
@@ -27,26 +27,6 @@ import (
 	"github.com/wireleap/common/api/status"
 )
 
-func (t *T) download(u string) ([]byte, error) {
-	req, err := http.NewRequest(http.MethodGet, u, nil)
-	if err != nil {
-		return nil, err
-	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
-			"%s download request returned code %d: %s",
-			u, res.StatusCode, res.Status,
-		)
-	}
-	t.l.Printf("Downloading %s...", u)
-	return io.ReadAll(res.Body)
-}
-
 func (t *T) Import(u url.URL) (ak *accesskey.T, err error) {
 	data := []byte{}
 
@@ -57,6 +37,10 @@ func (t *T) Import(u url.URL) (ak *accesskey.T, err error) {
 		data, err = t.download(u.String())
 	case u.Scheme == "file":
 		data, err = ioutil.ReadFile(u.Path)
+	case u.Scheme == "data":
+		data, err = clientlib.ReadDataURL(u)
+	case u.Scheme == clientlib.AccesskeyTokenScheme:
+		data, err = clientlib.DecodeAccesskeyToken(u)
 	case !u.IsAbs():
 		return nil, fmt.Errorf("url is not absolute: %s", u.String())
 	case u.Scheme == "":
@@ -88,17 +72,6 @@ func (t *T) Import(u url.URL) (ak *accesskey.T, err error) {
 			accesskey.VERSION.Minor,
 		)
 	}
-	sc0 := clientlib.ContractURL(t.Fd)
-	if sc0 != nil && *sc0 != *ak.Contract.Endpoint {
-		return nil, fmt.Errorf(
-			"you are trying to import accesskeys for a contract %s different from the currently defined %s; please set up a separate wireleap directory for your %s needs and import %s accesskeys there",
-			ak.Contract.Endpoint,
-			sc0,
-			ak.Contract.Endpoint,
-			u.String(),
-		)
-	}
-
 	ci, d, err := clientlib.GetContractInfo(t.cl, ak.Contract.Endpoint)
 
 	if err != nil {
@@ -118,6 +91,20 @@ func (t *T) Import(u url.URL) (ak *accesskey.T, err error) {
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if sc0 := clientlib.ContractURL(t.Fd); sc0 != nil && *sc0 != *ak.Contract.Endpoint {
+		// keep accesskeys for other contracts aside until they are used
+		err = t.updateParked(ci, d, func(p *parked) {
+			p.pofs, _ = t.mergePofs(p.pofs, ak.Pofs...)
+		})
+		if err != nil {
+			return nil, fmt.Errorf(
+				"could not save new pofs for %s: %s",
+				ak.Contract.Endpoint, err,
+			)
+		}
+		t.l.Printf("imported accesskeys for inactive contract %s", ak.Contract.Endpoint)
+		return
+	}
 	t.ci = ci
 	if err = clientlib.SaveContractInfo(t.Fd, ci, d); err != nil {
 		return nil, fmt.Errorf(
@@ -127,25 +114,8 @@ func (t *T) Import(u url.URL) (ak *accesskey.T, err error) {
 		)
 	}
 	sc := ci.Endpoint
-	for _, p := range ak.Pofs {
-		if p.Expiration <= time.Now().Unix() {
-			t.l.Printf("skipping expired accesskey %s", p.Digest())
-			continue
-		}
-		dup := false
-		for _, p0 := range t.pofs {
-			if p0.Digest() == p.Digest() {
-				t.l.Printf("skipping duplicate accesskey %s", p.Digest())
-				dup = true
-				break
-			}
-		}
-		if !dup {
-			t.pofs = append(t.pofs, p)
-		}
-	}
-
-	if err = t.Fd.SetIndented(t.pofs, filenames.Pofs); err != nil {
+	t.addPofs(ak.Pofs...)
+	if err = t.setSecret(t.pofs, filenames.Pofs); err != nil {
 		return nil, fmt.Errorf(
 			"could not save new pofs for %s: %s",
 			sc.String(), err,
@@ -178,18 +148,52 @@ func (t *T) Import(u url.URL) (ak *accesskey.T, err error) {
 	return
 }
 
+// addPofs adds the pofs which are neither expired nor known already. It is best
+// to lock mutex at the calling site while using this function.
+func (t *T) addPofs(ps ...*pof.T) (added []*pof.T) {
+	t.pofs, added = t.mergePofs(t.pofs, ps...)
+	return
+}
+
+// mergePofs adds the pofs ps which are neither expired nor in have to have.
+func (t *T) mergePofs(have []*pof.T, ps ...*pof.T) (all, added []*pof.T) {
+	all = have
+	for _, p := range ps {
+		if p.Expiration <= t.now().Unix() {
+			t.l.Printf("skipping expired accesskey %s", p.Digest())
+			continue
+		}
+		dup := false
+		for _, p0 := range all {
+			if p0.Digest() == p.Digest() {
+				t.l.Printf("skipping duplicate accesskey %s", p.Digest())
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			all = append(all, p)
+			added = append(added, p)
+		}
+	}
+	return
+}
+
 func (t *T) GetSK(fetch bool) (*servicekey.T, error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	if t.sk == nil {
-		t.Fd.Get(&t.sk, "servicekey.json")
+		t.getSecret(&t.sk, filenames.Servicekey)
 	}
-	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(time.Now().Unix()) {
+	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(t.now().Unix()) {
 		t.l.Printf(
 			"found existing servicekey %s",
 			t.sk.PublicKey,
 		)
+		if fetch {
+			t.skUsed = true
+		}
 		return t.sk, nil
 	}
 	if !t.cfg.Broker.Accesskey.UseOnDemand {
@@ -200,8 +204,17 @@ func (t *T) GetSK(fetch bool) (*servicekey.T, error) {
 	}
 	// discard old servicekey & get a new one
 	if err := t.RefreshSK(); err != nil {
-		return nil, fmt.Errorf("could not refresh servicekey: %s", err)
+		if !t.failover(err) {
+			return nil, fmt.Errorf("could not refresh servicekey: %s", err)
+		}
+		// the other contract may need a new servicekey as well
+		if t.sk == nil || t.sk.Contract == nil || t.sk.IsExpiredAt(t.now().Unix()) {
+			if err = t.RefreshSK(); err != nil {
+				return nil, fmt.Errorf("could not refresh servicekey: %s", err)
+			}
+		}
 	}
+	t.skUsed = true
 	return t.sk, nil
 }
 
@@ -221,14 +234,18 @@ func (t *T) NewSKFromPof(skurl string, p *pof.T) (*servicekey.T, error) {
 // It is best to lock mutex at the calling site while using this function.
 func (t *T) RefreshSK() (err error) {
 	if len(t.pofs) == 0 {
-		return fmt.Errorf("no fresh pofs available")
+		return fmt.Errorf("no fresh pofs available: %w", errNoAccesskeys)
 	}
 	if clientlib.ContractURL(t.Fd) == nil {
 		return fmt.Errorf("no contract defined")
 	}
 	newps := []*pof.T{}
+	// pof the new servicekey was activated with, recorded once it is saved
+	var activated *pof.T
+	// last activation error, kept so failover can tell why it failed
+	var lasterr error
 	// filter pofs & get sk
-	now := time.Now().Unix()
+	now := t.now().Unix()
 	for _, p := range t.pofs {
 		if p.IsExpiredAt(now) {
 			// leave the expired pof out
@@ -254,9 +271,11 @@ func (t *T) RefreshSK() (err error) {
 					continue
 				}
 				// keep if other error
+				lasterr = err
 				newps = append(newps, p)
 				continue
 			}
+			activated = p
 			// skip successfully-used pof
 			continue
 		}
@@ -266,7 +285,7 @@ func (t *T) RefreshSK() (err error) {
 	// now left with: faulty and untouched pofs
 	t.pofs = newps
 	// write new pofs
-	if err = t.Fd.SetIndented(&t.pofs, filenames.Pofs); err != nil {
+	if err = t.setSecret(&t.pofs, filenames.Pofs); err != nil {
 		return fmt.Errorf(
 			"could not write new %s: %s",
 			filenames.Pofs,
@@ -275,16 +294,26 @@ func (t *T) RefreshSK() (err error) {
 	}
 	// still no fresh sk present? (iterated over all pofs without result)
 	if t.sk == nil || t.sk.IsExpiredAt(now) {
+		if len(t.pofs) == 0 {
+			// all used up or expired
+			return fmt.Errorf("no servicekey available: %w", errNoAccesskeys)
+		}
+		if lasterr != nil {
+			return fmt.Errorf("no servicekey available: %w", lasterr)
+		}
 		return fmt.Errorf("no servicekey available")
 	}
 	// write new servicekey
-	if err = t.Fd.SetIndented(&t.sk, filenames.Servicekey); err != nil {
+	if err = t.setSecret(&t.sk, filenames.Servicekey); err != nil {
 		return fmt.Errorf(
 			"could not write new %s: %s",
 			filenames.Servicekey,
 			err,
 		)
 	}
+	if activated != nil {
+		t.recordActivation(activated, t.sk)
+	}
 	return nil
 }
 
@@ -298,7 +327,7 @@ func (t *T) Activate() (err error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	if t.sk == nil {
-		if err = t.Fd.Get(t.sk, filenames.Servicekey); err != nil {
+		if _, err = t.getSecret(&t.sk, filenames.Servicekey); err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrNotExist) {
 				// this is fine
 			} else {
@@ -309,7 +338,7 @@ func (t *T) Activate() (err error) {
 			}
 		}
 	}
-	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(time.Now().Unix()) {
+	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(t.now().Unix()) {
 		return fmt.Errorf(
 			"refusing to replace non-expired servicekey: %s expires at %s",
 			filenames.Servicekey,
@@ -320,7 +349,8 @@ func (t *T) Activate() (err error) {
 	if err = t.RefreshSK(); err != nil {
 		return fmt.Errorf("error while activating servicekey with pof: %s", err)
 	}
-	if err = t.Fd.SetIndented(t.sk, filenames.Servicekey); err != nil {
+	t.skUsed = false
+	if err = t.setSecret(t.sk, filenames.Servicekey); err != nil {
 		return fmt.Errorf("could not write new servicekey: %s", err)
 	}
 	t.reload()
@@ -0,0 +1,40 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/wireleap/client/filenames"
+)
+
+func TestRefreshSK(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		br := rolloverBroker(t, &activator{}, testPofs(2))
+		br.sk = nil
+		if fail {
+			// writing the servicekey fails if a directory is in the way
+			if err := os.Mkdir(br.Fd.Path(filenames.Servicekey), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := br.RefreshSK()
+		if (err != nil) != fail {
+			t.Fatalf("write failure %v: got error %v", fail, err)
+		}
+		h := br.History()
+		if fail {
+			if len(h) != 0 {
+				t.Errorf("uncommitted activation recorded: %+v", h)
+			}
+			continue
+		}
+		if len(h) != 1 || h[0].Servicekey != br.sk.PublicKey.String() {
+			t.Errorf("activation not recorded: %+v", h)
+		}
+		if mem, disk := storedPofs(t, br); len(mem) != 1 || len(disk) != 1 {
+			t.Errorf("used pof kept: %v %v", mem, disk)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/socks"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/flushwriter"
+	"github.com/wireleap/common/wlnet/h2conn"
+	"github.com/wireleap/common/wlnet/h2rwc"
+	"github.com/wireleap/common/wlnet/transport"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// bindRelay starts a stand-in exit relay which handles BIND by listening on
+// a local port or, if reject is set, rejects the command.
+func bindRelay(t *testing.T, reject bool) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Trailer", status.Header)
+		c := h2rwc.T{Writer: flushwriter.T{Writer: w}, ReadCloser: r.Body}
+		defer c.Close()
+		p, err := wlnet.InitFromHeaders(r.Header)
+		if err != nil || p.Command != "BIND" || reject {
+			(&status.T{Code: http.StatusBadRequest, Desc: "unknown command in payload", Origin: "stand-in"}).ToHeader(h)
+			return
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("stand-in relay: %s", err)
+			return
+		}
+		defer l.Close()
+		c.Write(append([]byte{socks.SOCKSv5, byte(socks.StatusOK), socks.RSV}, socks.AddrAddr(l.Addr())...))
+		pc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write(append([]byte{socks.SOCKSv5, byte(socks.StatusOK), socks.RSV}, socks.AddrAddr(pc.RemoteAddr())...))
+		wlnet.Splice(context.Background(), c, pc, 0, 32768)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// bindVia sends a BIND request to a broker using a single-hop circuit
+// consisting of the relay at relayURL like wireleap_socks does.
+func bindVia(t *testing.T, relayURL string) *h2conn.T {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "wireleap"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := testBroker(t)
+	br.T = transport.New(transport.Options{Timeout: 5 * time.Second})
+	br.sk = servicekey.New(priv)
+	br.sk.Contract.SettlementOpen = time.Now().Add(time.Hour).Unix()
+	br.circ = []*relayentry.T{{Role: "backing", Addr: &texturl.URL{URL: *u}, Pubkey: jsonb.PK(pub)}}
+	s := httptest.NewServer(h2c.NewHandler(br, &http2.Server{}))
+	t.Cleanup(s.Close)
+	tt := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	c, err := h2conn.New(tt, s.URL+"/broker", map[string]string{
+		"Wl-Dial-Command":  "BIND",
+		"Wl-Dial-Protocol": "tcp",
+		"Wl-Dial-Target":   "192.0.2.1:20",
+		"Wl-Forwarder":     "socks",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestBind(t *testing.T) {
+	c := bindVia(t, bindRelay(t, false).URL)
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	st, la, err := socks.ReadReply(c)
+	if err != nil || st != socks.StatusOK {
+		t.Fatalf("first reply: %s %v", st, err)
+	}
+	pc, err := net.Dial("tcp", la.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if st, _, err = socks.ReadReply(c); err != nil || st != socks.StatusOK {
+		t.Fatalf("second reply: %s %v", st, err)
+	}
+	if _, err = c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	pc.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = io.ReadFull(pc, b); err != nil || string(b) != "ping" {
+		t.Errorf("peer got %q %v, want ping", b, err)
+	}
+}
+
+func TestBindRejected(t *testing.T) {
+	c := bindVia(t, bindRelay(t, true).URL)
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	// the error must not end up in the stream as if the relay sent it
+	b, err := io.ReadAll(c)
+	if len(b) != 0 {
+		t.Errorf("got %q in the stream after the relay rejected the command", b)
+	}
+	if err == nil {
+		t.Error("no error after the relay rejected the command")
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
@@ -50,6 +49,8 @@ type T struct {
 	// currently active circuit
 	// only one, should be mutex-protected
 	circ circuit.T
+	// isolation groups with their own circuits, mutex-protected
+	iso map[string]*isolationGroup
 	// transport
 	*transport.T
 	// broker prefix logger
@@ -57,6 +58,29 @@ type T struct {
 	// accesskey manager state
 	sk   *servicekey.T
 	pofs []*pof.T
+	// whether sk was used for dialing, so it is worth rolling over
+	skUsed bool
+	// number of contract switches, to notice them while not holding the lock
+	switches int
+	// number of open connections by servicekey public key
+	skConns map[string]int
+	// servicekey activation history, oldest first
+	history []*Activation
+	// number of accesskey warning thresholds already warned about
+	warned int
+	// clock offset estimate (has its own lock as it is updated by requests
+	// made while holding the global one)
+	clk clock
+	// whether the clock offset was warned about
+	clkWarned bool
+	// traffic totals (has its own lock as it is updated on every read and
+	// write of spliced connections)
+	usage usage
+	// passphrase source and passphrase servicekey and pofs are encrypted
+	// with, if any
+	passSrc, passphrase string
+	// closed on shutdown
+	done chan struct{}
 	// contract info
 	ci *contractinfo.T
 	// relay list
@@ -74,44 +98,51 @@ func New(fd fsdir.T, cfg *clientcfg.C, l *log.Logger) *T {
 		Fd: fd,
 		cl: client.New(nil, clientcontract.T, clientdir.T),
 		// cache dns resolution in netstack transport
-		cache: dnscachedial.New(),
-		T:     transport.New(transport.Options{Timeout: time.Duration(cfg.Broker.Circuit.Timeout)}),
-		cfg:   cfg,
-		l:     l,
+		cache:   dnscachedial.New(),
+		T:       transport.New(transport.Options{Timeout: time.Duration(cfg.Broker.Circuit.Timeout)}),
+		cfg:     cfg,
+		l:       l,
+		iso:     map[string]*isolationGroup{},
+		skConns: map[string]int{},
+		done:    make(chan struct{}),
 	}
 	var err error
-	if err = t.Fd.Get(&t.pofs, filenames.Pofs); err != nil {
-		if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrNotExist) {
-			t.l.Fatalf("could not get previous pofs to initialize accesskeys: %s", err)
-		}
+	t.passSrc = cfg.Broker.Accesskey.PassphraseSource
+	if t.passphrase, err = clientlib.Passphrase(t.passSrc); err != nil {
+		t.l.Fatalf("could not get passphrase to initialize accesskeys: %s", err)
 	}
-	if err = t.Fd.Get(&t.sk, filenames.Servicekey); err != nil {
-		if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrNotExist) {
-			t.l.Fatalf(
-				"could not get apparently existing %s to initialize accesskeys: %s",
-				filenames.Servicekey, err,
-			)
-		}
+	if err = t.loadSecrets(); err != nil {
+		t.l.Fatalf("could not initialize accesskeys: %s", err)
+	}
+	if err = t.loadHistory(); err != nil {
+		t.l.Printf("could not read %s: %s", filenames.Activations, err)
+	}
+	if err = t.loadUsage(); err != nil {
+		t.l.Printf("could not read %s: %s", filenames.Usage, err)
 	}
 	if cfg.Broker.Address == nil {
 		t.l.Fatal("broker.address is nil in config, please set it")
 	}
 	t.T.Transport.DialContext = t.cache.Cover(t.T.Transport.DialContext)
 	t.T.Transport.DialTLSContext = t.cache.Cover(t.T.Transport.DialTLSContext)
-	t.cl.Transport = t.T.Transport
+	t.cl.Transport = &clockTransport{t.T.Transport, &t.clk}
 	t.ucl = client.New(nil)
 	t.ucl.RetryOpt.Tries = 1
 	t.ucl.RetryOpt.Interval = 1 * time.Millisecond
 	t.ucl.RetryOpt.Verbose = false
-	// TODO: unhardcode
+	// the host part of the url is the name of the forwarder
 	t.ucl.SetTransport(&http.Transport{
-		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-			return net.Dial("unix", t.Fd.Path("wireleap_tun.sock"))
+		DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+			name, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return net.Dial("unix", t.Fd.Path("wireleap_"+name+".sock"))
 		},
 	})
 	if cu := clientlib.ContractURL(t.Fd); cu != nil {
 		// cache dns, sc and directory data if we can
-		if err = t.Sync(); err != nil {
+		if err = t.Sync(); err != nil && !t.failover(err) {
 			t.l.Fatalf("could not get contract info: %s", err)
 		}
 		// cache relay ip addresses for tun
@@ -126,6 +157,9 @@ func New(fd fsdir.T, cfg *clientcfg.C, l *log.Logger) *T {
 		t.cache.Cache(context.Background(), t.ci.Directory.Endpoint.Hostname())
 	}
 	t.cl.RetryOpt.Interval = 1 * time.Second
+	go t.rollover()
+	go t.forecasts()
+	go t.usageSaver()
 	return t
 }
 
@@ -143,27 +177,13 @@ func (t *T) Circuit() (r []*relayentry.T, err error) {
 	if t.circ != nil {
 		return t.circ, nil
 	}
-	var all circuit.T
-	haveWL := t.cfg.Broker.Circuit.Whitelist != nil && len(t.cfg.Broker.Circuit.Whitelist) > 0
-	if haveWL {
-		for _, addr := range t.cfg.Broker.Circuit.Whitelist {
-			if t.rl[addr] != nil {
-				all = append(all, t.rl[addr])
-			}
-		}
-	} else {
-		all = t.rl.All()
-	}
-	if r, err = circuit.Make(t.cfg.Broker.Circuit.Hops, all); err != nil {
-		if haveWL {
-			err = fmt.Errorf("%w (broker.circuit.whitelist is non-empty)", err)
-		}
+	if r, err = t.makeCircuit(t.otherCircuits("")...); err != nil {
 		return
 	}
 	t.circ = r
 	// ignore error here as tun is not necessarily running
 	// TODO expose whether tun is running cleanly
-	_ = t.writeBypass(t.cache.Get(t.circ[0].Addr.Hostname())...)
+	_ = t.writeBypass(t.bypassRelays()...)
 	return
 }
 
@@ -176,11 +196,37 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	protocol := r.Header.Get("Wl-Dial-Protocol")
 	target := r.Header.Get("Wl-Dial-Target")
+	command := r.Header.Get("Wl-Dial-Command")
+	switch command {
+	case "":
+		command = "CONNECT"
+	case "CONNECT", "BIND":
+		// OK
+	default:
+		status.ErrRequest.WriteTo(w)
+		return
+	}
 	fwdr := r.Header.Get("Wl-Forwarder")
 	if fwdr == "" {
 		fwdr = "unnamed_forwarder"
 	}
-	t.l.Printf("%s forwarder connected", fwdr)
+	// connections with an isolation key get their own circuit
+	var iso string
+	circuitf := t.Circuit
+	if key := r.Header.Get("Wl-Isolation"); key != "" {
+		iso = isolationID(key)
+		release, err := t.acquireIsolation(iso)
+		if err != nil {
+			t.l.Printf("%s forwarder rejected: %s", fwdr, err)
+			status.ErrGateway.WriteTo(w)
+			return
+		}
+		defer release()
+		t.l.Printf("%s forwarder connected (isolation group %s)", fwdr, iso)
+		circuitf = t.isolatedCircuit(iso)
+	} else {
+		t.l.Printf("%s forwarder connected", fwdr)
+	}
 	dialf := t.T.DialWL
 	// force target protocol if needed
 	tproto, ok := os.LookupEnv("WIRELEAP_TARGET_PROTOCOL")
@@ -192,20 +238,37 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return dialf(c, proto, remote, p)
 		}
 	}
-	dialer := clientlib.CircuitDialer(
-		func() (*servicekey.T, error) { return t.GetSK(true) },
-		t.Circuit,
+	// keep track of the circuit used for tracing errors
+	var circ circuit.T
+	// keep track of the servicekey used for draining on rollover
+	var sk *servicekey.T
+	dialer := clientlib.CircuitCommandDialer(
+		func() (r *servicekey.T, err error) {
+			r, err = t.GetSK(true)
+			sk = r
+			return
+		},
+		func() (r []*relayentry.T, err error) {
+			r, err = circuitf()
+			circ = r
+			return
+		},
 		dialf,
 	)
-	cc, err := dialer(protocol, target)
+	cc, err := dialer(command, protocol, target)
 	if err != nil {
 		t.l.Printf("%s->h2->circuit dial failure: %s", fwdr, err)
+		trailStatus(w, err)
 		return
 	}
+	t.holdSK(sk)
+	if sk != nil {
+		cc = t.countUsage(cc, fwdr, sk)
+	}
 	rwc := h2rwc.T{flushwriter.T{w}, r.Body}
 	err = wlnet.Splice(context.Background(), rwc, cc, 0, 32*1024)
 	if err != nil {
-		if o := clientlib.TraceOrigin(err, t.circ); o != nil {
+		if o := clientlib.TraceOrigin(err, circ); o != nil {
 			if status.IsCircuitError(err) {
 				// reset on circuit errors
 				t.l.Printf(
@@ -213,9 +276,13 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					o.Pubkey,
 					err,
 				)
-				t.mu.Lock()
-				t.circ = nil
-				t.mu.Unlock()
+				if iso != "" {
+					t.resetIsolation(iso)
+				} else {
+					t.mu.Lock()
+					t.circ = nil
+					t.mu.Unlock()
+				}
 			} else {
 				// not reset-worthy
 				t.l.Printf("error from %s: %s", o.Pubkey, err)
@@ -223,14 +290,29 @@ func (t *T) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else {
 			t.l.Printf("circuit dial error: %s", err)
 		}
-		status.ErrGateway.WriteTo(w)
+		trailStatus(w, err)
 	}
 	cc.Close()
 	rwc.Close()
+	t.releaseSK(sk)
 }
 
-// TODO: unhardcode
-// write bypass to tun bypass API
+// trailStatus reports err to the forwarder in the status trailer rather than
+// the response body, which is the spliced connection. Relay errors are passed
+// on as is.
+func trailStatus(w http.ResponseWriter, err error) {
+	st := status.ErrGateway
+	if !errors.As(err, &st) {
+		st = status.ErrGateway.Wrap(err)
+	}
+	w.Header().Set(http.TrailerPrefix+status.Header, st.Error())
+}
+
+// bypassFwders are the forwarders which need to know which addresses must not
+// be tunneled.
+var bypassFwders = []string{"tun", "redirect"}
+
+// write bypass to the bypass API of all running bypassFwders
 func (t *T) writeBypass(extra ...string) error {
 	// contract/dir is always bypassed
 	if clientlib.ContractURL(t.Fd) == nil {
@@ -245,26 +327,34 @@ func (t *T) writeBypass(extra ...string) error {
 	}
 	dir := t.cache.Get(t.ci.Directory.Endpoint.Hostname())
 	bypass := append(append(sc, dir...), extra...)
-	var out *status.T
-	if err := t.ucl.Perform(http.MethodPost, "http://localhost/bypass", bypass, &out); err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			if errors.As(err, &out) {
-				return out
-			} else {
-				return err
+	// a failure to reach one forwarder must not keep the others from
+	// getting the bypass, so only the first error is kept
+	var err error
+	for _, name := range bypassFwders {
+		var out *status.T
+		if err1 := t.ucl.Perform(http.MethodPost, "http://"+name+"/bypass", bypass, &out); err1 != nil && err == nil {
+			if !errors.Is(err1, os.ErrNotExist) {
+				if errors.As(err1, &out) {
+					err = out
+				} else {
+					err = err1
+				}
 			}
 		}
 	}
-	return nil
+	return err
 }
 
 func (t *T) WriteBypass() (err error) {
-	if t.circ == nil {
+	t.mu.Lock()
+	relays := t.bypassRelays()
+	t.mu.Unlock()
+	if len(relays) == 0 {
 		if err = t.writeBypass(); err != nil {
 			err = fmt.Errorf("could not write sc/dir bypass: %w", err)
 		}
 	} else {
-		if err = t.writeBypass(t.cache.Get(t.circ[0].Addr.Hostname())...); err != nil {
+		if err = t.writeBypass(relays...); err != nil {
 			err = fmt.Errorf("could not write sc/dir/relay bypass: %w", err)
 		}
 	}
@@ -277,9 +367,12 @@ func (t *T) Sync() (err error) {
 		err = fmt.Errorf("contract is not defined")
 		return
 	}
-	if t.ci, err = consume.ContractInfo(t.cl, sc); err != nil {
+	// not consume.ContractInfo as the error has to stay inspectable for
+	// failover
+	t.ci = nil
+	if err = t.cl.Perform(http.MethodGet, sc.String()+"/info", nil, &t.ci); err != nil {
 		err = fmt.Errorf(
-			"could not get contract info for %s: %s",
+			"could not get contract info for %s: %w",
 			sc.String(), err,
 		)
 		return
@@ -341,16 +434,28 @@ func (t *T) reload() {
 		)
 		return
 	}
-	// refresh contract info
-	if err := t.Sync(); err != nil {
+	if err := t.setPassphraseSource(t.cfg.Broker.Accesskey.PassphraseSource); err != nil {
 		t.l.Printf(
-			"could not refresh contract info: %s, aborting reload",
+			"could not change accesskey encryption: %s, keeping previous setting",
 			err,
 		)
-		return
+		t.cfg.Broker.Accesskey.PassphraseSource = t.passSrc
 	}
-	// reset circuit
+	// refresh contract info
+	if err := t.Sync(); err != nil {
+		if !t.failover(err) {
+			t.l.Printf(
+				"could not refresh contract info: %s, aborting reload",
+				err,
+			)
+			return
+		}
+	}
+	// reset circuits
 	t.circ = nil
+	for _, g := range t.iso {
+		g.circ = nil
+	}
 }
 
 func (t *T) Reload() {
@@ -361,6 +466,8 @@ func (t *T) Reload() {
 
 func (t *T) Shutdown() {
 	t.l.Println("gracefully shutting down...")
+	close(t.done)
+	t.saveUsage()
 	t.Fd.Del(filenames.Pid)
 }
 
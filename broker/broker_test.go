@@ -0,0 +1,172 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/clientcfg"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/auth"
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/dirinfo"
+	"github.com/wireleap/common/api/duration"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/signer"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/cli/fsdir"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/flushwriter"
+	"github.com/wireleap/common/wlnet/h2rwc"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+// testBroker returns a broker with a temporary wireleap home and the default
+// config which does not talk to any contract or start background tasks.
+func testBroker(t *testing.T) *T {
+	fd, err := fsdir.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := clientcfg.Defaults()
+	return &T{
+		Fd:      fd,
+		cfg:     &cfg,
+		l:       log.New(io.Discard, "", 0),
+		iso:     map[string]*isolationGroup{},
+		skConns: map[string]int{},
+		done:    make(chan struct{}),
+	}
+}
+
+// testSK returns a new servicekey expiring at exp.
+func testSK(t *testing.T, exp time.Time) *servicekey.T {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := servicekey.New(priv)
+	sk.Contract.SettlementOpen = exp.Unix()
+	return sk
+}
+
+// testContract is a stand-in contract with its own directory.
+type testContract struct {
+	ci  *contractinfo.T
+	key ed25519.PrivateKey
+}
+
+// newContract starts a stand-in contract serving its info, an empty relay
+// list and anything else (e.g. activation requests) using h.
+func newContract(t *testing.T, h http.Handler) *testContract {
+	tc := &testContract{}
+	_, tc.key, _ = ed25519.GenerateKey(nil)
+	dpub, dpriv, _ := ed25519.GenerateKey(nil)
+	mux := http.NewServeMux()
+	reply := func(w http.ResponseWriter, x interface{}) {
+		b, err := json.Marshal(x)
+		if err != nil {
+			t.Errorf("stand-in contract: %s", err)
+		}
+		// directory replies are signed
+		auth.SetHeader(w.Header(), auth.Directory, auth.Pubkey, jsonb.PK(dpub).String())
+		auth.SetHeader(w.Header(), auth.Directory, auth.Signature, jsonb.B(ed25519.Sign(dpriv, b)).String())
+		w.Write(b)
+	}
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) { reply(w, tc.ci) })
+	mux.HandleFunc("/dir/info", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, &dirinfo.T{PublicKey: jsonb.PK(dpub), Endpoint: tc.ci.Directory.Endpoint})
+	})
+	mux.HandleFunc("/dir/relays", func(w http.ResponseWriter, r *http.Request) { reply(w, relaylist.T{}) })
+	if h != nil {
+		mux.Handle("/", h)
+	}
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	du := *u
+	du.Path = "/dir"
+	tc.ci = &contractinfo.T{
+		Pubkey:     jsonb.PK(tc.key.Public().(ed25519.PublicKey)),
+		Endpoint:   &texturl.URL{URL: *u},
+		Servicekey: contractinfo.Servicekey{Duration: duration.T(time.Hour)},
+		Directory:  contractinfo.Directory{Endpoint: &texturl.URL{URL: du}, PublicKey: jsonb.PK(dpub)},
+	}
+	return tc
+}
+
+// sk returns a new servicekey activated by the contract expiring at exp.
+func (tc *testContract) sk(t *testing.T, exp time.Time) *servicekey.T {
+	sk := testSK(t, exp)
+	sk.Contract.Sign(signer.New(tc.key))
+	return sk
+}
+
+// useContract starts a stand-in contract serving h and configures br to use
+// it as if it was imported.
+func useContract(t *testing.T, br *T, h http.Handler) *testContract {
+	tc := newContract(t, h)
+	br.cl = client.New(nil)
+	br.ci = tc.ci
+	if err := br.Fd.SetIndented(br.ci, filenames.Contract); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// useCircuit starts a stand-in exit relay which handles CONNECT by dialing
+// the target directly and configures br to use it as a single-hop circuit
+// with a fresh servicekey. The targets dialed are sent to dialed.
+func useCircuit(t *testing.T, br *T, dialed chan<- string) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Trailer", status.Header)
+		c := h2rwc.T{Writer: flushwriter.T{Writer: w}, ReadCloser: r.Body}
+		defer c.Close()
+		p, err := wlnet.InitFromHeaders(r.Header)
+		if err != nil || p.Command != "CONNECT" {
+			(&status.T{Code: http.StatusBadRequest, Desc: "unknown command in payload", Origin: "stand-in"}).ToHeader(h)
+			return
+		}
+		dialed <- p.Remote.Host
+		pc, err := net.Dial(p.Protocol, p.Remote.Host)
+		if err != nil {
+			status.ErrGateway.Wrap(err).ToHeader(h)
+			return
+		}
+		wlnet.Splice(context.Background(), c, pc, 0, 32768)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "wireleap"
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br.T = transport.New(transport.Options{Timeout: 5 * time.Second})
+	br.sk = testSK(t, time.Now().Add(time.Hour))
+	br.circ = []*relayentry.T{{Role: "backing", Addr: &texturl.URL{URL: *u}, Pubkey: jsonb.PK(pub)}}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+)
+
+// BundleVersion is the version of the accesskey bundle format.
+var BundleVersion = semver.MustParse("0.1.0")
+
+// Bundle is a backup of the accesskey state of a wireleap directory which can
+// be restored elsewhere. If it was exported with a passphrase, only Version
+// and Sealed are set and the rest is sealed within.
+type Bundle struct {
+	Version    *semver.Version   `json:"version"`
+	Contract   *contractinfo.T   `json:"contract,omitempty"`
+	Servicekey *servicekey.T     `json:"servicekey,omitempty"`
+	Pofs       []*pof.T          `json:"pofs,omitempty"`
+	Sealed     *clientlib.Sealed `json:"sealed,omitempty"`
+}
+
+// Export bundles the contract info, the active servicekey and the unused pofs,
+// sealing them with passphrase if it is not empty.
+func (t *T) Export(passphrase string) (b *Bundle, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ci == nil {
+		return nil, fmt.Errorf("no contract defined")
+	}
+	now := t.now().Unix()
+	b = &Bundle{Version: &BundleVersion, Contract: t.ci, Pofs: []*pof.T{}}
+	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(now) {
+		b.Servicekey = t.sk
+	}
+	for _, p := range t.pofs {
+		if !p.IsExpiredAt(now) {
+			b.Pofs = append(b.Pofs, p)
+		}
+	}
+	if passphrase == "" {
+		return
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal bundle: %w", err)
+	}
+	s, err := clientlib.Seal(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("could not seal bundle: %w", err)
+	}
+	return &Bundle{Version: &BundleVersion, Sealed: s}, nil
+}
+
+// Restore imports the contents of a bundle exported by Export, opening it
+// with passphrase if it is sealed. As with Import, the contract public key is
+// checked against the live contract. The servicekey is only used if it is
+// fresher than the current one. Bundles for a contract other than the active
+// one are kept aside until it is used. It returns the contract info of the
+// bundle along with the pofs and servicekey which were added.
+func (t *T) Restore(b *Bundle, passphrase string) (ci *contractinfo.T, ps []*pof.T, sk *servicekey.T, err error) {
+	if b == nil {
+		return nil, nil, nil, fmt.Errorf("malformed accesskey bundle")
+	}
+	if err = checkBundleVersion(b.Version); err != nil {
+		return nil, nil, nil, err
+	}
+	if b.Sealed != nil {
+		if passphrase == "" {
+			return nil, nil, nil, fmt.Errorf("accesskey bundle is encrypted, a passphrase is required")
+		}
+		data, err := b.Sealed.Open(passphrase)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not open accesskey bundle: %w", err)
+		}
+		b = &Bundle{}
+		if err = json.Unmarshal(data, b); err != nil {
+			return nil, nil, nil, fmt.Errorf("could not unmarshal accesskey bundle: %w", err)
+		}
+		// the outer version is not authenticated, the sealed one is
+		if b.Sealed != nil {
+			return nil, nil, nil, fmt.Errorf("malformed accesskey bundle")
+		}
+		if err = checkBundleVersion(b.Version); err != nil {
+			return nil, nil, nil, fmt.Errorf("sealed accesskey bundle: %w", err)
+		}
+	}
+	switch {
+	case b.Contract == nil,
+		b.Contract.Endpoint == nil,
+		b.Contract.Pubkey == nil,
+		b.Servicekey != nil && b.Servicekey.Contract == nil:
+		return nil, nil, nil, fmt.Errorf("malformed accesskey bundle")
+	}
+	ci, d, err := clientlib.GetContractInfo(t.cl, b.Contract.Endpoint)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !bytes.Equal(b.Contract.Pubkey, ci.Pubkey) {
+		return nil, nil, nil, fmt.Errorf(
+			"contract public key mismatch; expecting %s from accesskey bundle, got %s from live contract",
+			base64.RawURLEncoding.EncodeToString(b.Contract.Pubkey),
+			base64.RawURLEncoding.EncodeToString(ci.Pubkey),
+		)
+	}
+	if b.Servicekey != nil {
+		if !bytes.Equal(b.Servicekey.Contract.PublicKey, ci.Pubkey) {
+			return nil, nil, nil, fmt.Errorf("servicekey in accesskey bundle was not activated by %s", ci.Endpoint)
+		}
+		if err = b.Servicekey.Contract.Verify(); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid servicekey in accesskey bundle: %w", err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if sc0 := clientlib.ContractURL(t.Fd); sc0 != nil && *sc0 != *b.Contract.Endpoint {
+		// keep accesskeys for other contracts aside until they are used
+		err = t.updateParked(ci, d, func(p *parked) {
+			p.pofs, ps = t.mergePofs(p.pofs, b.Pofs...)
+			if fresher(t.now(), b.Servicekey, p.sk) {
+				p.sk, sk = b.Servicekey, b.Servicekey
+			}
+		})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf(
+				"could not save restored accesskeys for %s: %s",
+				ci.Endpoint, err,
+			)
+		}
+		t.l.Printf("restored accesskeys for inactive contract %s", ci.Endpoint)
+		return
+	}
+	t.ci = ci
+	t.rl = d
+	if err = clientlib.SaveContractInfo(t.Fd, ci, d); err != nil {
+		return nil, nil, nil, fmt.Errorf(
+			"could not save contract info for %s: %s",
+			ci.Endpoint,
+			err,
+		)
+	}
+	ps = t.addPofs(b.Pofs...)
+	if err = t.setSecret(t.pofs, filenames.Pofs); err != nil {
+		return nil, nil, nil, fmt.Errorf(
+			"could not save new pofs for %s: %s",
+			ci.Endpoint, err,
+		)
+	}
+	if fresher(t.now(), b.Servicekey, t.sk) {
+		t.sk, sk = b.Servicekey, b.Servicekey
+		t.skUsed = false
+		if err = t.setSecret(t.sk, filenames.Servicekey); err != nil {
+			return nil, nil, nil, fmt.Errorf("could not write restored servicekey: %s", err)
+		}
+	}
+	return
+}
+
+// checkBundleVersion returns an error if v is not a bundle version Restore
+// understands.
+func checkBundleVersion(v *semver.Version) error {
+	if v == nil {
+		return fmt.Errorf("malformed accesskey bundle")
+	}
+	if v.Major != BundleVersion.Major || v.Minor != BundleVersion.Minor {
+		return fmt.Errorf(
+			"incompatible accesskey bundle version: %s, expected %d.%d.x",
+			v, BundleVersion.Major, BundleVersion.Minor,
+		)
+	}
+	return nil
+}
+
+// fresher returns whether sk is unexpired at now and expires later than cur.
+func fresher(now time.Time, sk, cur *servicekey.T) bool {
+	return sk != nil && sk.Contract != nil && !sk.IsExpiredAt(now.Unix()) &&
+		(cur == nil || cur.Contract == nil || cur.Contract.SettlementOpen < sk.Contract.SettlementOpen)
+}
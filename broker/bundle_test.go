@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+)
+
+// exportBroker returns a broker using a stand-in contract with a servicekey
+// and two fresh and one expired pof.
+func exportBroker(t *testing.T) *T {
+	br := testBroker(t)
+	tc := useContract(t, br, nil)
+	br.sk = tc.sk(t, time.Now().Add(time.Hour))
+	br.pofs = testPofs(3)
+	br.pofs[2].Expiration = time.Now().Add(-time.Minute).Unix()
+	return br
+}
+
+// transfer returns b as restored from a file.
+func transfer(t *testing.T, b *Bundle) *Bundle {
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Bundle{}
+	if err = json.Unmarshal(data, r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// restoreBroker returns a broker without a contract to restore bundles to.
+func restoreBroker(t *testing.T) *T {
+	br := testBroker(t)
+	br.cl = client.New(nil)
+	return br
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	for _, pass := range []string{"", "secret"} {
+		src := exportBroker(t)
+		b, err := src.Export(pass)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pass != "" && (b.Sealed == nil || b.Contract != nil || b.Servicekey != nil || b.Pofs != nil) {
+			t.Fatalf("sealed bundle leaks contents: %+v", b)
+		}
+		dst := restoreBroker(t)
+		if pass != "" {
+			for _, wrong := range []string{"", "wrong"} {
+				if _, _, _, err = dst.Restore(transfer(t, b), wrong); err == nil {
+					t.Errorf("restored sealed bundle with passphrase %q", wrong)
+				}
+			}
+		}
+		ci, ps, sk, err := dst.Restore(transfer(t, b), pass)
+		if err != nil {
+			t.Fatalf("passphrase %q: %s", pass, err)
+		}
+		if ci.Endpoint.String() != src.ci.Endpoint.String() || dst.ci == nil {
+			t.Errorf("passphrase %q: restored contract %s", pass, ci.Endpoint)
+		}
+		// expired pofs are not exported
+		if len(ps) != 2 || ps[0].Digest() != src.pofs[0].Digest() || ps[1].Digest() != src.pofs[1].Digest() {
+			t.Errorf("passphrase %q: restored pofs %v", pass, ps)
+		}
+		if sk == nil || sk.PublicKey.String() != src.sk.PublicKey.String() || dst.sk != sk {
+			t.Errorf("passphrase %q: servicekey not restored", pass)
+		}
+		var (
+			dps []*pof.T
+			dsk *servicekey.T
+		)
+		if err = dst.Fd.Get(&dps, filenames.Pofs); err != nil || len(dps) != 2 {
+			t.Errorf("passphrase %q: pofs not written: %v", pass, err)
+		}
+		if err = dst.Fd.Get(&dsk, filenames.Servicekey); err != nil || dsk.PublicKey.String() != sk.PublicKey.String() {
+			t.Errorf("passphrase %q: servicekey not written: %v", pass, err)
+		}
+		if u := clientlib.ContractURL(dst.Fd); u == nil || u.String() != src.ci.Endpoint.String() {
+			t.Errorf("passphrase %q: contract not written", pass)
+		}
+		// restoring again adds nothing
+		if _, ps, sk, err = dst.Restore(transfer(t, b), pass); err != nil || len(ps) != 0 || sk != nil {
+			t.Errorf("passphrase %q: restored again: %v %v %v", pass, ps, sk, err)
+		}
+	}
+}
+
+func TestBundleVersion(t *testing.T) {
+	src := exportBroker(t)
+	plain, err := src.Export("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// seal returns a bundle sealing inner with the current outer version
+	seal := func(inner *Bundle) *Bundle {
+		data, err := json.Marshal(inner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := clientlib.Seal(data, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Bundle{Version: &BundleVersion, Sealed: s}
+	}
+	patch := semver.MustParse("0.1.7")
+	newer := semver.MustParse("0.2.0")
+	major := semver.MustParse("1.1.0")
+	with := func(v *semver.Version) *Bundle {
+		b := *plain
+		b.Version = v
+		return &b
+	}
+	for _, tc := range []struct {
+		name string
+		b    *Bundle
+		err  string
+	}{
+		{"patch", with(&patch), ""},
+		{"sealed patch", seal(with(&patch)), ""},
+		{"nil", nil, "malformed"},
+		{"no version", with(nil), "malformed"},
+		{"minor", with(&newer), "incompatible accesskey bundle version: 0.2.0"},
+		{"major", with(&major), "incompatible accesskey bundle version: 1.1.0"},
+		{"sealed minor", seal(with(&newer)), "sealed accesskey bundle: incompatible accesskey bundle version: 0.2.0"},
+		{"sealed no version", seal(with(nil)), "sealed accesskey bundle: malformed"},
+		{"nested", seal(seal(plain)), "malformed"},
+		{"no contract", func() *Bundle { b := with(&patch); b.Contract = nil; return b }(), "malformed"},
+	} {
+		_, _, _, err := restoreBroker(t).Restore(tc.b, "secret")
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, expected %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestBundleMismatch(t *testing.T) {
+	src := exportBroker(t)
+	b, err := src.Export("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// contract key differs from the live one
+	ci := *b.Contract
+	ci.Pubkey = jsonb.PK(make([]byte, 32))
+	wrong := *b
+	wrong.Contract = &ci
+	if _, _, _, err = restoreBroker(t).Restore(&wrong, ""); err == nil || !strings.Contains(err.Error(), "public key mismatch") {
+		t.Errorf("got error %v, expected public key mismatch", err)
+	}
+	// servicekey not activated by the contract
+	wrong = *b
+	wrong.Servicekey = testSK(t, time.Now().Add(time.Hour))
+	if _, _, _, err = restoreBroker(t).Restore(&wrong, ""); err == nil || !strings.Contains(err.Error(), "was not activated by") {
+		t.Errorf("got error %v, expected servicekey rejection", err)
+	}
+}
+
+func TestExportNoContract(t *testing.T) {
+	if _, err := testBroker(t).Export(""); err == nil {
+		t.Error("exported without contract")
+	}
+}
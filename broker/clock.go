@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wireleap/common/api/duration"
+)
+
+const (
+	// number of recent responses the clock offset is estimated from
+	clockSamples = 15
+	// responses taking longer than this are too imprecise to estimate from
+	clockMaxRTT = 5 * time.Second
+)
+
+// ClockSkew describes the estimated offset of the local clock.
+type ClockSkew struct {
+	// Offset is how far the contract and directory clocks are ahead of the
+	// local one, negative if they are behind.
+	Offset duration.T `json:"offset"`
+	// Samples is the number of responses the estimate is based on.
+	Samples int `json:"samples"`
+	// Updated is the unix time of the latest response.
+	Updated int64 `json:"updated"`
+	// Compensated is set if the offset is applied in expiry checks.
+	Compensated bool `json:"compensated"`
+	// Warning is set if the offset exceeds broker.clock.warn.
+	Warning string `json:"warning,omitempty"`
+}
+
+// clock estimates the local clock offset from the Date headers of contract
+// and directory responses.
+type clock struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	offset  time.Duration
+	updated time.Time
+}
+
+// sample adds the offset indicated by a response with the given Date header
+// to a request sent at start and answered at end.
+func (c *clock) sample(date string, start, end time.Time) {
+	rtt := end.Sub(start)
+	if date == "" || rtt < 0 || rtt > clockMaxRTT {
+		return
+	}
+	d, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	// Date has a resolution of one second; assume the middle of it was
+	// reached halfway through the request
+	off := d.Add(time.Second / 2).Sub(start.Add(rtt / 2))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = append(c.samples, off)
+	if len(c.samples) > clockSamples {
+		c.samples = c.samples[len(c.samples)-clockSamples:]
+	}
+	// the median is not thrown off by the odd slow or misconfigured server
+	s := make([]time.Duration, len(c.samples))
+	copy(s, c.samples)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	c.offset = s[len(s)/2].Round(time.Second)
+	c.updated = end
+}
+
+// get returns the estimated offset and the number of samples it is based on.
+func (c *clock) get() (time.Duration, int, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset, len(c.samples), c.updated
+}
+
+// clockTransport samples the Date headers of the responses to the requests
+// it performs.
+type clockTransport struct {
+	rt  http.RoundTripper
+	clk *clock
+}
+
+func (c *clockTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := c.rt.RoundTrip(r)
+	if err == nil {
+		c.clk.sample(res.Header.Get("Date"), start, time.Now())
+	}
+	return res, err
+}
+
+// now returns the current time, corrected by the estimated clock offset if
+// broker.clock.compensate is set. It is best to lock mutex at the calling site
+// while using this function.
+func (t *T) now() time.Time {
+	return time.Now().Add(t.offset())
+}
+
+// offset returns the correction now applies to the local clock. It is best to
+// lock mutex at the calling site while using this function.
+func (t *T) offset() time.Duration {
+	if !t.cfg.Broker.Clock.Compensate {
+		return 0
+	}
+	off, _, _ := t.clk.get()
+	return off
+}
+
+// Now returns the current time as used for expiry checks.
+func (t *T) Now() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.now()
+}
+
+// ClockSkew returns the estimated clock offset or nil if there is no
+// estimate yet.
+func (t *T) ClockSkew() *ClockSkew {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.clockSkew()
+}
+
+// clockSkew returns the estimated clock offset or nil if there is no estimate
+// yet. It is best to lock mutex at the calling site while using this
+// function.
+func (t *T) clockSkew() *ClockSkew {
+	off, n, updated := t.clk.get()
+	if n == 0 {
+		return nil
+	}
+	c := &ClockSkew{
+		Offset:      duration.T(off),
+		Samples:     n,
+		Updated:     updated.Unix(),
+		Compensated: t.cfg.Broker.Clock.Compensate,
+	}
+	abs := off
+	if abs < 0 {
+		abs = -abs
+	}
+	if warn := time.Duration(t.cfg.Broker.Clock.Warn); warn > 0 && abs > warn {
+		dir := "behind"
+		if off < 0 {
+			dir = "ahead of"
+		}
+		c.Warning = fmt.Sprintf("local clock is %s %s the contract and directory clocks", duration.T(abs), dir)
+		if c.Compensated {
+			c.Warning += "; compensating in expiry checks"
+		} else {
+			c.Warning += "; fix the system clock or enable broker.clock.compensate"
+		}
+	}
+	return c
+}
+
+// checkClock logs a warning when the clock offset exceeds broker.clock.warn
+// and once more when it no longer does.
+func (t *T) checkClock() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.clockSkew()
+	if c == nil {
+		return
+	}
+	switch {
+	case c.Warning != "" && !t.clkWarned:
+		t.l.Printf("WARNING: %s", c.Warning)
+	case c.Warning == "" && t.clkWarned:
+		t.l.Printf("local clock is within %s of the contract and directory clocks again", t.cfg.Broker.Clock.Warn)
+	}
+	t.clkWarned = c.Warning != ""
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/duration"
+)
+
+// at is the middle of a second so Date headers of whole second offsets from
+// it give exact estimates.
+var at = time.Unix(1700000000, int64(time.Second/2))
+
+// sampleOff adds a sample indicating an offset of off to c.
+func sampleOff(c *clock, off time.Duration) {
+	c.sample((at.Add(off)).UTC().Format(http.TimeFormat), at, at)
+}
+
+func TestClockSample(t *testing.T) {
+	c := &clock{}
+	if off, n, _ := c.get(); off != 0 || n != 0 {
+		t.Errorf("empty clock: offset %s, %d samples", off, n)
+	}
+	sampleOff(c, 10*time.Second)
+	if off, n, updated := c.get(); off != 10*time.Second || n != 1 || !updated.Equal(at) {
+		t.Errorf("got offset %s, %d samples, updated %s", off, n, updated)
+	}
+	// the odd wrong clock does not throw off the median
+	for _, off := range []time.Duration{-time.Hour, 11 * time.Second, 10 * time.Second, 24 * time.Hour} {
+		sampleOff(c, off)
+	}
+	if off, n, _ := c.get(); off != 10*time.Second || n != 5 {
+		t.Errorf("got offset %s from %d samples, expected 10s from 5", off, n)
+	}
+	// the request duration is accounted for
+	c = &clock{}
+	c.sample(at.Add(time.Second+30*time.Second).UTC().Format(http.TimeFormat), at, at.Add(2*time.Second))
+	if off, _, _ := c.get(); off != 30*time.Second {
+		t.Errorf("got offset %s for a slow response, expected 30s", off)
+	}
+	// unusable responses are ignored
+	for _, tc := range []struct {
+		name       string
+		date       string
+		start, end time.Time
+	}{
+		{"no date", "", at, at},
+		{"malformed date", "yesterday", at, at},
+		{"slow", at.UTC().Format(http.TimeFormat), at, at.Add(clockMaxRTT + time.Second)},
+		{"negative rtt", at.UTC().Format(http.TimeFormat), at, at.Add(-time.Second)},
+	} {
+		c.sample(tc.date, tc.start, tc.end)
+		if _, n, _ := c.get(); n != 1 {
+			t.Errorf("%s: sample was used", tc.name)
+		}
+	}
+	// only the latest samples count
+	for i := 0; i < clockSamples; i++ {
+		sampleOff(c, -5*time.Second)
+	}
+	if off, n, _ := c.get(); off != -5*time.Second || n != clockSamples {
+		t.Errorf("got offset %s from %d samples, expected -5s from %d", off, n, clockSamples)
+	}
+}
+
+func TestClockTransport(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	}))
+	defer s.Close()
+	c := &clock{}
+	cl := &http.Client{Transport: &clockTransport{http.DefaultTransport, c}}
+	res, err := cl.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if off, n, _ := c.get(); n != 1 || off < time.Hour-time.Second || off > time.Hour+time.Second {
+		t.Errorf("got offset %s from %d samples, expected about 1h", off, n)
+	}
+}
+
+func TestNow(t *testing.T) {
+	br := testBroker(t)
+	sampleOff(&br.clk, 48*time.Hour)
+	near := func(a, b time.Time) bool { d := a.Sub(b); return d > -time.Second && d < time.Second }
+	if !near(br.Now(), time.Now()) {
+		t.Errorf("uncompensated time is %s", br.Now())
+	}
+	br.cfg.Broker.Clock.Compensate = true
+	want := time.Now().Add(48 * time.Hour)
+	if !near(br.Now(), want) {
+		t.Errorf("compensated time is %s, expected %s", br.Now(), want)
+	}
+	// activations and usage are recorded with the same time
+	sk := testSK(t, want.Add(time.Hour))
+	br.recordActivation(testPofs(1)[0], sk)
+	if a := br.history[0].Activated; a < want.Unix()-1 || a > want.Unix()+1 {
+		t.Errorf("activation recorded at %s, expected %s", time.Unix(a, 0), want)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	br.countUsage(c1, "socks", sk).Close()
+	us := br.Usage("", "")
+	if day := want.UTC().Format(UsageDay); len(us) != 1 || us[0].Day != day {
+		t.Errorf("usage recorded as %+v, expected day %s", us, day)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	br := testBroker(t)
+	buf := &bytes.Buffer{}
+	br.l = log.New(buf, "", 0)
+	br.cfg.Broker.Clock.Warn = duration.T(time.Minute)
+	if br.ClockSkew() != nil {
+		t.Error("skew reported without samples")
+	}
+	br.checkClock()
+	sampleOff(&br.clk, -2*time.Minute)
+	c := br.ClockSkew()
+	if c == nil || time.Duration(c.Offset) != -2*time.Minute || c.Samples != 1 || c.Updated != at.Unix() {
+		t.Fatalf("got skew %+v", c)
+	}
+	if !strings.Contains(c.Warning, "2m0s ahead of") || !strings.Contains(c.Warning, "enable broker.clock.compensate") {
+		t.Errorf("unexpected warning %q", c.Warning)
+	}
+	br.cfg.Broker.Clock.Compensate = true
+	if c = br.ClockSkew(); !c.Compensated || !strings.HasSuffix(c.Warning, "compensating in expiry checks") {
+		t.Errorf("unexpected compensated skew %+v", c)
+	}
+	// warned about once, then once more when back within bounds
+	br.checkClock()
+	br.checkClock()
+	if n := strings.Count(buf.String(), "WARNING"); n != 1 {
+		t.Errorf("warned %d times:\n%s", n, buf)
+	}
+	for i := 0; i < clockSamples; i++ {
+		sampleOff(&br.clk, 0)
+	}
+	br.checkClock()
+	br.checkClock()
+	if n := strings.Count(buf.String(), "again"); n != 1 {
+		t.Errorf("logged recovery %d times:\n%s", n, buf)
+	}
+	if c = br.ClockSkew(); c.Warning != "" {
+		t.Errorf("warning within bounds: %q", c.Warning)
+	}
+}
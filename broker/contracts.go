@@ -0,0 +1,395 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/relaylist"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/texturl"
+)
+
+// contractsDir is the directory the state of the contracts which are not
+// active is kept in, one subdirectory per contract. The state of the active
+// contract is kept in the wireleap directory itself.
+const contractsDir = "contracts"
+
+// ErrNoContract is returned when switching to a contract which is not known.
+var ErrNoContract = errors.New("no such contract")
+
+// errNoAccesskeys is wrapped by the errors of RefreshSK when the active
+// contract has no usable pofs left.
+var errNoAccesskeys = errors.New("no accesskeys left")
+
+// Contract describes a known contract and its accesskeys.
+type Contract struct {
+	// Endpoint is the contract endpoint.
+	Endpoint *texturl.URL `json:"endpoint"`
+	// Active is set for the contract currently in use.
+	Active bool `json:"active"`
+	// Pofs is the number of inactive accesskeys which have not expired.
+	Pofs int `json:"pofs"`
+	// Expiration is the unix time the servicekey expires at, 0 if there is
+	// no usable servicekey.
+	Expiration int64 `json:"expiration"`
+}
+
+// parked is the state of a contract which is not active.
+type parked struct {
+	ci   *contractinfo.T
+	rl   relaylist.T
+	sk   *servicekey.T
+	pofs []*pof.T
+}
+
+// summary describes the contract state in p at the unix time now.
+func (p *parked) summary(now int64, active bool) *Contract {
+	c := &Contract{Endpoint: p.ci.Endpoint, Active: active}
+	for _, x := range p.pofs {
+		if !x.IsExpiredAt(now) {
+			c.Pofs++
+		}
+	}
+	if p.sk != nil && p.sk.Contract != nil && !p.sk.IsExpiredAt(now) {
+		c.Expiration = p.sk.Contract.SettlementOpen
+	}
+	return c
+}
+
+// noFile returns whether err is due to a missing or empty file.
+func noFile(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, os.ErrNotExist)
+}
+
+// contractID returns the name of the directory the state of the contract at u
+// is parked in. It is hashed as no mapping of urls to file names that keeps
+// them readable is free of collisions.
+func contractID(u *texturl.URL) string {
+	h := sha256.Sum256([]byte(u.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// parkedIDs returns the IDs of the parked contracts.
+func (t *T) parkedIDs() (ids []string, err error) {
+	des, err := os.ReadDir(t.Fd.Path(contractsDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, de := range des {
+		if de.IsDir() {
+			ids = append(ids, de.Name())
+		}
+	}
+	return
+}
+
+// loadParked reads the state of the parked contract id.
+func (t *T) loadParked(id string) (p *parked, err error) {
+	// fsdir.Get creates missing directories so check first
+	if _, err = os.Stat(t.Fd.Path(contractsDir, id)); err != nil {
+		return nil, err
+	}
+	p = &parked{}
+	if err = t.Fd.Get(&p.ci, contractsDir, id, filenames.Contract); err != nil {
+		return nil, err
+	}
+	if p.ci == nil || p.ci.Endpoint == nil {
+		return nil, fmt.Errorf("malformed contract info in %s", t.Fd.Path(contractsDir, id))
+	}
+	if err = t.Fd.Get(&p.rl, contractsDir, id, filenames.Relays); err != nil && !noFile(err) {
+		return nil, err
+	}
+	if _, err = t.getSecret(&p.sk, contractsDir, id, filenames.Servicekey); err != nil && !noFile(err) {
+		return nil, err
+	}
+	if _, err = t.getSecret(&p.pofs, contractsDir, id, filenames.Pofs); err != nil && !noFile(err) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// saveParked writes the state of the parked contract p.
+func (t *T) saveParked(p *parked) (err error) {
+	id := contractID(p.ci.Endpoint)
+	if err = t.Fd.SetIndented(p.ci, contractsDir, id, filenames.Contract); err != nil {
+		return
+	}
+	if p.rl != nil {
+		if err = t.Fd.SetIndented(p.rl, contractsDir, id, filenames.Relays); err != nil {
+			return
+		}
+	}
+	if p.pofs == nil {
+		p.pofs = []*pof.T{}
+	}
+	if err = t.setSecret(&p.pofs, contractsDir, id, filenames.Pofs); err != nil {
+		return
+	}
+	return t.setSecret(&p.sk, contractsDir, id, filenames.Servicekey)
+}
+
+// updateParked applies f to the parked state of the contract described by ci,
+// creating it if needed, and saves it along with ci and rl. It is best to lock
+// mutex at the calling site while using this function.
+func (t *T) updateParked(ci *contractinfo.T, rl relaylist.T, f func(p *parked)) error {
+	p, err := t.loadParked(contractID(ci.Endpoint))
+	if err != nil {
+		if !noFile(err) {
+			return err
+		}
+		p = &parked{}
+	}
+	p.ci, p.rl = ci, rl
+	f(p)
+	return t.saveParked(p)
+}
+
+// activeState returns the state of the active contract or nil if there is
+// none. It is best to lock mutex at the calling site while using this
+// function.
+func (t *T) activeState() *parked {
+	p := &parked{ci: t.ci, rl: t.rl, sk: t.sk, pofs: t.pofs}
+	if p.ci == nil {
+		// contract info could not be refreshed, use the saved one
+		if ci, err := clientlib.ContractInfo(t.Fd); err == nil && ci != nil && ci.Endpoint != nil {
+			p.ci = ci
+		} else {
+			return nil
+		}
+	}
+	if p.rl == nil {
+		t.Fd.Get(&p.rl, filenames.Relays)
+	}
+	return p
+}
+
+// writeActive writes the state of the active contract.
+func (t *T) writeActive(ci *contractinfo.T, rl relaylist.T, sk *servicekey.T, pofs []*pof.T) (err error) {
+	if err = t.setSecret(&pofs, filenames.Pofs); err != nil {
+		return
+	}
+	if err = t.setSecret(&sk, filenames.Servicekey); err != nil {
+		return
+	}
+	return clientlib.SaveContractInfo(t.Fd, ci, rl)
+}
+
+// switchTo makes the parked contract id the active one, parking the
+// currently active one. The contract info is refreshed first so contracts
+// which are not reachable are not switched to. It is best to lock mutex at the
+// calling site while using this function.
+func (t *T) switchTo(id string) error {
+	p, err := t.loadParked(id)
+	if err != nil {
+		if noFile(err) {
+			return ErrNoContract
+		}
+		return fmt.Errorf("could not read contract state: %w", err)
+	}
+	ci, rl, err := clientlib.GetContractInfo(t.cl, p.ci.Endpoint)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ci.Pubkey, p.ci.Pubkey) {
+		return fmt.Errorf(
+			"contract public key mismatch; expecting %s from stored contract info, got %s from live contract",
+			base64.RawURLEncoding.EncodeToString(p.ci.Pubkey),
+			base64.RawURLEncoding.EncodeToString(ci.Pubkey),
+		)
+	}
+	if p.pofs == nil {
+		p.pofs = []*pof.T{}
+	}
+	prev := t.activeState()
+	if prev != nil {
+		if err = t.saveParked(prev); err != nil {
+			return fmt.Errorf("could not save state of contract %s: %w", prev.ci.Endpoint, err)
+		}
+	}
+	if err = t.writeActive(ci, rl, p.sk, p.pofs); err != nil {
+		if prev != nil {
+			// try not to leave a mix of both contracts behind
+			t.writeActive(prev.ci, prev.rl, prev.sk, prev.pofs)
+			if pid := contractID(prev.ci.Endpoint); pid != id {
+				t.Fd.Del(contractsDir, pid)
+			}
+		}
+		return fmt.Errorf("could not write state of contract %s: %w", ci.Endpoint, err)
+	}
+	if err = t.Fd.Del(contractsDir, id); err != nil {
+		t.l.Printf("could not remove parked state of contract %s: %s", ci.Endpoint, err)
+	}
+	t.ci, t.rl, t.sk, t.pofs = ci, rl, p.sk, p.pofs
+	t.skUsed = false
+	t.switches++
+	t.warned = 0
+	// reset circuits
+	t.circ = nil
+	for _, g := range t.iso {
+		g.circ = nil
+	}
+	// cache dns for tun
+	for _, r := range t.rl.All() {
+		if t.cache.Get(r.Addr.Hostname()) == nil {
+			if err = t.cache.Cache(context.Background(), r.Addr.Hostname()); err != nil {
+				t.l.Printf("could not cache %s: %s", r.Addr.Hostname(), err)
+			}
+		}
+	}
+	t.cache.Cache(context.Background(), ci.Endpoint.Hostname())
+	if ci.Directory.Endpoint != nil {
+		t.cache.Cache(context.Background(), ci.Directory.Endpoint.Hostname())
+	}
+	// ignore error here as tun is not necessarily running
+	_ = t.writeBypass(t.bypassRelays()...)
+	if prev != nil {
+		t.l.Printf("switched from contract %s to %s", prev.ci.Endpoint, ci.Endpoint)
+	} else {
+		t.l.Printf("switched to contract %s", ci.Endpoint)
+	}
+	return nil
+}
+
+// UseContract makes the known contract at u the active one.
+func (t *T) UseContract(u *texturl.URL) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a := t.activeState(); a != nil && *a.ci.Endpoint == *u {
+		return nil
+	}
+	return t.switchTo(contractID(u))
+}
+
+// Contracts returns the known contracts, the active one first.
+func (t *T) Contracts() []*Contract {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := []*Contract{}
+	if a := t.activeState(); a != nil {
+		r = append(r, a.summary(t.now().Unix(), true))
+	}
+	ids, err := t.parkedIDs()
+	if err != nil {
+		t.l.Printf("could not list contracts: %s", err)
+	}
+	for _, id := range ids {
+		p, err := t.loadParked(id)
+		if err != nil {
+			t.l.Printf("could not read state of contract %s: %s", id, err)
+			continue
+		}
+		r = append(r, p.summary(t.now().Unix(), false))
+	}
+	return r
+}
+
+// ContractInfoOf returns the contract info of the known contract at u or nil
+// if it is not known.
+func (t *T) ContractInfoOf(u *texturl.URL) *contractinfo.T {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a := t.activeState(); a != nil && *a.ci.Endpoint == *u {
+		return a.ci
+	}
+	p, err := t.loadParked(contractID(u))
+	if err != nil {
+		return nil
+	}
+	return p.ci
+}
+
+// candidate is a parked contract which can be failed over to.
+type candidate struct {
+	id string
+	c  *Contract
+}
+
+// candidates returns the parked contracts which have accesskeys left in the
+// order they are failed over to: contracts with a usable servicekey first,
+// then the ones with the most accesskeys. It is best to lock mutex at the
+// calling site while using this function.
+func (t *T) candidates() (cs []candidate, err error) {
+	ids, err := t.parkedIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		p, err := t.loadParked(id)
+		if err != nil {
+			t.l.Printf("could not read state of contract %s: %s", id, err)
+			continue
+		}
+		if c := p.summary(t.now().Unix(), false); c.Expiration > 0 || c.Pofs > 0 {
+			cs = append(cs, candidate{id, c})
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := cs[i].c, cs[j].c
+		if (a.Expiration > 0) != (b.Expiration > 0) {
+			return a.Expiration > 0
+		}
+		return a.Pofs > b.Pofs
+	})
+	return
+}
+
+// unreachable returns whether err is due to the contract not responding at
+// all. Requests are retried as usual before failing so a short outage does not
+// count.
+func unreachable(err error) bool {
+	var uerr *url.Error
+	return errors.As(err, &uerr)
+}
+
+// failover switches to another known contract which has accesskeys left if
+// broker.accesskey.failover is enabled and the active contract either has no
+// accesskeys left or is unreachable, returning whether it did. It is best to
+// lock mutex at the calling site while using this function.
+func (t *T) failover(reason error) bool {
+	if !t.cfg.Broker.Accesskey.Failover {
+		return false
+	}
+	cs, err := t.candidates()
+	if err != nil {
+		t.l.Printf("could not list contracts to fail over to: %s", err)
+		return false
+	}
+	if len(cs) == 0 {
+		return false
+	}
+	from := "no contract"
+	if a := t.activeState(); a != nil {
+		from = a.ci.Endpoint.String()
+	}
+	if !errors.Is(reason, errNoAccesskeys) && !unreachable(reason) {
+		t.l.Printf("not failing over from %s as it is reachable and has accesskeys left: %s", from, reason)
+		return false
+	}
+	for _, c := range cs {
+		t.l.Printf("failing over from %s to %s: %s", from, c.c.Endpoint, reason)
+		if err = t.switchTo(c.id); err != nil {
+			t.l.Printf("could not fail over to %s: %s", c.c.Endpoint, err)
+			continue
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/dnscachedial"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/client"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/texturl"
+)
+
+// failoverBroker returns a broker with failover enabled using a stand-in
+// contract with two pofs.
+func failoverBroker(t *testing.T) (*T, *testContract) {
+	br := testBroker(t)
+	br.cfg.Broker.Accesskey.Failover = true
+	tc := useContract(t, br, nil)
+	br.cl.RetryOpt.Tries = 1
+	br.cl.RetryOpt.Verbose = false
+	br.pofs = testPofs(2)
+	switchable(br)
+	return br, tc
+}
+
+// switchable sets up br so it can switch contracts without forwarders to
+// notify.
+func switchable(br *T) {
+	br.cache = dnscachedial.New()
+	br.ucl = client.New(nil)
+	br.ucl.RetryOpt.Tries = 1
+	br.ucl.RetryOpt.Verbose = false
+	br.ucl.SetTransport(&http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return nil, os.ErrNotExist
+		},
+	})
+}
+
+// park stores the state of a contract which is not active.
+func park(t *testing.T, br *T, tc *testContract, sk *servicekey.T, pofs []*pof.T) string {
+	if err := br.updateParked(tc.ci, nil, func(p *parked) { p.sk, p.pofs = sk, pofs }); err != nil {
+		t.Fatal(err)
+	}
+	return contractID(tc.ci.Endpoint)
+}
+
+func TestContractID(t *testing.T) {
+	br, _ := failoverBroker(t)
+	var (
+		a = newContract(t, nil)
+		b = newContract(t, nil)
+	)
+	a.ci.Endpoint = texturl.URLMustParse("https://contract.example/a_b")
+	b.ci.Endpoint = texturl.URLMustParse("https://contract.example/a/b")
+	if contractID(a.ci.Endpoint) != contractID(texturl.URLMustParse("https://contract.example/a_b")) {
+		t.Error("contract id is not stable")
+	}
+	ida, idb := park(t, br, a, nil, testPofs(1)), park(t, br, b, nil, testPofs(2))
+	if ida == idb {
+		t.Fatalf("%s and %s share contract id %s", a.ci.Endpoint, b.ci.Endpoint, ida)
+	}
+	for _, c := range []struct {
+		id   string
+		tc   *testContract
+		pofs int
+	}{{ida, a, 1}, {idb, b, 2}} {
+		p, err := br.loadParked(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ci.Endpoint.String() != c.tc.ci.Endpoint.String() || len(p.pofs) != c.pofs {
+			t.Errorf("%s: got %s with %d pofs", c.id, p.ci.Endpoint, len(p.pofs))
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	br, _ := failoverBroker(t)
+	var (
+		fresh  = newContract(t, nil)
+		most   = newContract(t, nil)
+		fewer  = newContract(t, nil)
+		none   = newContract(t, nil)
+		stale  = newContract(t, nil)
+		hour   = time.Now().Add(time.Hour)
+		before = time.Now().Add(-time.Hour)
+	)
+	expired := testPofs(3)
+	for _, p := range expired {
+		p.Expiration = before.Unix()
+	}
+	want := []string{
+		park(t, br, fresh, fresh.sk(t, hour), testPofs(1)),
+		park(t, br, most, nil, testPofs(5)),
+		park(t, br, fewer, stale.sk(t, before), testPofs(2)),
+	}
+	park(t, br, none, none.sk(t, before), nil)
+	park(t, br, stale, nil, expired)
+	cs, err := br.candidates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != len(want) {
+		t.Fatalf("got %d candidates, expected %d", len(cs), len(want))
+	}
+	for i, c := range cs {
+		if c.id != want[i] {
+			t.Errorf("candidate %d is %s, expected %s", i, c.id, want[i])
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	refused := &url.Error{Op: "Get", URL: "http://127.0.0.1:1/info", Err: syscall.ECONNREFUSED}
+	for _, tc := range []struct {
+		name     string
+		reason   error
+		disabled bool
+		switched bool
+	}{
+		{"no accesskeys", fmt.Errorf("no fresh pofs available: %w", errNoAccesskeys), false, true},
+		{"unreachable", fmt.Errorf("could not get contract info: %w", refused), false, true},
+		{"reachable", errors.New("error while performing SK activation request"), false, false},
+		{"disabled", errNoAccesskeys, true, false},
+	} {
+		br, _ := failoverBroker(t)
+		br.cfg.Broker.Accesskey.Failover = !tc.disabled
+		// the best candidate cannot be switched to
+		best, next := newContract(t, nil), newContract(t, nil)
+		ci := *best.ci
+		ci.Pubkey = jsonb.PK(make([]byte, 32))
+		park(t, br, &testContract{ci: &ci}, best.sk(t, time.Now().Add(time.Hour)), nil)
+		nextID := park(t, br, next, nil, testPofs(3))
+		prev := br.ci.Endpoint.String()
+		if got := br.failover(tc.reason); got != tc.switched {
+			t.Errorf("%s: failover returned %v", tc.name, got)
+		}
+		if !tc.switched {
+			if br.ci.Endpoint.String() != prev || len(br.pofs) != 2 {
+				t.Errorf("%s: switched to %s", tc.name, br.ci.Endpoint)
+			}
+			continue
+		}
+		if br.ci.Endpoint.String() != next.ci.Endpoint.String() || len(br.pofs) != 3 {
+			t.Errorf("%s: switched to %s with %d pofs", tc.name, br.ci.Endpoint, len(br.pofs))
+		}
+		if u := clientlib.ContractURL(br.Fd); u == nil || u.String() != next.ci.Endpoint.String() {
+			t.Errorf("%s: active contract file not written", tc.name)
+		}
+		if _, err := br.loadParked(nextID); err == nil {
+			t.Errorf("%s: new contract is still parked", tc.name)
+		}
+		if p, err := br.loadParked(contractID(texturl.URLMustParse(prev))); err != nil || len(p.pofs) != 2 {
+			t.Errorf("%s: previous contract not parked: %v", tc.name, err)
+		}
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	br, active := failoverBroker(t)
+	ci := *active.ci
+	ci.Endpoint = texturl.URLMustParse("http://" + closed.Addr().String())
+	if err = br.Fd.SetIndented(&ci, filenames.Contract); err != nil {
+		t.Fatal(err)
+	}
+	if err = br.Sync(); !unreachable(err) {
+		t.Errorf("sync error not due to an unreachable contract: %v", err)
+	}
+	if err = br.RefreshSK(); !unreachable(err) {
+		t.Errorf("refresh error not due to an unreachable contract: %v", err)
+	}
+	if unreachable(fmt.Errorf("no servicekey available: %w", errNoAccesskeys)) {
+		t.Error("missing accesskeys counted as unreachable")
+	}
+}
+
+func TestSwitchToRollback(t *testing.T) {
+	br, active := failoverBroker(t)
+	br.sk = active.sk(t, time.Now().Add(time.Hour))
+	if err := br.writeActive(br.ci, nil, br.sk, br.pofs); err != nil {
+		t.Fatal(err)
+	}
+	other := newContract(t, nil)
+	id := park(t, br, other, nil, testPofs(3))
+	// the new contract info cannot be written
+	p := br.Fd.Path(filenames.Contract)
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := br.switchTo(id); err == nil {
+		t.Fatal("switched despite write failure")
+	}
+	if br.ci != active.ci || len(br.pofs) != 2 || br.sk == nil {
+		t.Errorf("active state changed to %s", br.ci.Endpoint)
+	}
+	var (
+		pofs []*pof.T
+		sk   *servicekey.T
+	)
+	if _, err := br.getSecret(&pofs, filenames.Pofs); err != nil || len(pofs) != 2 {
+		t.Errorf("pofs not rolled back: %d, %v", len(pofs), err)
+	}
+	if _, err := br.getSecret(&sk, filenames.Servicekey); err != nil || sk == nil || sk.PublicKey.String() != br.sk.PublicKey.String() {
+		t.Errorf("servicekey not rolled back: %v", err)
+	}
+	if pk, err := br.loadParked(id); err != nil || len(pk.pofs) != 3 {
+		t.Errorf("state of contract not kept: %v", err)
+	}
+	if _, err := br.loadParked(contractID(active.ci.Endpoint)); err == nil {
+		t.Error("active contract left parked")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/wireleap/client/clientcfg"
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/common/api/servicekey"
+)
+
+// accesskey download limits used if not configured
+const (
+	defaultDownloadTimeout = 30 * time.Second
+	defaultDownloadSize    = 16 << 20
+)
+
+// downloader returns the HTTP client used for downloading accesskeys with
+// the settings from dl.
+func (t *T) downloader(dl clientcfg.Download) (*http.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// not available on all platforms
+		pool = x509.NewCertPool()
+	}
+	for _, f := range dl.CACerts {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no PEM CA certificates found in %s", f)
+		}
+	}
+	timeout := time.Duration(dl.Timeout)
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+	nd := &net.Dialer{Timeout: timeout}
+	tr := &http.Transport{
+		// reuse the broker dns cache
+		DialContext:           t.cache.Cover(nd.DialContext),
+		TLSClientConfig:       &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		DisableKeepAlives:     true,
+	}
+	if dl.Circuit {
+		// the exit relay resolves and connects to the host so neither the
+		// vendor nor the resolver see our address
+		tr.DialContext = t.circuitDialer(true)
+	}
+	return &http.Client{
+		Transport: tr,
+		Timeout:   timeout,
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			if r.URL.Scheme != "https" {
+				return fmt.Errorf("refusing to follow redirect to non-HTTPS URL %s", r.URL)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// circuitDialer returns a DialContext function dialing through the circuit
+// for HTTP clients of the broker itself. If fetch is set, a new servicekey is
+// activated if needed, otherwise only the current one is used.
+func (t *T) circuitDialer(fetch bool) func(context.Context, string, string) (net.Conn, error) {
+	dial := clientlib.CircuitDialer(
+		func() (*servicekey.T, error) { return t.GetSK(fetch) },
+		t.Circuit,
+		t.T.DialWL,
+	)
+	return func(_ context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("could not dial %s through the circuit: %w", addr, err)
+		}
+		return c, nil
+	}
+}
+
+// circuitPayable returns an error if there is neither a fresh servicekey nor
+// a pof to activate one, so nothing can be dialed through the circuit. This is
+// always the case when importing the first accesskey.
+// It is best to lock mutex at the calling site while using this function.
+func (t *T) circuitPayable() error {
+	now := t.now().Unix()
+	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(now) {
+		return nil
+	}
+	if t.cfg.Broker.Accesskey.UseOnDemand && clientlib.ContractURL(t.Fd) != nil {
+		for _, p := range t.pofs {
+			if !p.IsExpiredAt(now) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf(
+		"cannot download through the circuit without an accesskey to use; " +
+			"import the first accesskey with broker.accesskey.download.circuit " +
+			"set to false or from a file",
+	)
+}
+
+// download downloads an accesskey file from u, enforcing the configured
+// timeout and maximum size.
+func (t *T) download(u string) ([]byte, error) {
+	t.mu.Lock()
+	dl := t.cfg.Broker.Accesskey.Download
+	var err error
+	if dl.Circuit {
+		err = t.circuitPayable()
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.downloader(dl)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"%s download request returned code %d: %s",
+			u, res.StatusCode, res.Status,
+		)
+	}
+	max := dl.MaxSize
+	if max <= 0 {
+		max = defaultDownloadSize
+	}
+	if res.ContentLength > max {
+		return nil, fmt.Errorf("%s is larger than the maximum of %d bytes", u, max)
+	}
+	if dl.Circuit {
+		t.l.Printf("Downloading %s through the circuit...", u)
+	} else {
+		t.l.Printf("Downloading %s...", u)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, fmt.Errorf("%s is larger than the maximum of %d bytes", u, max)
+	}
+	return b, nil
+}
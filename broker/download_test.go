@@ -0,0 +1,63 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitPayable(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sk       time.Duration
+		pofs     int
+		expired  bool
+		contract bool
+		onDemand bool
+		ok       bool
+	}{
+		{"first import", 0, 0, false, false, true, false},
+		{"first import with contract", 0, 0, false, true, true, false},
+		{"fresh servicekey", time.Hour, 0, false, true, false, true},
+		{"expired servicekey", -time.Hour, 0, false, true, true, false},
+		{"pofs", 0, 2, false, true, true, true},
+		{"expired pofs", -time.Hour, 2, true, true, true, false},
+		{"pofs without contract", 0, 2, false, false, true, false},
+		{"pofs not used on demand", 0, 2, false, true, false, false},
+	} {
+		br := testBroker(t)
+		br.cfg.Broker.Accesskey.UseOnDemand = tc.onDemand
+		br.cfg.Broker.Accesskey.Download.Circuit = true
+		var c *testContract
+		if tc.contract {
+			c = useContract(t, br, nil)
+		}
+		if tc.sk != 0 {
+			if c != nil {
+				br.sk = c.sk(t, time.Now().Add(tc.sk))
+			} else {
+				br.sk = testSK(t, time.Now().Add(tc.sk))
+			}
+		}
+		br.pofs = testPofs(tc.pofs)
+		if tc.expired {
+			for _, p := range br.pofs {
+				p.Expiration = time.Now().Add(-time.Minute).Unix()
+			}
+		}
+		err := br.circuitPayable()
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+		if tc.ok {
+			continue
+		}
+		// fails before connecting anywhere
+		_, err = br.download("https://192.0.2.1/accesskey.json")
+		if err == nil || !strings.Contains(err.Error(), "without an accesskey") {
+			t.Errorf("%s: download got error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/wireleap/common/api/duration"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/texturl"
+)
+
+const (
+	// how often the forecast is checked against the warning thresholds
+	forecastCheck = time.Minute
+	// timeout of warning webhook requests
+	webhookTimeout = 10 * time.Second
+)
+
+// Forecast describes how long the available accesskeys last.
+type Forecast struct {
+	// Contract is the contract the accesskeys are for.
+	Contract *texturl.URL `json:"contract,omitempty"`
+	// Depletion is the unix time the accesskeys run out at, 0 if they
+	// already did.
+	Depletion int64 `json:"depletion"`
+	// Remaining is the number of seconds until depletion.
+	Remaining int64 `json:"remaining"`
+	// Pofs is the number of inactive accesskeys which can still be
+	// activated before they expire.
+	Pofs int `json:"pofs"`
+	// Warning is set if the remaining time is below one of the configured
+	// thresholds.
+	Warning string `json:"warning,omitempty"`
+}
+
+// Forecast computes how long the current servicekey and the remaining pofs
+// last if used continuously. It returns nil if no contract is defined.
+func (t *T) Forecast() *Forecast {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ci == nil {
+		return nil
+	}
+	f, _ := t.forecast(t.now())
+	return &f
+}
+
+// forecast computes the forecast at now along with the number of warning
+// thresholds crossed. Pofs are assumed to be activated in order of expiration
+// as soon as the previous servicekey expires; the ones which would expire
+// before their turn are not counted. It is best to lock mutex at the calling
+// site while using this function.
+func (t *T) forecast(now time.Time) (f Forecast, level int) {
+	if t.ci == nil {
+		// no contract, nothing to forecast
+		return
+	}
+	f.Contract = t.ci.Endpoint
+	at := now
+	if t.sk != nil && t.sk.Contract != nil && !t.sk.IsExpiredAt(now.Unix()) {
+		at = time.Unix(t.sk.Contract.SettlementOpen, 0)
+	}
+	ps := make([]*pof.T, len(t.pofs))
+	copy(ps, t.pofs)
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Expiration < ps[j].Expiration })
+	for _, p := range ps {
+		if p.IsExpiredAt(at.Unix()) {
+			continue
+		}
+		f.Pofs++
+		at = at.Add(time.Duration(t.ci.Servicekey.Duration))
+	}
+	if at.After(now) {
+		f.Depletion = at.Unix()
+		f.Remaining = int64(at.Sub(now) / time.Second)
+	}
+	for _, th := range t.cfg.Broker.Accesskey.Warn {
+		if th > 0 && at.Sub(now) <= time.Duration(th) {
+			level++
+		}
+	}
+	switch {
+	case level == 0:
+		// plenty left
+	case f.Remaining == 0:
+		// running out entirely is worth another warning
+		level++
+		f.Warning = fmt.Sprintf(
+			"accesskeys for %s are used up; import more accesskeys to keep connecting",
+			f.Contract,
+		)
+	default:
+		f.Warning = fmt.Sprintf(
+			"accesskeys for %s run out in %s (at %s) with %d inactive accesskey(s) left; import more accesskeys to keep connecting",
+			f.Contract,
+			duration.T(at.Sub(now).Round(time.Minute)),
+			at.Format(time.RFC3339),
+			f.Pofs,
+		)
+	}
+	return
+}
+
+// forecasts checks the forecast periodically until shutdown.
+func (t *T) forecasts() {
+	for {
+		t.checkForecast()
+		t.checkClock()
+		select {
+		case <-t.done:
+			return
+		case <-time.After(forecastCheck):
+		}
+	}
+}
+
+// checkForecast emits a warning whenever another threshold is crossed. If
+// more accesskeys are imported, the thresholds are armed again.
+func (t *T) checkForecast() {
+	t.mu.Lock()
+	f, level := t.forecast(t.now())
+	prev := t.warned
+	t.warned = level
+	hook := t.cfg.Broker.Accesskey.Webhook
+	direct := t.cfg.Broker.Accesskey.WebhookDirect
+	t.mu.Unlock()
+	if level <= prev {
+		return
+	}
+	t.l.Printf("WARNING: %s", f.Warning)
+	if hook != "" {
+		go t.postWarning(hook, direct, f)
+	}
+}
+
+// postWarning POSTs f to the webhook at u through the circuit or, if direct
+// is set, directly. No servicekey is activated just for the warning, so it
+// cannot be sent through the circuit once the accesskeys are used up.
+func (t *T) postWarning(u string, direct bool, f Forecast) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.l.Printf("could not marshal accesskey warning: %s", err)
+		return
+	}
+	tr := &http.Transport{DisableKeepAlives: true}
+	if !direct {
+		// the webhook would learn our address otherwise
+		tr.DialContext = t.circuitDialer(false)
+	}
+	c := &http.Client{Transport: tr, Timeout: webhookTimeout}
+	res, err := c.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.l.Printf("could not send accesskey warning to webhook: %s", err)
+		if !direct {
+			t.l.Printf("set broker.accesskey.webhook_direct to send accesskey warnings without the circuit")
+		}
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		t.l.Printf("accesskey warning webhook returned code %d: %s", res.StatusCode, res.Status)
+	}
+}
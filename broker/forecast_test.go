@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/duration"
+	"github.com/wireleap/common/api/pof"
+)
+
+// forecastBroker returns a broker using a contract with hourly servicekeys
+// and warning thresholds of 24h and 1h.
+func forecastBroker(t *testing.T) *T {
+	br := testBroker(t)
+	br.ci = &contractinfo.T{Servicekey: contractinfo.Servicekey{Duration: duration.T(time.Hour)}}
+	br.cfg.Broker.Accesskey.Warn = []duration.T{duration.T(24 * time.Hour), 0, duration.T(time.Hour)}
+	return br
+}
+
+// pofsExpiring returns pofs expiring after the durations in exps.
+func pofsExpiring(now time.Time, exps ...time.Duration) (r []*pof.T) {
+	for i, d := range exps {
+		r = append(r, &pof.T{Type: "test", Expiration: now.Add(d).Unix(), Nonce: string(rune('a' + i))})
+	}
+	return
+}
+
+func TestForecast(t *testing.T) {
+	// expiry times are unix seconds
+	now := time.Unix(time.Now().Unix(), 0)
+	for _, tc := range []struct {
+		name      string
+		sk        time.Duration
+		pofs      []time.Duration
+		remaining time.Duration
+		npofs     int
+		level     int
+		warning   string
+	}{
+		{"below 24h", 2 * time.Hour, []time.Duration{48 * time.Hour, 48 * time.Hour, 48 * time.Hour}, 5 * time.Hour, 3, 1, "run out in 5h"},
+		{"no warning", 30 * time.Hour, nil, 30 * time.Hour, 0, 0, ""},
+		{"one hour left", time.Hour, nil, time.Hour, 0, 2, "run out in 1h"},
+		{"sk only", 30 * time.Minute, nil, 30 * time.Minute, 0, 2, "with 0 inactive accesskey(s) left"},
+		{"pofs only", 0, []time.Duration{48 * time.Hour, 48 * time.Hour}, 2 * time.Hour, 2, 1, "with 2 inactive accesskey(s) left"},
+		// pofs are used in order of expiration
+		{"expiring pofs", 0, []time.Duration{48 * time.Hour, 30 * time.Minute}, 2 * time.Hour, 2, 1, "with 2 inactive"},
+		// the second pof expires before the servicekey does
+		{"pof expiring before turn", time.Hour, []time.Duration{48 * time.Hour, 30 * time.Minute}, 2 * time.Hour, 1, 1, "with 1 inactive"},
+		{"used up", 0, nil, 0, 0, 3, "are used up"},
+		{"expired pofs", -time.Hour, []time.Duration{-time.Minute}, 0, 0, 3, "are used up"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := forecastBroker(t)
+			if tc.sk != 0 {
+				br.sk = testSK(t, now.Add(tc.sk))
+			}
+			br.pofs = pofsExpiring(now, tc.pofs...)
+			f, level := br.forecast(now)
+			if got := time.Duration(f.Remaining) * time.Second; got != tc.remaining {
+				t.Errorf("remaining %s, expected %s", got, tc.remaining)
+			}
+			if tc.remaining > 0 && f.Depletion != now.Add(tc.remaining).Unix() {
+				t.Errorf("depletion at %d, expected %d", f.Depletion, now.Add(tc.remaining).Unix())
+			}
+			if f.Pofs != tc.npofs {
+				t.Errorf("%d pofs counted, expected %d", f.Pofs, tc.npofs)
+			}
+			if level != tc.level {
+				t.Errorf("level %d, expected %d", level, tc.level)
+			}
+			if (tc.level == 0) != (f.Warning == "") || !strings.Contains(f.Warning, tc.warning) {
+				t.Errorf("unexpected warning %q", f.Warning)
+			}
+		})
+	}
+	// no contract, no forecast
+	br := testBroker(t)
+	if f, level := br.forecast(now); level != 0 || f != (Forecast{}) {
+		t.Errorf("forecast without contract: %+v, level %d", f, level)
+	}
+}
+
+// countWarnings returns the number of warnings logged so far.
+func countWarnings(buf *bytes.Buffer) int {
+	return strings.Count(buf.String(), "WARNING: ")
+}
+
+func TestCheckForecast(t *testing.T) {
+	br := forecastBroker(t)
+	buf := &bytes.Buffer{}
+	br.l = log.New(buf, "", 0)
+	br.sk = testSK(t, time.Now().Add(2*time.Hour))
+	br.pofs = pofsExpiring(time.Now(), 48*time.Hour)
+	// below 24h: warned once
+	br.checkForecast()
+	br.checkForecast()
+	if n := countWarnings(buf); n != 1 || br.warned != 1 {
+		t.Fatalf("%d warnings, warned %d: %s", n, br.warned, buf)
+	}
+	// below 1h: warned again, once
+	br.sk = testSK(t, time.Now().Add(30*time.Minute))
+	br.pofs = nil
+	br.checkForecast()
+	br.checkForecast()
+	if n := countWarnings(buf); n != 2 || br.warned != 2 {
+		t.Fatalf("%d warnings, warned %d: %s", n, br.warned, buf)
+	}
+	// more accesskeys imported: thresholds are armed again
+	br.pofs = pofsExpiring(time.Now(), 72*time.Hour, 72*time.Hour, 72*time.Hour)
+	br.checkForecast()
+	if n := countWarnings(buf); n != 2 || br.warned != 1 {
+		t.Fatalf("%d warnings, warned %d: %s", n, br.warned, buf)
+	}
+	// used up
+	br.sk, br.pofs = nil, nil
+	br.checkForecast()
+	br.checkForecast()
+	if n := countWarnings(buf); n != 3 || br.warned != 3 {
+		t.Fatalf("%d warnings, warned %d: %s", n, br.warned, buf)
+	}
+	if !strings.Contains(buf.String(), "are used up") {
+		t.Errorf("no used up warning: %s", buf)
+	}
+}
+
+// webhook starts a stand-in webhook sending the forecasts it gets to fc.
+func webhook(t *testing.T) (*httptest.Server, chan Forecast) {
+	fc := make(chan Forecast, 4)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var f Forecast
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&f) != nil {
+			t.Errorf("unexpected webhook request %s %s", r.Method, r.URL)
+		}
+		fc <- f
+	}))
+	t.Cleanup(s.Close)
+	return s, fc
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestPostWarning(t *testing.T) {
+	f := Forecast{Remaining: 42, Warning: "test"}
+	t.Run("circuit", func(t *testing.T) {
+		s, fc := webhook(t)
+		br := forecastBroker(t)
+		br.l = log.New(io.Discard, "", 0)
+		dialed := make(chan string, 1)
+		useCircuit(t, br, dialed)
+		br.postWarning(s.URL, false, f)
+		select {
+		case got := <-fc:
+			if got.Remaining != 42 || got.Warning != "test" {
+				t.Errorf("webhook got %+v", got)
+			}
+		default:
+			t.Fatal("webhook not called")
+		}
+		if got := <-dialed; got != s.Listener.Addr().String() {
+			t.Errorf("exit relay dialed %s, expected %s", got, s.Listener.Addr())
+		}
+	})
+	t.Run("used up", func(t *testing.T) {
+		s, fc := webhook(t)
+		br := forecastBroker(t)
+		buf := &syncBuffer{}
+		br.l = log.New(buf, "", 0)
+		dialed := make(chan string, 1)
+		useCircuit(t, br, dialed)
+		br.sk = nil
+		br.pofs = pofsExpiring(time.Now(), time.Hour)
+		// not sent directly and no pof is used up for it
+		br.postWarning(s.URL, false, f)
+		if len(fc) != 0 || len(dialed) != 0 {
+			t.Error("warning sent without servicekey")
+		}
+		if len(br.pofs) != 1 || br.sk != nil {
+			t.Error("servicekey activated for warning")
+		}
+		if !strings.Contains(buf.String(), "broker.accesskey.webhook_direct") {
+			t.Errorf("no hint logged: %s", buf)
+		}
+	})
+	t.Run("direct", func(t *testing.T) {
+		s, fc := webhook(t)
+		br := forecastBroker(t)
+		br.l = log.New(io.Discard, "", 0)
+		br.postWarning(s.URL, true, f)
+		if len(fc) != 1 {
+			t.Error("webhook not called")
+		}
+	})
+}
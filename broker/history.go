@@ -0,0 +1,144 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/contractinfo"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/texturl"
+)
+
+// maxActivations is the number of activations kept in the history.
+const maxActivations = 1000
+
+// ErrNoPof is returned when removing a pof which is not known.
+var ErrNoPof = errors.New("no such accesskey")
+
+// Activation records which pof a servicekey was activated with.
+type Activation struct {
+	// Pof is the digest of the pof used.
+	Pof string `json:"pof"`
+	// Servicekey is the public key of the servicekey activated.
+	Servicekey string `json:"servicekey"`
+	// Contract is the contract the servicekey was activated by.
+	Contract *texturl.URL `json:"contract,omitempty"`
+	// Activated is the unix time of activation.
+	Activated int64 `json:"activated"`
+	// Expiration is the unix time the servicekey expires at.
+	Expiration int64 `json:"expiration"`
+}
+
+// loadHistory reads the activation history.
+func (t *T) loadHistory() error {
+	err := t.Fd.Get(&t.history, filenames.Activations)
+	if errors.Is(err, io.EOF) || errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// recordActivation adds the activation of sk with p to the history. It is best
+// to lock mutex at the calling site while using this function.
+func (t *T) recordActivation(p *pof.T, sk *servicekey.T) {
+	a := &Activation{
+		Pof:        p.Digest(),
+		Servicekey: sk.PublicKey.String(),
+		Activated:  t.now().Unix(),
+	}
+	if t.ci != nil {
+		a.Contract = t.ci.Endpoint
+	}
+	if sk.Contract != nil {
+		a.Expiration = sk.Contract.SettlementOpen
+	}
+	t.history = append(t.history, a)
+	if len(t.history) > maxActivations {
+		t.history = t.history[len(t.history)-maxActivations:]
+	}
+	if err := t.Fd.SetIndented(t.history, filenames.Activations); err != nil {
+		t.l.Printf("could not write %s: %s", filenames.Activations, err)
+	}
+}
+
+// History returns the activation history, oldest first.
+func (t *T) History() []*Activation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := make([]*Activation, len(t.history))
+	copy(r, t.history)
+	return r
+}
+
+// ActivatedWith returns the digest of the pof sk was activated with or an
+// empty string if it is not known.
+func (t *T) ActivatedWith(sk *servicekey.T) string {
+	if sk == nil {
+		return ""
+	}
+	k := sk.PublicKey.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.history) - 1; i >= 0; i-- {
+		if t.history[i].Servicekey == k {
+			return t.history[i].Pof
+		}
+	}
+	return ""
+}
+
+// Remove removes the inactive pof with the given digest of the active or any
+// other known contract, returning it and the contract it was for.
+func (t *T) Remove(digest string) (*pof.T, *contractinfo.T, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, newps := without(t.pofs, digest); p != nil {
+		if err := t.setSecret(&newps, filenames.Pofs); err != nil {
+			return nil, nil, fmt.Errorf("could not write new %s: %s", filenames.Pofs, err)
+		}
+		t.pofs = newps
+		t.l.Printf("removed accesskey %s", digest)
+		return p, t.ci, nil
+	}
+	ids, err := t.parkedIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range ids {
+		pk, err := t.loadParked(id)
+		if err != nil {
+			t.l.Printf("could not read state of contract %s: %s", id, err)
+			continue
+		}
+		p, newps := without(pk.pofs, digest)
+		if p == nil {
+			continue
+		}
+		pk.pofs = newps
+		if err = t.saveParked(pk); err != nil {
+			return nil, nil, fmt.Errorf("could not write new %s for %s: %s", filenames.Pofs, pk.ci.Endpoint, err)
+		}
+		t.l.Printf("removed accesskey %s of inactive contract %s", digest, pk.ci.Endpoint)
+		return p, pk.ci, nil
+	}
+	return nil, nil, ErrNoPof
+}
+
+// without returns the pof with the given digest in ps, if any, and ps without
+// it.
+func without(ps []*pof.T, digest string) (*pof.T, []*pof.T) {
+	for i, p := range ps {
+		if p.Digest() == digest {
+			newps := make([]*pof.T, 0, len(ps)-1)
+			newps = append(newps, ps[:i]...)
+			return p, append(newps, ps[i+1:]...)
+		}
+	}
+	return nil, ps
+}
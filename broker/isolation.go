@@ -0,0 +1,219 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/wireleap/client/circuit"
+	"github.com/wireleap/common/api/relayentry"
+)
+
+const (
+	// isolationIdle is how long an unused isolation group is kept around.
+	isolationIdle = 10 * time.Minute
+	// isolationMax is the maximum number of isolation groups.
+	isolationMax = 64
+)
+
+// isolationGroup is a set of connections sharing an isolation key which use
+// their own circuit, the exit relay of which is not used by any other group.
+type isolationGroup struct {
+	circ   circuit.T
+	active int
+	used   time.Time
+}
+
+// IsolationGroup describes an isolation group and its circuit.
+type IsolationGroup struct {
+	ID          string   `json:"id"`
+	Circuit     []string `json:"circuit"`
+	Connections int      `json:"connections"`
+	LastUsed    int64    `json:"last_used"`
+}
+
+// isolationID returns the isolation group ID for an isolation key, so that
+// the keys (SOCKS usernames) themselves are neither kept nor exposed.
+func isolationID(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:8])
+}
+
+// makeCircuit creates a new circuit from the configured relays. Relays in
+// use as exits by other circuits are not considered as exit relays. It
+// expects t.mu to be held.
+func (t *T) makeCircuit(exclude ...circuit.T) (r circuit.T, err error) {
+	var all circuit.T
+	haveWL := t.cfg.Broker.Circuit.Whitelist != nil && len(t.cfg.Broker.Circuit.Whitelist) > 0
+	if haveWL {
+		for _, addr := range t.cfg.Broker.Circuit.Whitelist {
+			if t.rl[addr] != nil {
+				all = append(all, t.rl[addr])
+			}
+		}
+	} else {
+		all = t.rl.All()
+	}
+	exits := map[string]bool{}
+	for _, c := range exclude {
+		if len(c) > 0 {
+			exits[c[len(c)-1].Addr.String()] = true
+		}
+	}
+	var usable circuit.T
+	for _, r := range all {
+		if r.Role == "backing" && exits[r.Addr.String()] {
+			continue
+		}
+		usable = append(usable, r)
+	}
+	if r, err = circuit.Make(t.cfg.Broker.Circuit.Hops, usable); err != nil {
+		if len(exits) > 0 {
+			err = fmt.Errorf("%w (excluding %d exit relays used by isolated circuits)", err, len(exits))
+		}
+		if haveWL {
+			err = fmt.Errorf("%w (broker.circuit.whitelist is non-empty)", err)
+		}
+	}
+	return
+}
+
+// otherCircuits returns all active circuits except the one of the isolation
+// group with the given ID, "" meaning the default circuit. It expects t.mu
+// to be held.
+func (t *T) otherCircuits(id string) (r []circuit.T) {
+	if id != "" && t.circ != nil {
+		r = append(r, t.circ)
+	}
+	for k, g := range t.iso {
+		if k != id && g.circ != nil {
+			r = append(r, g.circ)
+		}
+	}
+	return
+}
+
+// isolationGroup returns the isolation group with the given ID, creating it
+// if needed. If there are isolationMax groups already, the least recently
+// used idle one is discarded to make room. It expects t.mu to be held.
+func (t *T) isolationGroup(id string) (*isolationGroup, error) {
+	t.expireIsolation()
+	if g := t.iso[id]; g != nil {
+		return g, nil
+	}
+	if len(t.iso) >= isolationMax {
+		var lru string
+		for k, g := range t.iso {
+			if g.active == 0 && (lru == "" || g.used.Before(t.iso[lru].used)) {
+				lru = k
+			}
+		}
+		if lru == "" {
+			return nil, fmt.Errorf("too many isolation groups in use (maximum %d)", isolationMax)
+		}
+		t.l.Printf("removing least recently used isolation group %s", lru)
+		delete(t.iso, lru)
+	}
+	g := &isolationGroup{used: time.Now()}
+	t.iso[id] = g
+	return g, nil
+}
+
+// isolatedCircuit returns a function returning the circuit of the isolation
+// group with the given ID, creating the group and its circuit as needed.
+func (t *T) isolatedCircuit(id string) func() ([]*relayentry.T, error) {
+	return func() (r []*relayentry.T, err error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		g, err := t.isolationGroup(id)
+		if err != nil {
+			return
+		}
+		g.used = time.Now()
+		if g.circ != nil {
+			return g.circ, nil
+		}
+		if g.circ, err = t.makeCircuit(t.otherCircuits(id)...); err != nil {
+			return
+		}
+		t.l.Printf("created circuit for isolation group %s", id)
+		_ = t.writeBypass(t.bypassRelays()...)
+		return g.circ, nil
+	}
+}
+
+// acquireIsolation marks a connection of the isolation group with the given
+// ID as active and returns a function to call once it is closed.
+func (t *T) acquireIsolation(id string) (release func(), err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, err := t.isolationGroup(id)
+	if err != nil {
+		return
+	}
+	g.active++
+	g.used = time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		g.active--
+		g.used = time.Now()
+	}, nil
+}
+
+// resetIsolation discards the circuit of the isolation group with the given
+// ID.
+func (t *T) resetIsolation(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if g := t.iso[id]; g != nil {
+		g.circ = nil
+	}
+}
+
+// expireIsolation removes idle isolation groups. It expects t.mu to be held.
+func (t *T) expireIsolation() {
+	for k, g := range t.iso {
+		if g.active == 0 && time.Since(g.used) > isolationIdle {
+			t.l.Printf("removing idle isolation group %s", k)
+			delete(t.iso, k)
+		}
+	}
+}
+
+// bypassRelays returns the addresses of the entry relays of all active
+// circuits. It expects t.mu to be held.
+func (t *T) bypassRelays() (r []string) {
+	for _, c := range append(t.otherCircuits(""), t.circ) {
+		if len(c) > 0 {
+			r = append(r, t.cache.Get(c[0].Addr.Hostname())...)
+		}
+	}
+	return
+}
+
+// IsolationGroups returns the currently existing isolation groups.
+func (t *T) IsolationGroups() (r []IsolationGroup) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireIsolation()
+	r = []IsolationGroup{}
+	for k, g := range t.iso {
+		ig := IsolationGroup{
+			ID:          k,
+			Circuit:     []string{},
+			Connections: g.active,
+			LastUsed:    g.used.Unix(),
+		}
+		for _, rl := range g.circ {
+			ig.Circuit = append(ig.Circuit, rl.Addr.String())
+		}
+		r = append(r, ig)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].ID < r[j].ID })
+	return
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIsolationID(t *testing.T) {
+	a, b := isolationID("profile1"), isolationID("profile2")
+	if a == b {
+		t.Errorf("distinct keys have the same isolation id %s", a)
+	}
+	if a != isolationID("profile1") {
+		t.Error("isolation id is not stable")
+	}
+	if len(a) != 16 {
+		t.Errorf("isolation id %s is %d characters, want 16", a, len(a))
+	}
+}
+
+func TestIsolationLimit(t *testing.T) {
+	br := testBroker(t)
+	var releases []func()
+	for i := 0; i < isolationMax; i++ {
+		release, err := br.acquireIsolation(isolationID(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatalf("group %d: %s", i, err)
+		}
+		releases = append(releases, release)
+	}
+	// all groups have open connections
+	if _, err := br.acquireIsolation(isolationID("one too many")); err == nil {
+		t.Fatal("no error when exceeding isolation group limit")
+	}
+	// existing groups can still be used
+	release, err := br.acquireIsolation(isolationID("0"))
+	if err != nil {
+		t.Fatalf("existing group: %s", err)
+	}
+	release()
+	// least recently used idle group is evicted first
+	releases[7]()
+	releases[3]()
+	br.iso[isolationID("3")].used = time.Now().Add(-time.Minute)
+	if _, err = br.acquireIsolation(isolationID("new")); err != nil {
+		t.Fatalf("with idle groups: %s", err)
+	}
+	if br.iso[isolationID("3")] != nil {
+		t.Error("least recently used idle group was not evicted")
+	}
+	if br.iso[isolationID("7")] == nil {
+		t.Error("more recently used idle group was evicted")
+	}
+	if n := len(br.IsolationGroups()); n != isolationMax {
+		t.Errorf("%d isolation groups, want %d", n, isolationMax)
+	}
+}
+
+func TestIsolationExpire(t *testing.T) {
+	br := testBroker(t)
+	release, err := br.acquireIsolation(isolationID("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = br.acquireIsolation(isolationID("b")); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	for _, g := range br.iso {
+		g.used = time.Now().Add(-2 * isolationIdle)
+	}
+	gs := br.IsolationGroups()
+	if len(gs) != 1 || gs[0].ID != isolationID("b") || gs[0].Connections != 1 {
+		t.Errorf("after expiry got %+v, want only the group with an open connection", gs)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+)
+
+// sealedFile is the format of encrypted servicekey.json and pofs.json.
+type sealedFile struct {
+	Sealed *clientlib.Sealed `json:"sealed"`
+}
+
+// getSecret reads the file under the path ps into x, decrypting it if it is
+// encrypted. It returns whether it was encrypted.
+func (t *T) getSecret(x interface{}, ps ...string) (sealed bool, err error) {
+	name := filepath.Join(ps...)
+	var raw json.RawMessage
+	if err = t.Fd.Get(&raw, ps...); err != nil {
+		return
+	}
+	var sf sealedFile
+	if json.Unmarshal(raw, &sf) == nil && sf.Sealed != nil {
+		if t.passphrase == "" {
+			return true, fmt.Errorf(
+				"%s is encrypted but broker.accesskey.passphrase_source is not set",
+				name,
+			)
+		}
+		if raw, err = sf.Sealed.Open(t.passphrase); err != nil {
+			return true, fmt.Errorf("could not decrypt %s: %w", name, err)
+		}
+		sealed = true
+	}
+	if err = json.Unmarshal(raw, x); err != nil {
+		return sealed, fmt.Errorf("could not unmarshal %s: %w", name, err)
+	}
+	return
+}
+
+// setSecret writes x to the file under the path ps, encrypting it if a
+// passphrase is set.
+func (t *T) setSecret(x interface{}, ps ...string) error {
+	name := filepath.Join(ps...)
+	if t.passphrase != "" {
+		b, err := json.Marshal(x)
+		if err != nil {
+			return err
+		}
+		s, err := clientlib.Seal(b, t.passphrase)
+		if err != nil {
+			return fmt.Errorf("could not encrypt %s: %w", name, err)
+		}
+		x = sealedFile{Sealed: s}
+	}
+	b, err := json.MarshalIndent(x, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writePrivate(t.Fd.Path(ps...), b)
+}
+
+// writePrivate atomically replaces the file at p with b. The file is only
+// ever readable by the owner, even if it was world-readable before.
+func writePrivate(p string, b []byte) (err error) {
+	dir := filepath.Dir(p)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// os.CreateTemp creates the file with mode 0600
+	f, err := os.CreateTemp(dir, "."+filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// loadSecrets reads the servicekey and pofs on startup. If a passphrase is
+// set, files which are not encrypted yet are encrypted, including the ones of
+// other known contracts.
+func (t *T) loadSecrets() error {
+	type secret struct {
+		x  interface{}
+		ps []string
+	}
+	fs := []secret{
+		{&t.pofs, []string{filenames.Pofs}},
+		{&t.sk, []string{filenames.Servicekey}},
+	}
+	ids, err := t.parkedIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fs = append(fs,
+			secret{&[]*pof.T{}, []string{contractsDir, id, filenames.Pofs}},
+			secret{new(*servicekey.T), []string{contractsDir, id, filenames.Servicekey}},
+		)
+	}
+	for _, f := range fs {
+		sealed, err := t.getSecret(f.x, f.ps...)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if t.passphrase != "" && !sealed {
+			t.l.Printf("encrypting %s", filepath.Join(f.ps...))
+			if err = t.setSecret(f.x, f.ps...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setPassphraseSource switches to the passphrase from src and rewrites the
+// servicekey and pofs files of all known contracts accordingly, which decrypts
+// them if src is empty.
+// It is best to lock mutex at the calling site while using this function.
+func (t *T) setPassphraseSource(src string) (err error) {
+	if src == t.passSrc {
+		return nil
+	}
+	p, err := clientlib.Passphrase(src)
+	if err != nil {
+		return err
+	}
+	// read the state of other contracts with the previous passphrase
+	ids, err := t.parkedIDs()
+	if err != nil {
+		return err
+	}
+	var pks []*parked
+	for _, id := range ids {
+		pk, err := t.loadParked(id)
+		if err != nil {
+			return fmt.Errorf("could not read state of contract %s: %w", id, err)
+		}
+		pks = append(pks, pk)
+	}
+	t.passSrc, t.passphrase = src, p
+	if src == "" {
+		t.l.Printf("decrypting %s and %s", filenames.Servicekey, filenames.Pofs)
+	} else {
+		t.l.Printf("encrypting %s and %s with passphrase from %s", filenames.Servicekey, filenames.Pofs, src)
+	}
+	if t.pofs != nil {
+		if err = t.setSecret(&t.pofs, filenames.Pofs); err != nil {
+			return fmt.Errorf("could not write %s: %w", filenames.Pofs, err)
+		}
+	}
+	if t.sk != nil {
+		if err = t.setSecret(&t.sk, filenames.Servicekey); err != nil {
+			return fmt.Errorf("could not write %s: %w", filenames.Servicekey, err)
+		}
+	}
+	for _, pk := range pks {
+		if err = t.saveParked(pk); err != nil {
+			return fmt.Errorf("could not write state of contract %s: %w", pk.ci.Endpoint, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/servicekey"
+)
+
+func TestSetSecret(t *testing.T) {
+	for _, pass := range []string{"", "secret"} {
+		br := testBroker(t)
+		br.passphrase = pass
+		p := br.Fd.Path(filenames.Servicekey)
+		// replaces a world-readable file
+		if err := os.WriteFile(p, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sk := testSK(t, time.Now().Add(time.Hour))
+		if err := br.setSecret(sk, filenames.Servicekey); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := fi.Mode().Perm(); m != 0600 {
+			t.Errorf("passphrase %q: file mode %o", pass, m)
+		}
+		var got *servicekey.T
+		sealed, err := br.getSecret(&got, filenames.Servicekey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sealed != (pass != "") || got.PublicKey.String() != sk.PublicKey.String() {
+			t.Errorf("passphrase %q: read back sealed %v, %v", pass, sealed, got)
+		}
+		// no temporary files are left behind
+		if es, err := os.ReadDir(br.Fd.Path()); err != nil || len(es) != 1 {
+			t.Errorf("passphrase %q: directory contents %v %v", pass, es, err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/status"
+)
+
+const (
+	// longest time the rollover scheduler sleeps, so config reloads and
+	// newly imported accesskeys are picked up in reasonable time
+	rolloverCheck = time.Minute
+	// time to wait after a failed rollover before retrying
+	rolloverRetry = 30 * time.Second
+)
+
+// rolloverAt returns when the current servicekey should be replaced in the
+// background or the zero time if it should not be. Only servicekeys which were
+// used for dialing are rolled over so an idle client does not use up pofs;
+// expired servicekeys are replaced on demand by GetSK instead. It is best to
+// lock mutex at the calling site while using this function.
+func (t *T) rolloverAt() time.Time {
+	ak := t.cfg.Broker.Accesskey
+	if !ak.UseOnDemand || ak.Rollover <= 0 || !t.skUsed || len(t.pofs) == 0 ||
+		t.sk == nil || t.sk.Contract == nil || t.sk.IsExpiredAt(t.now().Unix()) {
+		return time.Time{}
+	}
+	d := time.Duration(ak.Rollover)
+	// never roll over more than halfway through the servicekey lifetime,
+	// otherwise the new servicekey could be due for rollover right away
+	if t.ci != nil {
+		if max := time.Duration(t.ci.Servicekey.Duration) / 2; max > 0 && d > max {
+			d = max
+		}
+	}
+	return time.Unix(t.sk.Contract.SettlementOpen, 0).Add(-d)
+}
+
+// rollover runs the rollover scheduler until shutdown.
+func (t *T) rollover() {
+	for {
+		wait := rolloverCheck
+		t.mu.Lock()
+		at := t.rolloverAt()
+		now := t.now()
+		t.mu.Unlock()
+		if !at.IsZero() {
+			if d := at.Sub(now); d > 0 {
+				if d < wait {
+					wait = d
+				}
+			} else if err := t.Rollover(); err != nil {
+				t.l.Printf("servicekey rollover failed: %s, retrying in %s", err, rolloverRetry)
+				wait = rolloverRetry
+			} else {
+				continue
+			}
+		}
+		select {
+		case <-t.done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Rollover activates a new servicekey from the pof pool and replaces the
+// current one with it. The activation request is performed without holding
+// the broker lock so dialing is not held up; new connections switch to the new
+// servicekey at once while open ones keep using the previous one until they
+// are closed.
+func (t *T) Rollover() (err error) {
+	t.mu.Lock()
+	cu := clientlib.ContractURL(t.Fd)
+	old := t.sk
+	ps := t.pofs
+	gen := t.switches
+	now := t.now().Unix()
+	t.mu.Unlock()
+	if cu == nil {
+		return fmt.Errorf("no contract defined")
+	}
+	var (
+		sk   *servicekey.T
+		src  *pof.T
+		used = map[string]bool{}
+	)
+	for _, p := range ps {
+		if p.IsExpiredAt(now) {
+			continue
+		}
+		t.l.Printf("rolling over to new servicekey from pof %s...", p.Digest())
+		if sk, err = t.NewSKFromPof(cu.String()+"/servicekey/activate", p); err != nil {
+			t.l.Printf(
+				"failed generating new servicekey from pof %s: %s",
+				p.Digest(),
+				err,
+			)
+			if errors.Is(err, status.ErrSneakyPof) {
+				// drop already used pof
+				used[p.Digest()] = true
+			}
+			continue
+		}
+		src = p
+		break
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switched := t.switches != gen
+	if switched {
+		// the rejected pofs belong to the contract which was active before
+		used = map[string]bool{}
+	}
+	switch {
+	case sk == nil:
+		if err == nil {
+			err = fmt.Errorf("no fresh pofs available")
+		}
+		err = fmt.Errorf("no servicekey available: %w", err)
+	case switched:
+		t.l.Printf("contract was switched during rollover, discarding %s", sk.PublicKey)
+		sk = nil
+	case t.sk != old && t.sk != nil && t.sk.Contract.SettlementOpen >= sk.Contract.SettlementOpen:
+		// replaced on demand in the meantime, keep the fresher one; src is
+		// neither recorded nor dropped as sk is not committed
+		t.l.Printf("servicekey was replaced during rollover, discarding %s", sk.PublicKey)
+		sk = nil
+	}
+	prev, prevUsed := t.sk, t.skUsed
+	if sk != nil {
+		t.sk, t.skUsed = sk, false
+		if err = t.setSecret(&t.sk, filenames.Servicekey); err != nil {
+			t.sk, t.skUsed = prev, prevUsed
+			err = fmt.Errorf(
+				"could not write new %s: %s",
+				filenames.Servicekey,
+				err,
+			)
+			sk = nil
+		} else {
+			// committed, src is used up now
+			t.recordActivation(src, sk)
+			used[src.Digest()] = true
+		}
+	}
+	// pofs may have been imported or used in the meantime
+	newps := []*pof.T{}
+	for _, p := range t.pofs {
+		if !used[p.Digest()] && !p.IsExpiredAt(now) {
+			newps = append(newps, p)
+		}
+	}
+	t.pofs = newps
+	if err1 := t.setSecret(&t.pofs, filenames.Pofs); err1 != nil && err == nil {
+		err = fmt.Errorf(
+			"could not write new %s: %s",
+			filenames.Pofs,
+			err1,
+		)
+	}
+	if sk == nil {
+		return
+	}
+	if prev != nil {
+		t.l.Printf(
+			"rolled over servicekey %s to %s, draining %d connection(s) using the previous one",
+			prev.PublicKey,
+			sk.PublicKey,
+			t.skConns[prev.PublicKey.String()],
+		)
+	} else {
+		t.l.Printf("rolled over to servicekey %s", sk.PublicKey)
+	}
+	return nil
+}
+
+// holdSK counts an open connection using sk.
+func (t *T) holdSK(sk *servicekey.T) {
+	if sk == nil {
+		return
+	}
+	t.mu.Lock()
+	t.skConns[sk.PublicKey.String()]++
+	t.mu.Unlock()
+}
+
+// releaseSK counts a closed connection using sk and logs when a servicekey
+// which was rolled over has no connections left.
+func (t *T) releaseSK(sk *servicekey.T) {
+	if sk == nil {
+		return
+	}
+	k := sk.PublicKey.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.skConns[k]--; t.skConns[k] > 0 {
+		return
+	}
+	delete(t.skConns, k)
+	if t.sk != nil && t.sk.PublicKey.String() != k {
+		t.l.Printf("previous servicekey %s drained", k)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/status"
+)
+
+// testPofs returns n distinct pofs expiring in a day.
+func testPofs(n int) (r []*pof.T) {
+	for i := 0; i < n; i++ {
+		r = append(r, &pof.T{
+			Type:       "test",
+			Expiration: time.Now().Add(24 * time.Hour).Unix(),
+			Nonce:      strconv.Itoa(i),
+		})
+	}
+	return
+}
+
+// activator is a stand-in contract activating servicekeys which expire in an
+// hour. Pofs in sneaky are rejected as used; during is called while handling
+// each activation request.
+type activator struct {
+	mu        sync.Mutex
+	activated []string
+	sneaky    map[string]bool
+	during    func()
+}
+
+func (a *activator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req pof.SKActivationRequest
+	if r.URL.Path != "/servicekey/activate" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		status.ErrRequest.WriteTo(w)
+		return
+	}
+	a.mu.Lock()
+	sneaky := a.sneaky[req.Pof.Digest()]
+	if !sneaky {
+		a.activated = append(a.activated, req.Pof.Digest())
+	}
+	a.mu.Unlock()
+	if sneaky {
+		status.ErrSneakyPof.WriteTo(w)
+		return
+	}
+	if a.during != nil {
+		a.during()
+	}
+	json.NewEncoder(w).Encode(&servicekey.Contract{SettlementOpen: time.Now().Add(time.Hour).Unix()})
+}
+
+// rolloverBroker returns a broker using the stand-in contract a, a used
+// servicekey expiring in ten minutes and pofs.
+func rolloverBroker(t *testing.T, a *activator, pofs []*pof.T) *T {
+	br := testBroker(t)
+	useContract(t, br, a)
+	br.sk = testSK(t, time.Now().Add(10*time.Minute))
+	br.skUsed = true
+	br.pofs = pofs
+	return br
+}
+
+// storedPofs returns the digests of the pofs in the pool and on disk.
+func storedPofs(t *testing.T, br *T) (mem, disk []string) {
+	var ps []*pof.T
+	if err := br.Fd.Get(&ps, filenames.Pofs); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, p := range br.pofs {
+		mem = append(mem, p.Digest())
+	}
+	for _, p := range ps {
+		disk = append(disk, p.Digest())
+	}
+	return
+}
+
+func TestRollover(t *testing.T) {
+	a := &activator{}
+	ps := testPofs(2)
+	br := rolloverBroker(t, a, ps)
+	old := br.sk
+	if err := br.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if br.sk == old || br.skUsed {
+		t.Fatal("servicekey was not replaced")
+	}
+	var sk *servicekey.T
+	if err := br.Fd.Get(&sk, filenames.Servicekey); err != nil || sk.PublicKey.String() != br.sk.PublicKey.String() {
+		t.Errorf("new servicekey not written: %v", err)
+	}
+	if h := br.History(); len(h) != 1 || h[0].Pof != ps[0].Digest() || h[0].Servicekey != br.sk.PublicKey.String() {
+		t.Errorf("unexpected history %+v", h)
+	}
+	mem, disk := storedPofs(t, br)
+	if len(mem) != 1 || mem[0] != ps[1].Digest() || len(disk) != 1 || disk[0] != ps[1].Digest() {
+		t.Errorf("used pof not dropped: %v, on disk %v", mem, disk)
+	}
+}
+
+func TestRolloverSneaky(t *testing.T) {
+	ps := testPofs(3)
+	a := &activator{sneaky: map[string]bool{ps[0].Digest(): true}}
+	br := rolloverBroker(t, a, ps)
+	if err := br.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if h := br.History(); len(h) != 1 || h[0].Pof != ps[1].Digest() {
+		t.Errorf("unexpected history %+v", h)
+	}
+	// both the rejected and the used pof are dropped
+	if mem, disk := storedPofs(t, br); len(mem) != 1 || mem[0] != ps[2].Digest() || len(disk) != 1 {
+		t.Errorf("unexpected pofs left: %v, on disk %v", mem, disk)
+	}
+}
+
+// The current servicekey is replaced on demand while the rollover activation
+// request is in flight.
+func TestRolloverWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// expiry of the servicekey activated in the meantime
+		exp time.Duration
+		// whether the rollover servicekey is kept
+		kept bool
+	}{
+		{"fresher", 2 * time.Hour, false},
+		{"staler", 30 * time.Minute, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &activator{}
+			ps := testPofs(2)
+			br := rolloverBroker(t, a, ps)
+			other := testSK(t, time.Now().Add(tc.exp))
+			a.during = func() {
+				br.mu.Lock()
+				br.sk, br.skUsed = other, true
+				br.mu.Unlock()
+			}
+			if err := br.Rollover(); err != nil {
+				t.Fatal(err)
+			}
+			mem, _ := storedPofs(t, br)
+			h := br.History()
+			if tc.kept {
+				if br.sk == other || br.skUsed {
+					t.Error("staler servicekey was kept")
+				}
+				if len(h) != 1 || len(mem) != 1 {
+					t.Errorf("activation not recorded: history %+v, pofs %v", h, mem)
+				}
+				return
+			}
+			if br.sk != other || !br.skUsed {
+				t.Error("fresher servicekey was replaced")
+			}
+			// discarded: neither recorded nor dropped
+			if len(h) != 0 {
+				t.Errorf("discarded activation recorded: %+v", h)
+			}
+			if len(mem) != 2 {
+				t.Errorf("pof of discarded activation dropped: %v", mem)
+			}
+			var sk *servicekey.T
+			if err := br.Fd.Get(&sk, filenames.Servicekey); err == nil {
+				t.Errorf("discarded servicekey %s written", sk.PublicKey)
+			}
+		})
+	}
+}
+
+// The contract is switched while the rollover activation request is in
+// flight.
+func TestRolloverSwitch(t *testing.T) {
+	a := &activator{}
+	br := rolloverBroker(t, a, testPofs(2))
+	switchable(br)
+	old, prevID := br.sk, contractID(br.ci.Endpoint)
+	other := newContract(t, nil)
+	id := park(t, br, other, nil, testPofs(1))
+	a.during = func() {
+		br.mu.Lock()
+		defer br.mu.Unlock()
+		if err := br.switchTo(id); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := br.Rollover(); err != nil {
+		t.Fatal(err)
+	}
+	if br.ci.Endpoint.String() != other.ci.Endpoint.String() {
+		t.Fatalf("not switched to %s", other.ci.Endpoint)
+	}
+	// the new servicekey of the previous contract is not committed to the
+	// new one
+	var sk *servicekey.T
+	if _, err := br.getSecret(&sk, filenames.Servicekey); br.sk != nil || sk != nil || err != nil {
+		t.Errorf("servicekey of previous contract committed: %v %v %v", br.sk, sk, err)
+	}
+	if h := br.History(); len(h) != 0 {
+		t.Errorf("discarded activation recorded: %+v", h)
+	}
+	if mem, disk := storedPofs(t, br); len(mem) != 1 || len(disk) != 1 {
+		t.Errorf("pofs of new contract changed: %v %v", mem, disk)
+	}
+	// the previous contract keeps its servicekey
+	if p, err := br.loadParked(prevID); err != nil || p.sk == nil || p.sk.PublicKey.String() != old.PublicKey.String() {
+		t.Errorf("previous contract state not kept: %v", err)
+	}
+}
+
+func TestRolloverWriteFailure(t *testing.T) {
+	a := &activator{}
+	ps := testPofs(2)
+	br := rolloverBroker(t, a, ps)
+	old := br.sk
+	// writing the servicekey fails if a directory is in the way
+	if err := os.Mkdir(br.Fd.Path(filenames.Servicekey), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := br.Rollover(); err == nil {
+		t.Fatal("expected error")
+	}
+	if br.sk != old || !br.skUsed {
+		t.Error("servicekey replaced although not committed")
+	}
+	if h := br.History(); len(h) != 0 {
+		t.Errorf("uncommitted activation recorded: %+v", h)
+	}
+	if mem, _ := storedPofs(t, br); len(mem) != 2 {
+		t.Errorf("pof of uncommitted activation dropped: %v", mem)
+	}
+}
+
+func TestRolloverNoPofs(t *testing.T) {
+	ps := testPofs(1)
+	ps[0].Expiration = time.Now().Add(-time.Minute).Unix()
+	a := &activator{}
+	br := rolloverBroker(t, a, ps)
+	if err := br.Rollover(); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(a.activated) != 0 {
+		t.Errorf("expired pof activated: %v", a.activated)
+	}
+	// expired pofs are pruned
+	if mem, _ := storedPofs(t, br); len(mem) != 0 {
+		t.Errorf("expired pof kept: %v", mem)
+	}
+}
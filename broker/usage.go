@@ -0,0 +1,259 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/texturl"
+)
+
+const (
+	// how often changed usage totals are written
+	usageSave = time.Minute
+	// how long usage totals are kept
+	usageKeep = 400 * 24 * time.Hour
+)
+
+// UsageDay is the time layout of usage days.
+const UsageDay = "2006-01-02"
+
+// Usage is the traffic carried through the circuit with a servicekey for a
+// forwarder on a day.
+type Usage struct {
+	// Day is the UTC date in YYYY-MM-DD format.
+	Day string `json:"day"`
+	// Servicekey is the public key of the servicekey used.
+	Servicekey string `json:"servicekey"`
+	// Pof is the digest of the pof the servicekey was activated with, if
+	// known.
+	Pof string `json:"pof,omitempty"`
+	// Contract is the contract the servicekey was activated by.
+	Contract *texturl.URL `json:"contract,omitempty"`
+	// Forwarder is the name of the forwarder the connections came from.
+	Forwarder string `json:"forwarder"`
+	// Connections is the number of connections opened.
+	Connections int64 `json:"connections"`
+	// Sent is the number of bytes sent through the circuit.
+	Sent int64 `json:"sent"`
+	// Received is the number of bytes received through the circuit.
+	Received int64 `json:"received"`
+}
+
+// usage keeps the usage totals by day, servicekey and forwarder.
+type usage struct {
+	mu    sync.Mutex
+	recs  map[usageKey]*Usage
+	dirty bool
+	// open connections with traffic which may not be added yet
+	open map[*usageConn]struct{}
+}
+
+type usageKey struct{ day, sk, fwdr string }
+
+// add adds the given counts to the totals of the servicekey and forwarder in
+// tmpl on the day of at.
+func (u *usage) add(tmpl *Usage, at time.Time, conns, sent, recvd int64) {
+	day := at.UTC().Format(UsageDay)
+	k := usageKey{day, tmpl.Servicekey, tmpl.Forwarder}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := u.recs[k]
+	if r == nil {
+		r = &Usage{
+			Day:        day,
+			Servicekey: tmpl.Servicekey,
+			Pof:        tmpl.Pof,
+			Contract:   tmpl.Contract,
+			Forwarder:  tmpl.Forwarder,
+		}
+		if u.recs == nil {
+			u.recs = map[usageKey]*Usage{}
+		}
+		u.recs[k] = r
+	}
+	r.Connections += conns
+	r.Sent += sent
+	r.Received += recvd
+	u.dirty = true
+}
+
+// list returns copies of the totals for the days from to to (inclusive,
+// either can be empty), sorted by day, servicekey and forwarder.
+func (u *usage) list(from, to string) []*Usage {
+	u.mu.Lock()
+	r := []*Usage{}
+	for _, x := range u.recs {
+		if (from == "" || x.Day >= from) && (to == "" || x.Day <= to) {
+			c := *x
+			r = append(r, &c)
+		}
+	}
+	u.mu.Unlock()
+	sort.Slice(r, func(i, j int) bool {
+		a, b := r[i], r[j]
+		switch {
+		case a.Day != b.Day:
+			return a.Day < b.Day
+		case a.Servicekey != b.Servicekey:
+			return a.Servicekey < b.Servicekey
+		}
+		return a.Forwarder < b.Forwarder
+	})
+	return r
+}
+
+// usageConn counts the traffic of a connection through the circuit. The
+// counts are kept in the connection and only added to the totals on flush so
+// reads and writes do not contend for the lock.
+type usageConn struct {
+	// traffic not added to the totals yet, first for 64-bit alignment of
+	// atomic operations on 32-bit platforms
+	sent, recvd int64
+	net.Conn
+	u    *usage
+	tmpl *Usage
+	// clock correction as of opening the connection
+	off    time.Duration
+	closed sync.Once
+}
+
+func (c *usageConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddInt64(&c.recvd, int64(n))
+	}
+	return
+}
+
+func (c *usageConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		atomic.AddInt64(&c.sent, int64(n))
+	}
+	return
+}
+
+// Close closes the connection and adds its remaining traffic to the totals.
+func (c *usageConn) Close() error {
+	err := c.Conn.Close()
+	c.closed.Do(func() {
+		c.u.mu.Lock()
+		delete(c.u.open, c)
+		c.u.mu.Unlock()
+		c.flush()
+	})
+	return err
+}
+
+// flush adds the traffic counted since the previous flush to the totals.
+func (c *usageConn) flush() {
+	sent, recvd := atomic.SwapInt64(&c.sent, 0), atomic.SwapInt64(&c.recvd, 0)
+	if sent != 0 || recvd != 0 {
+		c.u.add(c.tmpl, time.Now().Add(c.off), 0, sent, recvd)
+	}
+}
+
+// flushOpen adds the traffic of the open connections counted so far to the
+// totals.
+func (u *usage) flushOpen() {
+	u.mu.Lock()
+	cs := make([]*usageConn, 0, len(u.open))
+	for c := range u.open {
+		cs = append(cs, c)
+	}
+	u.mu.Unlock()
+	for _, c := range cs {
+		c.flush()
+	}
+}
+
+// countUsage counts a new connection c from the forwarder fwdr using sk and
+// returns it wrapped so its traffic is counted as well.
+func (t *T) countUsage(c net.Conn, fwdr string, sk *servicekey.T) net.Conn {
+	tmpl := &Usage{
+		Servicekey: sk.PublicKey.String(),
+		Pof:        t.ActivatedWith(sk),
+		Forwarder:  fwdr,
+	}
+	t.mu.Lock()
+	if t.ci != nil {
+		tmpl.Contract = t.ci.Endpoint
+	}
+	off := t.offset()
+	t.mu.Unlock()
+	t.usage.add(tmpl, time.Now().Add(off), 1, 0, 0)
+	uc := &usageConn{Conn: c, u: &t.usage, tmpl: tmpl, off: off}
+	t.usage.mu.Lock()
+	if t.usage.open == nil {
+		t.usage.open = map[*usageConn]struct{}{}
+	}
+	t.usage.open[uc] = struct{}{}
+	t.usage.mu.Unlock()
+	return uc
+}
+
+// Usage returns the usage totals for the days from to to (inclusive, YYYY-MM-DD
+// format, either can be empty) sorted by day, servicekey and forwarder.
+func (t *T) Usage(from, to string) []*Usage {
+	t.usage.flushOpen()
+	return t.usage.list(from, to)
+}
+
+// loadUsage reads the saved usage totals.
+func (t *T) loadUsage() error {
+	var rs []*Usage
+	if err := t.Fd.Get(&rs, filenames.Usage); err != nil {
+		if noFile(err) {
+			return nil
+		}
+		return err
+	}
+	t.usage.mu.Lock()
+	defer t.usage.mu.Unlock()
+	t.usage.recs = map[usageKey]*Usage{}
+	for _, r := range rs {
+		t.usage.recs[usageKey{r.Day, r.Servicekey, r.Forwarder}] = r
+	}
+	return nil
+}
+
+// saveUsage writes the usage totals if they changed, dropping the ones older
+// than usageKeep.
+func (t *T) saveUsage() {
+	t.usage.flushOpen()
+	old := t.Now().Add(-usageKeep).UTC().Format(UsageDay)
+	t.usage.mu.Lock()
+	if !t.usage.dirty {
+		t.usage.mu.Unlock()
+		return
+	}
+	for k := range t.usage.recs {
+		if k.day < old {
+			delete(t.usage.recs, k)
+		}
+	}
+	t.usage.dirty = false
+	t.usage.mu.Unlock()
+	if err := t.Fd.SetIndented(t.usage.list("", ""), filenames.Usage); err != nil {
+		t.l.Printf("could not write %s: %s", filenames.Usage, err)
+	}
+}
+
+// usageSaver writes the usage totals periodically until shutdown.
+func (t *T) usageSaver() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-time.After(usageSave):
+			t.saveUsage()
+		}
+	}
+}
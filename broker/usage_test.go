@@ -0,0 +1,132 @@
+// Copyright (c) 2022 Wireleap
+
+package broker
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/filenames"
+)
+
+// usagePipe returns a counted connection from fwdr and the far end of it,
+// which echoes everything back.
+func usagePipe(t *testing.T, br *T, fwdr string) net.Conn {
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+	return br.countUsage(c1, fwdr, br.sk)
+}
+
+// echo writes n bytes to c and reads them back.
+func echo(t *testing.T, c net.Conn, n int) {
+	b := make([]byte, n)
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write(b)
+		written <- err
+	}()
+	if _, err := io.ReadFull(c, make([]byte, n)); err != nil {
+		t.Error(err)
+	}
+	if err := <-written; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUsageConn(t *testing.T) {
+	br := testBroker(t)
+	br.sk = testSK(t, time.Now().Add(time.Hour))
+	c := usagePipe(t, br, "socks")
+	echo(t, c, 100)
+	// only the connection is counted until the traffic is flushed
+	if us := br.usage.list("", ""); len(us) != 1 || us[0].Connections != 1 || us[0].Sent != 0 || us[0].Received != 0 {
+		t.Errorf("traffic counted before flush: %+v", us[0])
+	}
+	us := br.Usage("", "")
+	if len(us) != 1 || us[0].Sent != 100 || us[0].Received != 100 {
+		t.Fatalf("open connection not flushed: %+v", us)
+	}
+	if us[0].Servicekey != br.sk.PublicKey.String() || us[0].Forwarder != "socks" || us[0].Day != time.Now().UTC().Format(UsageDay) {
+		t.Errorf("unexpected usage record %+v", us[0])
+	}
+	echo(t, c, 10)
+	c.Close()
+	c.Close()
+	us = br.Usage("", "")
+	if len(us) != 1 || us[0].Connections != 1 || us[0].Sent != 110 || us[0].Received != 110 {
+		t.Errorf("got %+v after close, expected 110 bytes each way", us)
+	}
+	if len(br.usage.open) != 0 {
+		t.Errorf("%d connections still open", len(br.usage.open))
+	}
+}
+
+func TestUsageConcurrent(t *testing.T) {
+	br := testBroker(t)
+	br.sk = testSK(t, time.Now().Add(time.Hour))
+	const conns, writes, size = 8, 50, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		fwdr := "socks"
+		if i%2 == 1 {
+			fwdr = "http"
+		}
+		c := usagePipe(t, br, fwdr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				echo(t, c, size)
+			}
+			c.Close()
+		}()
+	}
+	// flushes while counting are not lost or doubled
+	for i := 0; i < 10; i++ {
+		br.Usage("", "")
+	}
+	wg.Wait()
+	us := br.Usage("", "")
+	if len(us) != 2 {
+		t.Fatalf("got %d usage records, expected 2", len(us))
+	}
+	for _, u := range us {
+		if u.Connections != conns/2 || u.Sent != conns/2*writes*size || u.Received != u.Sent {
+			t.Errorf("unexpected totals %+v", u)
+		}
+	}
+}
+
+func TestSaveUsage(t *testing.T) {
+	br := testBroker(t)
+	br.sk = testSK(t, time.Now().Add(time.Hour))
+	old := &Usage{Servicekey: "old", Forwarder: "socks"}
+	br.usage.add(old, time.Now().Add(-usageKeep-48*time.Hour), 1, 2, 3)
+	c := usagePipe(t, br, "socks")
+	defer c.Close()
+	echo(t, c, 100)
+	// open connections are flushed and expired totals dropped
+	br.saveUsage()
+	var saved []*Usage
+	if err := br.Fd.Get(&saved, filenames.Usage); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].Servicekey == "old" || saved[0].Sent != 100 {
+		t.Fatalf("saved %+v", saved)
+	}
+	// loaded back as saved
+	br2 := testBroker(t)
+	br2.Fd = br.Fd
+	if err := br2.loadUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if us := br2.Usage("", ""); len(us) != 1 || *us[0] != *saved[0] {
+		t.Errorf("loaded %+v, expected %+v", us, saved)
+	}
+}
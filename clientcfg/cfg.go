@@ -18,6 +18,8 @@ type C struct {
 	Broker Broker `json:"broker,omitempty"`
 	// Forwarders holds the settings specific to the wireleap broker.
 	Forwarders Forwarders `json:"forwarders,omitempty"`
+	// Pac holds the settings of the generated proxy auto-config file.
+	Pac Pac `json:"pac,omitempty"`
 }
 
 type Broker struct {
@@ -27,6 +29,8 @@ type Broker struct {
 	Accesskey Accesskey `json:"accesskey,omitempty"`
 	// Circuit describes the configuration of the Wireleap connection circuit.
 	Circuit Circuit `json:"circuit,omitempty"`
+	// Clock describes how the local clock is checked against the contract.
+	Clock Clock `json:"clock,omitempty"`
 }
 
 // Accesskey is the section dealing with accesskey configuration.
@@ -34,6 +38,40 @@ type Accesskey struct {
 	// UseOnDemand sets whether pofs are used to generate new servicekeys
 	// automatically.
 	UseOnDemand bool `json:"use_on_demand"`
+	// Rollover is how long before the current servicekey expires the next
+	// one is activated in the background. Zero disables rollover.
+	Rollover duration.T `json:"rollover"`
+	// Warn is the list of thresholds of remaining accesskey time (assuming
+	// continuous use) at which a warning is emitted.
+	Warn []duration.T `json:"warn"`
+	// Webhook, if set, is the URL warnings are POSTed to as JSON through
+	// the circuit.
+	Webhook string `json:"webhook"`
+	// WebhookDirect sets whether warnings are POSTed to Webhook directly,
+	// revealing the address of this host to it.
+	WebhookDirect bool `json:"webhook_direct"`
+	// PassphraseSource, if set, is where the passphrase servicekey.json
+	// and pofs.json are encrypted with is obtained from.
+	PassphraseSource string `json:"passphrase_source"`
+	// Failover sets whether another known contract with accesskeys left is
+	// switched to when the active one runs out of them or is unreachable.
+	Failover bool `json:"failover"`
+	// Download describes how accesskeys are downloaded on import.
+	Download Download `json:"download"`
+}
+
+// Download describes how accesskeys are downloaded from https URLs on import.
+type Download struct {
+	// Timeout is the maximum duration of a download.
+	Timeout duration.T `json:"timeout,omitempty"`
+	// MaxSize is the maximum size of a downloaded accesskey file in bytes.
+	MaxSize int64 `json:"max_size,omitempty"`
+	// CACerts is the list of PEM files with CA certificates to trust in
+	// addition to the system ones.
+	CACerts []string `json:"ca_certs"`
+	// Circuit sets whether downloads go through the wireleap circuit
+	// instead of connecting directly.
+	Circuit bool `json:"circuit"`
 }
 
 // Circuit describes the configuration of the Wireleap connection circuit.
@@ -46,12 +84,28 @@ type Circuit struct {
 	Hops int `json:"hops,omitempty"`
 }
 
+// Clock describes how the offset of the local clock, as estimated from the
+// Date headers of contract and directory responses, is handled.
+type Clock struct {
+	// Warn is the offset above which a warning is emitted. Zero disables
+	// warnings.
+	Warn duration.T `json:"warn"`
+	// Compensate sets whether the offset is applied when deciding whether
+	// servicekeys and pofs have expired.
+	Compensate bool `json:"compensate"`
+}
+
 // Forwarders describes the settings of the available forwarders.
 type Forwarders struct {
-	// Socks is the SOCKSv5 TCP and UDP listening address.
-	Socks Forwarder `json:"socks,omitempty"`
+	// Socks is the SOCKSv5 TCP and UDP listening address configuration.
+	Socks SocksForwarder `json:"socks,omitempty"`
 	// Tun is the listening address configuration for wireleap_tun.
-	Tun Forwarder `json:"tun,omitempty"`
+	Tun TunForwarder `json:"tun,omitempty"`
+	// Http is the HTTP proxy listening address configuration.
+	Http HttpForwarder `json:"http,omitempty"`
+	// Redirect is the transparent proxy listening address configuration
+	// for wireleap_redirect (Linux only).
+	Redirect Forwarder `json:"redirect,omitempty"`
 }
 
 // Forwarder describes a single forwarder.
@@ -59,6 +113,58 @@ type Forwarder struct {
 	Address string `json:"address,omitempty"`
 }
 
+// ACL restricts the source addresses a forwarder accepts connections and
+// datagrams from. Entries are IP addresses or CIDR ranges.
+type ACL struct {
+	// Allow, if not empty, is the list of sources which are accepted.
+	Allow []string `json:"allow"`
+	// Deny is the list of sources which are rejected, even if allowed.
+	Deny []string `json:"deny"`
+}
+
+// SocksForwarder describes the SOCKSv5 forwarder.
+type SocksForwarder struct {
+	Forwarder
+	ACL
+	// Username and Password, if set, are required from SOCKSv5 clients
+	// using username/password authentication (RFC1929).
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// HttpForwarder describes the HTTP proxy forwarder.
+type HttpForwarder struct {
+	Forwarder
+	ACL
+	// Username and Password, if set, are required from HTTP proxy clients
+	// using Basic Proxy-Authorization.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// TunForwarder describes the tun forwarder.
+type TunForwarder struct {
+	Forwarder
+	// MTU is the MTU of the tun device. TCP MSS is clamped and UDP
+	// datagrams are fragmented accordingly.
+	MTU int `json:"mtu,omitempty"`
+	// Gateway enables tunnelling traffic from other hosts which use this
+	// one as their IPv4 gateway (Linux only).
+	Gateway bool `json:"gateway,omitempty"`
+}
+
+// Pac describes the proxy auto-config file served by the controller.
+type Pac struct {
+	// Bypass is the list of hosts, domains and IPv4 CIDR ranges which are
+	// connected to directly instead of via the SOCKSv5 forwarder. A domain
+	// also matches all of its subdomains.
+	Bypass []string `json:"bypass"`
+	// Proxy is the list of hosts, domains and IPv4 CIDR ranges which are
+	// always routed via the SOCKSv5 forwarder, even if matched by Bypass,
+	// e.g. to proxy a single subdomain of a bypassed domain.
+	Proxy []string `json:"proxy"`
+}
+
 // Defaults provides a config with sane defaults whenever possible.
 func Defaults() C {
 	var (
@@ -66,22 +172,43 @@ func Defaults() C {
 		brokaddr = "127.0.0.1:13490"
 		sksaddr  = "127.0.0.1:13491"
 		tunaddr  = "10.13.49.0:13492"
+		httpaddr = "127.0.0.1:13493"
+		rdraddr  = "127.0.0.1:13494"
 	)
 	return C{
 		Address: &restaddr,
 		Broker: Broker{
-			Address:   &brokaddr,
-			Accesskey: Accesskey{UseOnDemand: true},
+			Address: &brokaddr,
+			Accesskey: Accesskey{
+				UseOnDemand: true,
+				Rollover:    duration.T(time.Minute * 5),
+				Warn:        []duration.T{duration.T(time.Hour * 24), duration.T(time.Hour)},
+				Download: Download{
+					Timeout: duration.T(time.Second * 30),
+					MaxSize: 16 << 20,
+					CACerts: []string{},
+				},
+			},
 			Circuit: Circuit{
 				Timeout:   duration.T(time.Second * 5),
 				Whitelist: []string{},
 				Hops:      1,
 			},
+			Clock: Clock{Warn: duration.T(time.Minute)},
 		},
 		Forwarders: Forwarders{
-			Socks: Forwarder{Address: sksaddr},
-			Tun:   Forwarder{Address: tunaddr},
+			Socks: SocksForwarder{
+				Forwarder: Forwarder{Address: sksaddr},
+				ACL:       ACL{Allow: []string{}, Deny: []string{}},
+			},
+			Tun: TunForwarder{Forwarder: Forwarder{Address: tunaddr}, MTU: 1500},
+			Http: HttpForwarder{
+				Forwarder: Forwarder{Address: httpaddr},
+				ACL:       ACL{Allow: []string{}, Deny: []string{}},
+			},
+			Redirect: Forwarder{Address: rdraddr},
 		},
+		Pac: Pac{Bypass: []string{}, Proxy: []string{}},
 	}
 }
 
@@ -103,10 +230,36 @@ func (c *C) Metadata() []*Meta {
 		{"address", "str", "Controller address", &c.Address, true},
 		{"broker.address", "str", "Override default broker address", &c.Broker.Address, true},
 		{"broker.accesskey.use_on_demand", "bool", "Activate accesskeys as needed", &c.Broker.Accesskey.UseOnDemand, false},
+		{"broker.accesskey.rollover", "str", "Activate next accesskey this long before expiry", &c.Broker.Accesskey.Rollover, true},
+		{"broker.accesskey.warn", "list", "Warn when accesskeys last less than these durations", &c.Broker.Accesskey.Warn, false},
+		{"broker.accesskey.webhook", "str", "URL to POST accesskey warnings to", &c.Broker.Accesskey.Webhook, true},
+		{"broker.accesskey.webhook_direct", "bool", "POST accesskey warnings directly instead of through the circuit", &c.Broker.Accesskey.WebhookDirect, false},
+		{"broker.accesskey.passphrase_source", "str", "Encrypt accesskeys with passphrase from env:VAR, file:PATH or keyring:NAME", &c.Broker.Accesskey.PassphraseSource, true},
+		{"broker.accesskey.failover", "bool", "Switch to another contract when out of accesskeys or unreachable", &c.Broker.Accesskey.Failover, false},
+		{"broker.accesskey.download.timeout", "str", "Accesskey download timeout duration", &c.Broker.Accesskey.Download.Timeout, true},
+		{"broker.accesskey.download.max_size", "int", "Maximum accesskey download size in bytes", &c.Broker.Accesskey.Download.MaxSize, false},
+		{"broker.accesskey.download.ca_certs", "list", "Extra trusted CA certificate PEM files for downloads", &c.Broker.Accesskey.Download.CACerts, false},
+		{"broker.accesskey.download.circuit", "bool", "Download accesskeys through the circuit", &c.Broker.Accesskey.Download.Circuit, false},
 		{"broker.circuit.timeout", "str", "Dial timeout duration", &c.Broker.Circuit.Timeout, true},
 		{"broker.circuit.hops", "int", "Number of relays to use in a circuit", &c.Broker.Circuit.Hops, false},
 		{"broker.circuit.whitelist", "list", "Relay addresses to use in circuit", &c.Broker.Circuit.Whitelist, false},
+		{"broker.clock.warn", "str", "Warn when the local clock is off by more than this duration", &c.Broker.Clock.Warn, true},
+		{"broker.clock.compensate", "bool", "Correct expiry checks for the local clock offset", &c.Broker.Clock.Compensate, false},
 		{"forwarders.socks.address", "str", "SOCKSv5 proxy address", &c.Forwarders.Socks.Address, true},
+		{"forwarders.socks.username", "str", "SOCKSv5 proxy auth username", &c.Forwarders.Socks.Username, true},
+		{"forwarders.socks.password", "str", "SOCKSv5 proxy auth password", &c.Forwarders.Socks.Password, true},
+		{"forwarders.socks.allow", "list", "SOCKSv5 client IPs/CIDRs to accept (default all)", &c.Forwarders.Socks.Allow, false},
+		{"forwarders.socks.deny", "list", "SOCKSv5 client IPs/CIDRs to reject", &c.Forwarders.Socks.Deny, false},
 		{"forwarders.tun.address", "str", "TUN device address (not loopback)", &c.Forwarders.Tun.Address, true},
+		{"forwarders.tun.mtu", "int", "TUN device MTU", &c.Forwarders.Tun.MTU, false},
+		{"forwarders.tun.gateway", "bool", "Tunnel traffic of LAN hosts using this one as gateway", &c.Forwarders.Tun.Gateway, false},
+		{"forwarders.http.address", "str", "HTTP proxy address", &c.Forwarders.Http.Address, true},
+		{"forwarders.http.username", "str", "HTTP proxy auth username", &c.Forwarders.Http.Username, true},
+		{"forwarders.http.password", "str", "HTTP proxy auth password", &c.Forwarders.Http.Password, true},
+		{"forwarders.http.allow", "list", "HTTP proxy client IPs/CIDRs to accept (default all)", &c.Forwarders.Http.Allow, false},
+		{"forwarders.http.deny", "list", "HTTP proxy client IPs/CIDRs to reject", &c.Forwarders.Http.Deny, false},
+		{"forwarders.redirect.address", "str", "Transparent proxy address (loopback)", &c.Forwarders.Redirect.Address, true},
+		{"pac.bypass", "list", "Hosts, domains and CIDRs not proxied in proxy.pac", &c.Pac.Bypass, false},
+		{"pac.proxy", "list", "Hosts, domains and CIDRs proxied in proxy.pac even if bypassed", &c.Pac.Proxy, false},
 	}
 }
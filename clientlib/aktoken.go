@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Wireleap
+
+package clientlib
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/wireleap/common/api/accesskey"
+)
+
+// AccesskeyTokenScheme is the URL scheme of compact accesskey tokens. A token
+// is the scheme followed by the base64url-encoded (unpadded) DEFLATE-compressed
+// JSON of an accesskey file, which is short enough to paste or scan from a QR
+// code.
+const AccesskeyTokenScheme = "wlak"
+
+// maxAccesskeySize is the largest decoded accesskey file accepted from data:
+// URLs and tokens.
+const maxAccesskeySize = 16 << 20
+
+// EncodeAccesskeyToken encodes ak as a compact accesskey token.
+func EncodeAccesskeyToken(ak *accesskey.T) (string, error) {
+	b, err := json.Marshal(ak)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(b); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	return AccesskeyTokenScheme + ":" + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecodeAccesskeyToken returns the accesskey file JSON contained in the token
+// URL u.
+func DecodeAccesskeyToken(u url.URL) ([]byte, error) {
+	if u.Scheme != AccesskeyTokenScheme || u.Opaque == "" {
+		return nil, fmt.Errorf("not an accesskey token")
+	}
+	z, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(u.Opaque, "="))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode accesskey token: %w", err)
+	}
+	b, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(z)), maxAccesskeySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress accesskey token: %w", err)
+	}
+	if len(b) > maxAccesskeySize {
+		return nil, fmt.Errorf("accesskey token is too large")
+	}
+	return b, nil
+}
+
+// DataURL returns a base64-encoded data: URL containing the JSON in b.
+func DataURL(b []byte) *url.URL {
+	return &url.URL{
+		Scheme: "data",
+		Opaque: "application/json;base64," + base64.StdEncoding.EncodeToString(b),
+	}
+}
+
+// ReadDataURL returns the contents of the RFC 2397 data: URL u.
+func ReadDataURL(u url.URL) ([]byte, error) {
+	if u.Scheme != "data" {
+		return nil, fmt.Errorf("not a data: URL")
+	}
+	// data:[<mediatype>][;base64],<data>
+	s := u.Opaque
+	i := strings.IndexByte(s, ',')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed data: URL, missing comma")
+	}
+	meta, data := s[:i], s[i+1:]
+	data, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed data: URL: %w", err)
+	}
+	var b []byte
+	if strings.HasSuffix(meta, ";base64") {
+		// be lenient about padding and the URL-safe alphabet
+		data = strings.TrimRight(data, "=")
+		data = strings.NewReplacer("-", "+", "_", "/", "\n", "", "\r", "", " ", "").Replace(data)
+		if b, err = base64.RawStdEncoding.DecodeString(data); err != nil {
+			return nil, fmt.Errorf("could not decode data: URL: %w", err)
+		}
+	} else {
+		b = []byte(data)
+	}
+	if len(b) > maxAccesskeySize {
+		return nil, fmt.Errorf("data: URL is too large")
+	}
+	return b, nil
+}
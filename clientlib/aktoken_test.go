@@ -0,0 +1,148 @@
+// Copyright (c) 2022 Wireleap
+
+package clientlib
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/common/api/accesskey"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/pof"
+	"github.com/wireleap/common/api/texturl"
+)
+
+func testAccesskey(n int) *accesskey.T {
+	ak := &accesskey.T{
+		Version: &accesskey.VERSION,
+		Contract: &accesskey.Contract{
+			Endpoint:  texturl.URLMustParse("https://contract.example.com"),
+			PublicKey: jsonb.PK(bytes.Repeat([]byte{1}, 32)),
+		},
+	}
+	for i := 0; i < n; i++ {
+		ak.Pofs = append(ak.Pofs, &pof.T{
+			Type:       "pof",
+			Expiration: 1700000000,
+			Nonce:      strconv.Itoa(i),
+			Signature:  jsonb.B(bytes.Repeat([]byte{byte(i)}, 64)),
+		})
+	}
+	return ak
+}
+
+func mustParse(t *testing.T, s string) url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+func TestAccesskeyToken(t *testing.T) {
+	ak := testAccesskey(10)
+	tok, err := EncodeAccesskeyToken(ak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tok, AccesskeyTokenScheme+":") || strings.ContainsAny(tok, "+/= ") {
+		t.Errorf("token is not URL-safe: %s", tok)
+	}
+	want, err := json.Marshal(ak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tok) >= len(want) {
+		t.Errorf("token is %d bytes, JSON %d", len(tok), len(want))
+	}
+	// padding is tolerated
+	for _, s := range []string{tok, tok + "=="} {
+		b, err := DecodeAccesskeyToken(mustParse(t, s))
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		if !bytes.Equal(b, want) {
+			t.Errorf("decoded %s, expected %s", b, want)
+		}
+	}
+}
+
+func TestAccesskeyTokenInvalid(t *testing.T) {
+	deflate := func(b []byte) string {
+		buf := &bytes.Buffer{}
+		w, err := flate.NewWriter(buf, flate.BestSpeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(b)
+		w.Close()
+		return AccesskeyTokenScheme + ":" + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+	}
+	for _, tc := range []struct {
+		name, tok, err string
+	}{
+		{"scheme", "data:" + deflate([]byte("{}"))[len(AccesskeyTokenScheme)+1:], "not an accesskey token"},
+		{"empty", AccesskeyTokenScheme + ":", "not an accesskey token"},
+		{"base64", AccesskeyTokenScheme + ":a+b/c", "could not decode"},
+		{"deflate", AccesskeyTokenScheme + ":" + base64.RawURLEncoding.EncodeToString([]byte("not deflate")), "could not decompress"},
+		// a few kilobytes expanding to more than the limit
+		{"bomb", deflate(make([]byte, maxAccesskeySize+1)), "too large"},
+	} {
+		if _, err := DecodeAccesskeyToken(mustParse(t, tc.tok)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, expected %q", tc.name, err, tc.err)
+		}
+	}
+	if _, err := DecodeAccesskeyToken(mustParse(t, deflate(make([]byte, maxAccesskeySize)))); err != nil {
+		t.Errorf("token at the size limit: %s", err)
+	}
+}
+
+func TestReadDataURL(t *testing.T) {
+	ak, err := json.Marshal(testAccesskey(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	std := base64.StdEncoding.EncodeToString(ak)
+	for _, tc := range []struct {
+		name, u string
+		want    []byte
+	}{
+		{"DataURL", DataURL(ak).String(), ak},
+		{"base64", "data:application/json;base64," + std, ak},
+		{"unpadded", "data:;base64," + strings.TrimRight(std, "="), ak},
+		{"url-safe", "data:;base64," + base64.URLEncoding.EncodeToString(ak), ak},
+		{"escaped base64", "data:;base64," + url.PathEscape(std[:20]+"\n"+std[20:]), ak},
+		{"percent-encoded", "data:application/json," + url.PathEscape(string(ak)), ak},
+		{"plain", `data:,{"version":"0.1.0"}`, []byte(`{"version":"0.1.0"}`)},
+		{"empty", "data:,", []byte{}},
+	} {
+		b, err := ReadDataURL(mustParse(t, tc.u))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(b, tc.want) {
+			t.Errorf("%s: got %q, expected %q", tc.name, b, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		name, u, err string
+	}{
+		{"scheme", "http://example.com/,x", "not a data: URL"},
+		{"comma", "data:application/json;base64", "missing comma"},
+		{"escape", "data:,%zz", "malformed data: URL"},
+		{"base64", "data:;base64,a*b", "could not decode"},
+		{"size", "data:," + strings.Repeat("a", maxAccesskeySize+1), "too large"},
+		{"base64 size", "data:;base64," + base64.StdEncoding.EncodeToString(make([]byte, maxAccesskeySize+1)), "too large"},
+	} {
+		if _, err := ReadDataURL(mustParse(t, tc.u)); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, expected %q", tc.name, err, tc.err)
+		}
+	}
+}
@@ -23,7 +23,21 @@ func CircuitDialer(
 	circuitf func() ([]*relayentry.T, error),
 	dialf func(net.Conn, string, *url.URL, *wlnet.Init) (net.Conn, error),
 ) func(string, string) (net.Conn, error) {
-	return func(protocol, target string) (c net.Conn, err error) {
+	dialer := CircuitCommandDialer(skf, circuitf, dialf)
+	return func(protocol, target string) (net.Conn, error) {
+		return dialer("CONNECT", protocol, target)
+	}
+}
+
+// CircuitCommandDialer is like CircuitDialer but also takes the command
+// (CONNECT or BIND) to send to the exit relay. For BIND, target is the
+// address of the peer expected to connect to the exit relay.
+func CircuitCommandDialer(
+	skf func() (*servicekey.T, error),
+	circuitf func() ([]*relayentry.T, error),
+	dialf func(net.Conn, string, *url.URL, *wlnet.Init) (net.Conn, error),
+) func(string, string, string) (net.Conn, error) {
+	return func(command, protocol, target string) (c net.Conn, err error) {
 		sk, err := skf()
 		if err != nil {
 			err = fmt.Errorf("could not obtain fresh servicekey: %w", err)
@@ -66,7 +80,7 @@ func CircuitDialer(
 				return
 			}
 		}
-		log.Printf("Now connecting to target: %s", target)
+		log.Printf("Now sending %s for target: %s", command, target)
 		st, err = sharetoken.New(sk, circuit[len(circuit)-1].Pubkey.T())
 		if err != nil {
 			return
@@ -76,7 +90,7 @@ func CircuitDialer(
 			return
 		}
 		c, err = dialf(c, "tcp", &circuit[len(circuit)-1].Addr.URL, &wlnet.Init{
-			Command:  "CONNECT",
+			Command:  command,
 			Protocol: protocol,
 			Remote:   &texturl.URL{*u},
 			Token:    st,
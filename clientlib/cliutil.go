@@ -35,6 +35,12 @@ func JSONOrDie(w io.Writer, x interface{}) {
 }
 
 func APICallOrDie(method, url string, in interface{}, out interface{}) {
+	APIPerformOrDie(method, url, in, out)
+	JSONOrDie(os.Stdout, out)
+}
+
+// APIPerformOrDie is like APICallOrDie but leaves printing out to the caller.
+func APIPerformOrDie(method, url string, in interface{}, out interface{}) {
 	if err := DefaultAPIClient.Perform(method, url, in, out); err != nil {
 		st := &status.T{}
 		if errors.As(err, &st) {
@@ -44,7 +50,5 @@ func APICallOrDie(method, url string, in interface{}, out interface{}) {
 		} else {
 			log.Fatalf("error while executing API request: %s", err)
 		}
-	} else {
-		JSONOrDie(os.Stdout, out)
 	}
 }
@@ -0,0 +1,53 @@
+// Copyright (c) 2022 Wireleap
+
+package clientlib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// PassphraseSourceHelp describes the supported passphrase sources.
+const PassphraseSourceHelp = "env:VAR, file:PATH or keyring:NAME (Linux)"
+
+// Passphrase obtains a passphrase from src, which is one of:
+//
+//	env:VAR      value of environment variable VAR
+//	file:PATH    contents of file PATH without trailing newlines
+//	keyring:NAME payload of the "user" key NAME in the user keyring (Linux)
+//
+// An empty src yields an empty passphrase.
+func Passphrase(src string) (p string, err error) {
+	if src == "" {
+		return "", nil
+	}
+	kind, arg := src, ""
+	if i := strings.IndexByte(src, ':'); i >= 0 {
+		kind, arg = src[:i], src[i+1:]
+	}
+	if arg == "" {
+		return "", fmt.Errorf("invalid passphrase source %q, expected %s", src, PassphraseSourceHelp)
+	}
+	switch kind {
+	case "env":
+		p = os.Getenv(arg)
+	case "file":
+		var b []byte
+		if b, err = ioutil.ReadFile(arg); err != nil {
+			return "", fmt.Errorf("could not read passphrase file: %w", err)
+		}
+		p = strings.TrimRight(string(b), "\r\n")
+	case "keyring":
+		if p, err = keyring(arg); err != nil {
+			return "", fmt.Errorf("could not read passphrase from keyring: %w", err)
+		}
+	default:
+		return "", fmt.Errorf("invalid passphrase source %q, expected %s", src, PassphraseSourceHelp)
+	}
+	if p == "" {
+		return "", fmt.Errorf("passphrase from %s is empty", src)
+	}
+	return
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2022 Wireleap
+
+package clientlib
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyring reads the payload of the "user" key with description name from the
+// user keyring, as added by `keyctl add user NAME PASSPHRASE @u`.
+func keyring(name string) (string, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_USER_KEYRING, "user", name, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not find key %q: %w", name, err)
+	}
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not read key %q: %w", name, err)
+	}
+	b := make([]byte, n)
+	if n, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, b, 0); err != nil {
+		return "", fmt.Errorf("could not read key %q: %w", name, err)
+	}
+	if n > len(b) {
+		return "", fmt.Errorf("key %q changed while reading", name)
+	}
+	return string(b[:n]), nil
+}
@@ -0,0 +1,12 @@
+// Copyright (c) 2022 Wireleap
+
+//go:build !linux
+// +build !linux
+
+package clientlib
+
+import "fmt"
+
+func keyring(string) (string, error) {
+	return "", fmt.Errorf("keyring passphrase sources are only supported on Linux")
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Wireleap
+
+package clientlib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrPassphrase is returned when sealed data cannot be opened, which is most
+// likely due to a wrong passphrase.
+var ErrPassphrase = errors.New("wrong passphrase or corrupted data")
+
+// scrypt parameters for newly sealed data
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	// largest N accepted when opening
+	scryptMaxN = 1 << 20
+)
+
+// Sealed is data encrypted with AES-256-GCM using a key derived from a
+// passphrase with scrypt. The parameters are stored alongside the data so
+// they can be changed later on.
+type Sealed struct {
+	KDF    string `json:"kdf"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Salt   []byte `json:"salt"`
+	Cipher string `json:"cipher"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+// Seal encrypts data with passphrase.
+func Seal(data []byte, passphrase string) (s *Sealed, err error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	s = &Sealed{
+		KDF:    "scrypt",
+		N:      scryptN,
+		R:      scryptR,
+		P:      scryptP,
+		Salt:   make([]byte, 16),
+		Cipher: "aes-256-gcm",
+	}
+	if _, err = rand.Read(s.Salt); err != nil {
+		return nil, fmt.Errorf("could not generate salt: %w", err)
+	}
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(s.Nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	s.Data = aead.Seal(nil, s.Nonce, data, nil)
+	return
+}
+
+// Open decrypts s with passphrase.
+func (s *Sealed) Open(passphrase string) ([]byte, error) {
+	if s.KDF != "scrypt" || s.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("unsupported kdf %q or cipher %q", s.KDF, s.Cipher)
+	}
+	if s.N > scryptMaxN || s.R > scryptR || s.P > scryptP {
+		// don't let crafted files use up all memory
+		return nil, fmt.Errorf("unsupported scrypt parameters n=%d r=%d p=%d", s.N, s.R, s.P)
+	}
+	aead, err := s.aead(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != aead.NonceSize() {
+		return nil, ErrPassphrase
+	}
+	b, err := aead.Open(nil, s.Nonce, s.Data, nil)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return b, nil
+}
+
+func (s *Sealed) aead(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), s.Salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
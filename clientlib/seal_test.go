@@ -0,0 +1,82 @@
+// Copyright (c) 2022 Wireleap
+
+package clientlib
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	data := []byte(`{"secret":true}`)
+	s, err := Seal(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(s.Data, data) {
+		t.Error("sealed data contains plaintext")
+	}
+	b, err := s.Open("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("opened %q, expected %q", b, data)
+	}
+	// salt and nonce are not reused
+	s2, err := Seal(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(s.Salt, s2.Salt) || bytes.Equal(s.Nonce, s2.Nonce) || bytes.Equal(s.Data, s2.Data) {
+		t.Error("sealing twice gave the same salt, nonce or data")
+	}
+	if _, err = Seal(data, ""); err == nil {
+		t.Error("sealed with an empty passphrase")
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	s, err := Seal([]byte("data"), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	flip := func(b []byte) []byte {
+		b = append([]byte{}, b...)
+		b[0] ^= 1
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		pass string
+		f    func(s Sealed) Sealed
+	}{
+		{"wrong passphrase", "wrong", func(s Sealed) Sealed { return s }},
+		{"tampered data", "secret", func(s Sealed) Sealed { s.Data = flip(s.Data); return s }},
+		{"truncated data", "secret", func(s Sealed) Sealed { s.Data = s.Data[:len(s.Data)-1]; return s }},
+		{"tampered nonce", "secret", func(s Sealed) Sealed { s.Nonce = flip(s.Nonce); return s }},
+		{"short nonce", "secret", func(s Sealed) Sealed { s.Nonce = s.Nonce[1:]; return s }},
+		{"tampered salt", "secret", func(s Sealed) Sealed { s.Salt = flip(s.Salt); return s }},
+	} {
+		x := tc.f(*s)
+		if _, err := x.Open(tc.pass); !errors.Is(err, ErrPassphrase) {
+			t.Errorf("%s: got error %v, expected %v", tc.name, err, ErrPassphrase)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		f    func(s Sealed) Sealed
+	}{
+		{"kdf", func(s Sealed) Sealed { s.KDF = "pbkdf2"; return s }},
+		{"cipher", func(s Sealed) Sealed { s.Cipher = "aes-128-gcm"; return s }},
+		{"large n", func(s Sealed) Sealed { s.N = scryptMaxN * 2; return s }},
+		{"large r", func(s Sealed) Sealed { s.R = scryptR * 2; return s }},
+		{"large p", func(s Sealed) Sealed { s.P = scryptP + 1; return s }},
+	} {
+		x := tc.f(*s)
+		if _, err := x.Open("secret"); err == nil || errors.Is(err, ErrPassphrase) {
+			t.Errorf("%s: got error %v, expected unsupported parameters", tc.name, err)
+		}
+	}
+}
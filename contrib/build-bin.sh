@@ -56,6 +56,26 @@ else
     mv "$SRCDIR/wireleap_socks/wireleap_socks" "$SRCDIR/sub/initcmd/embedded/wireleap_socks"
 fi
 
+info "building wireleap_http"
+cd "$SRCDIR/wireleap_http"
+go get -v -d ./...
+CGO_ENABLED=0 go build
+cd -
+if [ "$GOOS" = 'windows' ]; then
+    mv "$SRCDIR/wireleap_http/wireleap_http.exe" "$SRCDIR/sub/initcmd/embedded/wireleap_http.exe"
+else
+    mv "$SRCDIR/wireleap_http/wireleap_http" "$SRCDIR/sub/initcmd/embedded/wireleap_http"
+fi
+
+if [ "$GOOS" = 'linux' ]; then
+    info "building wireleap_redirect"
+    cd "$SRCDIR/wireleap_redirect"
+    go get -v -d ./...
+    CGO_ENABLED=0 go build
+    cd -
+    mv "$SRCDIR/wireleap_redirect/wireleap_redirect" "$SRCDIR/sub/initcmd/embedded"
+fi
+
 cp "$SRCDIR/LICENSE" "$SRCDIR/sub/initcmd/embedded/"
 
 info "building ..."
@@ -207,6 +207,13 @@ main() {
         echo "  $ sudo chmod u+s $binarydir/wireleap_tun"
     fi
 
+    if [ -e "$binarydir/wireleap_redirect" ]; then
+        echo
+        echo "To enable transparent proxy support, execute the following commands:"
+        echo "  $ sudo chown 0:0 $binarydir/wireleap_redirect"
+        echo "  $ sudo chmod u+s $binarydir/wireleap_redirect"
+    fi
+
     return 0
 }
 
@@ -3,14 +3,16 @@
 package filenames
 
 const (
-	Config     = "config.json"
-	Pid        = "wireleap.pid"
-	Servicekey = "servicekey.json"
-	Pofs       = "pofs.json"
-	Log        = "wireleap.log"
-	Bypass     = "bypass.json"
-	Contract   = "contract.json"
-	Relays     = "relays.json"
+	Config      = "config.json"
+	Pid         = "wireleap.pid"
+	Servicekey  = "servicekey.json"
+	Pofs        = "pofs.json"
+	Log         = "wireleap.log"
+	Bypass      = "bypass.json"
+	Contract    = "contract.json"
+	Relays      = "relays.json"
+	Activations = "activations.json"
+	Usage       = "usage.json"
 )
 
 var InitFiles = [...]string{Config, Servicekey, Pofs}
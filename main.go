@@ -18,11 +18,14 @@ import (
 
 	"github.com/wireleap/client/sub/accesskeyscmd"
 	"github.com/wireleap/client/sub/configcmd"
+	"github.com/wireleap/client/sub/contractscmd"
 	"github.com/wireleap/client/sub/execcmd"
+	"github.com/wireleap/client/sub/httpcmd"
 	"github.com/wireleap/client/sub/httpgetcmd"
 	"github.com/wireleap/client/sub/initcmd"
 	"github.com/wireleap/client/sub/interceptcmd"
 	"github.com/wireleap/client/sub/logcmd"
+	"github.com/wireleap/client/sub/redirectcmd"
 	"github.com/wireleap/client/sub/reloadcmd"
 	"github.com/wireleap/client/sub/restartcmd"
 	"github.com/wireleap/client/sub/sockscmd"
@@ -30,6 +33,7 @@ import (
 	"github.com/wireleap/client/sub/statuscmd"
 	"github.com/wireleap/client/sub/stopcmd"
 	"github.com/wireleap/client/sub/tuncmd"
+	"github.com/wireleap/client/sub/usagecmd"
 	"github.com/wireleap/client/sub/versioncmd"
 	"github.com/wireleap/client/version"
 )
@@ -44,6 +48,8 @@ func main() {
 			initcmd.Cmd(),
 			configcmd.Cmd(fm),
 			accesskeyscmd.Cmd(),
+			contractscmd.Cmd(),
+			usagecmd.Cmd(),
 			startcmd.Cmd(binname),
 			statuscmd.Cmd(binname),
 			reloadcmd.Cmd(binname),
@@ -52,6 +58,8 @@ func main() {
 			logcmd.Cmd(binname),
 			tuncmd.Cmd(),
 			sockscmd.Cmd(),
+			httpcmd.Cmd(),
+			redirectcmd.Cmd(),
 			interceptcmd.Cmd(),
 			httpgetcmd.Cmd(),
 			execcmd.Cmd(),
@@ -3,6 +3,8 @@ package restapi
 import (
 	"time"
 
+	"github.com/wireleap/client/broker"
+	"github.com/wireleap/common/api/contractinfo"
 	"github.com/wireleap/common/api/pof"
 	"github.com/wireleap/common/api/servicekey"
 	"github.com/wireleap/common/api/texturl"
@@ -12,21 +14,33 @@ type AccesskeyImportRequest struct {
 	URL *texturl.URL `json:"url"`
 }
 
+type AccesskeyExportRequest struct {
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+type AccesskeyRestoreRequest struct {
+	Bundle     *broker.Bundle `json:"bundle"`
+	Passphrase string         `json:"passphrase,omitempty"`
+}
+
 type AccesskeyReply struct {
 	Contract   *texturl.URL `json:"contract"`
 	Duration   int64        `json:"duration"`
 	State      string       `json:"state"`
 	Expiration int64        `json:"expiration"`
+	Digest     string       `json:"digest,omitempty"`
 }
 
-func (t *T) accesskeysFromSks(sks ...*servicekey.T) (rs []*AccesskeyReply) {
-	ci := t.br.ContractInfo()
+func (t *T) accesskeysFromSks(ci *contractinfo.T, sks ...*servicekey.T) (rs []*AccesskeyReply) {
+	if ci == nil {
+		return
+	}
 	for _, sk := range sks {
 		if sk == nil {
 			continue
 		}
 		state := "active"
-		if sk.IsExpiredAt(time.Now().Unix()) {
+		if sk.IsExpiredAt(t.br.Now().Unix()) {
 			state = "expired"
 		}
 		rs = append(rs, &AccesskeyReply{
@@ -34,19 +48,22 @@ func (t *T) accesskeysFromSks(sks ...*servicekey.T) (rs []*AccesskeyReply) {
 			Duration:   int64(time.Duration(ci.Servicekey.Duration) / time.Second),
 			State:      state,
 			Expiration: sk.Contract.SettlementOpen,
+			Digest:     t.br.ActivatedWith(sk),
 		})
 	}
 	return
 }
 
-func (t *T) accesskeysFromPofs(pofs ...*pof.T) (rs []*AccesskeyReply) {
-	ci := t.br.ContractInfo()
+func (t *T) accesskeysFromPofs(ci *contractinfo.T, pofs ...*pof.T) (rs []*AccesskeyReply) {
+	if ci == nil {
+		return
+	}
 	for _, p := range pofs {
 		if p == nil {
 			continue
 		}
 		state := "inactive"
-		if p.IsExpiredAt(time.Now().Unix()) {
+		if p.IsExpiredAt(t.br.Now().Unix()) {
 			state = "expired"
 		}
 		rs = append(rs, &AccesskeyReply{
@@ -54,14 +71,16 @@ func (t *T) accesskeysFromPofs(pofs ...*pof.T) (rs []*AccesskeyReply) {
 			Duration:   int64(time.Duration(ci.Servicekey.Duration) / time.Second),
 			State:      state,
 			Expiration: p.Expiration,
+			Digest:     p.Digest(),
 		})
 	}
 	return
 }
 
 func (t *T) newAccesskeysReply() (rs []*AccesskeyReply) {
-	rs = append(rs, t.accesskeysFromSks(t.br.CurrentSK())...)
-	rs = append(rs, t.accesskeysFromPofs(t.br.CurrentPofs()...)...)
+	ci := t.br.ContractInfo()
+	rs = append(rs, t.accesskeysFromSks(ci, t.br.CurrentSK())...)
+	rs = append(rs, t.accesskeysFromPofs(ci, t.br.CurrentPofs()...)...)
 	// serve empty list instead of nil
 	if rs == nil {
 		rs = make([]*AccesskeyReply, 0)
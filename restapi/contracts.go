@@ -0,0 +1,7 @@
+package restapi
+
+import "github.com/wireleap/common/api/texturl"
+
+type ContractUseRequest struct {
+	Contract *texturl.URL `json:"contract"`
+}
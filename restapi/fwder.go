@@ -2,6 +2,7 @@ package restapi
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -12,6 +13,8 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,6 +30,7 @@ type FwderReply struct {
 	Pid     int         `json:"pid"`
 	State   string      `json:"state"`
 	Address string      `json:"address"`
+	Denied  uint64      `json:"denied,omitempty"`
 	Binary  binaryReply `json:"binary"`
 }
 
@@ -39,13 +43,37 @@ type binaryState struct {
 	// those are sensible for any forwarder
 	Exists bool `json:"exists"`
 	ChmodX bool `json:"chmod_x"`
-	// those are specific to (currently) only tun
-	Chown0  *bool `json:"chown_0,omitempty"`
-	ChmodUS *bool `json:"chmod_us,omitempty"`
+	// those are specific to (currently) only tun and redirect
+	Chown0      *bool `json:"chown_0,omitempty"`
+	ChmodUS     *bool `json:"chmod_us,omitempty"`
+	CapNetAdmin *bool `json:"cap_net_admin,omitempty"`
+}
+
+// setuidRoot returns whether the binary is owned by root and setuid.
+func (st binaryState) setuidRoot() bool {
+	return st.Chown0 != nil && *st.Chown0 && st.ChmodUS != nil && *st.ChmodUS
+}
+
+// privileged returns whether the binary can configure network devices, either
+// by being setuid root or by having the CAP_NET_ADMIN file capability.
+func (st binaryState) privileged() bool {
+	return st.setuidRoot() || (st.CapNetAdmin != nil && *st.CapNetAdmin)
+}
+
+// capHint returns the alternative to setuid root for the forwarder binary
+// name at binpath, if there is one.
+func (st binaryState) capHint(name, binpath string) string {
+	if name != "tun" || st.CapNetAdmin == nil {
+		return ""
+	}
+	return fmt.Sprintf(" or `setcap cap_net_admin+ep %s`", binpath)
 }
 
 type FwderState struct {
 	State string `json:"state"`
+	// Denied is the number of connections and datagrams rejected by
+	// access control, if the forwarder supports it.
+	Denied uint64 `json:"denied,omitempty"`
 }
 
 func boolptr(x bool) *bool { return &x }
@@ -59,6 +87,10 @@ func isImplemented(name string) (is bool) {
 			is = true
 		case "tun":
 			is = true
+		case "http":
+			is = true
+		case "redirect":
+			is = true
 		}
 	case "darwin":
 		switch name {
@@ -66,6 +98,8 @@ func isImplemented(name string) (is bool) {
 			is = true
 		case "tun":
 			is = true
+		case "http":
+			is = true
 		}
 	case "windows":
 		switch name {
@@ -73,6 +107,8 @@ func isImplemented(name string) (is bool) {
 			is = true
 		case "tun":
 			is = false
+		case "http":
+			is = true
 		}
 	default:
 		is = false
@@ -103,7 +139,13 @@ func (t *T) registerForwarder(name string) {
 				o.Binary.Ok = st.Exists && st.ChmodX
 			case "tun":
 				o.Address = t.br.Config().Forwarders.Tun.Address
-				o.Binary.Ok = st.Exists && st.ChmodX && *st.Chown0 && *st.ChmodUS
+				o.Binary.Ok = st.Exists && st.ChmodX && st.privileged()
+			case "http":
+				o.Address = t.br.Config().Forwarders.Http.Address
+				o.Binary.Ok = st.Exists && st.ChmodX
+			case "redirect":
+				o.Address = t.br.Config().Forwarders.Redirect.Address
+				o.Binary.Ok = st.Exists && st.ChmodX && st.privileged()
 			}
 			o.Binary.State = st
 		}
@@ -118,6 +160,7 @@ func (t *T) registerForwarder(name string) {
 		defer mu.Unlock()
 		t.br.Fd.Get(&o.Pid, pidfile)
 		var fst FwderState
+		o.Denied = 0
 		if o.Pid == -1 {
 			o.State = "inactive"
 		} else if o.Pid != -1 && !process.Exists(o.Pid) {
@@ -126,6 +169,7 @@ func (t *T) registerForwarder(name string) {
 			for i := 0; i < 10; i++ {
 				if err := cl.PerformOnce(http.MethodGet, "http://localhost/state", nil, &fst); err == nil {
 					o.State = fst.State
+					o.Denied = fst.Denied
 					break
 				}
 				time.Sleep(100 * time.Millisecond)
@@ -157,14 +201,22 @@ func (t *T) registerForwarder(name string) {
 		case !st.ChmodX:
 			err = fmt.Errorf("could not execute %s: file is not executable (did you `chmod +x %s`?)", binpath, binpath)
 			return
-		case name == "tun" && !*st.Chown0:
+		case name == "tun" && st.privileged():
+			// either setuid root or cap_net_admin is fine
+		case name == "redirect" && st.setuidRoot():
+			// nftables are managed by running nft, which needs root
+			// (CAP_NET_ADMIN is not inherited by nft)
+		case (name == "tun" || name == "redirect") && !*st.Chown0:
 			err = fmt.Errorf(
-				"could not execute %s: file is not owned by root (did you `chown 0:0 %s && chmod u+s %s`?)",
-				binpath, binpath, binpath,
+				"could not execute %s: file is not owned by root (did you `chown 0:0 %s && chmod u+s %s`%s?)",
+				binpath, binpath, binpath, st.capHint(name, binpath),
 			)
 			return
-		case name == "tun" && !*st.ChmodUS:
-			err = fmt.Errorf("could not execute %s: file is not setuid (did you `chmod u+s %s`?)", binpath, binpath)
+		case (name == "tun" || name == "redirect") && !*st.ChmodUS:
+			err = fmt.Errorf(
+				"could not execute %s: file is not setuid (did you `chmod u+s %s`%s?)",
+				binpath, binpath, st.capHint(name, binpath),
+			)
 			return
 		}
 		env := append(
@@ -172,8 +224,34 @@ func (t *T) registerForwarder(name string) {
 			"WIRELEAP_HOME="+t.br.Fd.Path(),
 			"WIRELEAP_ADDR_H2C="+*t.br.Config().Broker.Address+"/broker",
 			"WIRELEAP_ADDR_TUN="+t.br.Config().Forwarders.Tun.Address,
+			"WIRELEAP_TUN_MTU="+strconv.Itoa(t.br.Config().Forwarders.Tun.MTU),
 			"WIRELEAP_ADDR_SOCKS="+t.br.Config().Forwarders.Socks.Address,
+			"WIRELEAP_ADDR_HTTP="+t.br.Config().Forwarders.Http.Address,
+			"WIRELEAP_ADDR_REDIRECT="+t.br.Config().Forwarders.Redirect.Address,
 		)
+		if t.br.Config().Forwarders.Tun.Gateway {
+			env = append(env, "WIRELEAP_TUN_GATEWAY=1")
+		}
+		if sc := t.br.Config().Forwarders.Socks; sc.Username != "" || sc.Password != "" {
+			env = append(env, "WIRELEAP_SOCKS_USERNAME="+sc.Username, "WIRELEAP_SOCKS_PASSWORD="+sc.Password)
+		}
+		if sc := t.br.Config().Forwarders.Socks; len(sc.Allow) > 0 || len(sc.Deny) > 0 {
+			env = append(
+				env,
+				"WIRELEAP_SOCKS_ALLOW="+strings.Join(sc.Allow, ","),
+				"WIRELEAP_SOCKS_DENY="+strings.Join(sc.Deny, ","),
+			)
+		}
+		if hc := t.br.Config().Forwarders.Http; hc.Username != "" || hc.Password != "" {
+			env = append(env, "WIRELEAP_HTTP_USERNAME="+hc.Username, "WIRELEAP_HTTP_PASSWORD="+hc.Password)
+		}
+		if hc := t.br.Config().Forwarders.Http; len(hc.Allow) > 0 || len(hc.Deny) > 0 {
+			env = append(
+				env,
+				"WIRELEAP_HTTP_ALLOW="+strings.Join(hc.Allow, ","),
+				"WIRELEAP_HTTP_DENY="+strings.Join(hc.Deny, ","),
+			)
+		}
 		if err = t.br.Fd.Get(&o.Pid, pidfile); err == nil && process.Exists(o.Pid) {
 			err = fmt.Errorf("%s daemon is already running!", fullbin)
 			return
@@ -230,7 +308,7 @@ func (t *T) registerForwarder(name string) {
 				o.State = fst.State
 				mu.Unlock()
 				// TODO find a more elegant/general place for this
-				if name == "tun" {
+				if name == "tun" || name == "redirect" {
 					_ = t.br.WriteBypass()
 				}
 				break
@@ -310,4 +388,39 @@ func (t *T) registerForwarder(name string) {
 		}
 		w.Write(b)
 	})}))
+	if name == "tun" {
+		// proxy packet capture control to the running wireleap_tun
+		proxy := func(method string) http.HandlerFunc {
+			return func(w http.ResponseWriter, r *http.Request) {
+				var (
+					in  interface{}
+					out json.RawMessage
+				)
+				if method == http.MethodPost {
+					var req json.RawMessage
+					b, err := ioutil.ReadAll(r.Body)
+					if err != nil || json.Unmarshal(b, &req) != nil {
+						status.ErrRequest.WriteTo(w)
+						return
+					}
+					in = req
+				}
+				if err := cl.PerformOnce(method, "http://localhost/capture", in, &out); err != nil {
+					var st *status.T
+					if errors.As(err, &st) {
+						st.WriteTo(w)
+					} else {
+						status.ErrRequest.Wrap(fmt.Errorf("could not reach %s: %w", fullbin, err)).WriteTo(w)
+					}
+					return
+				}
+				w.Write(out)
+			}
+		}
+		t.mux.Handle("/forwarders/"+name+"/capture", provide.MethodGate(provide.Routes{
+			http.MethodGet:    proxy(http.MethodGet),
+			http.MethodPost:   proxy(http.MethodPost),
+			http.MethodDelete: proxy(http.MethodDelete),
+		}))
+	}
 }
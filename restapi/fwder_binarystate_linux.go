@@ -3,6 +3,8 @@ package restapi
 import (
 	"os"
 	"syscall"
+
+	"github.com/wireleap/client/wireleap_tun/caps"
 )
 
 const fwderSuffix = ""
@@ -14,13 +16,15 @@ func (t *T) getBinaryState(bin string) (st binaryState) {
 	}
 	st.Exists = true
 	st.ChmodX = fi.Mode()&0100 != 0
-	if bin == fwderPrefix+"tun" {
+	if bin == fwderPrefix+"tun" || bin == fwderPrefix+"redirect" {
 		if stat, ok := fi.Sys().(*syscall.Stat_t); ok && stat.Uid == 0 {
 			st.Chown0 = boolptr(true)
 		} else {
 			st.Chown0 = boolptr(false)
 		}
 		st.ChmodUS = boolptr(fi.Mode()&os.ModeSetuid != 0)
+		capable, _ := caps.FileHasNetAdmin(t.br.Fd.Path(bin))
+		st.CapNetAdmin = boolptr(capable)
 	}
 	return
 }
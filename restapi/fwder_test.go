@@ -0,0 +1,25 @@
+// Copyright (c) 2022 Wireleap
+
+package restapi
+
+import "testing"
+
+func TestCapHint(t *testing.T) {
+	yes, no := true, false
+	for _, tc := range []struct {
+		name string
+		caps *bool
+		hint string
+	}{
+		{"tun", &no, " or `setcap cap_net_admin+ep /w/wireleap_tun`"},
+		{"tun", &yes, " or `setcap cap_net_admin+ep /w/wireleap_tun`"},
+		// file capabilities are not supported
+		{"tun", nil, ""},
+		{"redirect", &no, ""},
+	} {
+		st := binaryState{CapNetAdmin: tc.caps}
+		if got := st.capHint(tc.name, "/w/wireleap_tun"); got != tc.hint {
+			t.Errorf("%s (caps %v): got %q, expected %q", tc.name, tc.caps, got, tc.hint)
+		}
+	}
+}
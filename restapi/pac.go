@@ -0,0 +1,124 @@
+// Copyright (c) 2022 Wireleap
+
+package restapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/wireleap/client/broker"
+	"github.com/wireleap/client/clientcfg"
+)
+
+// PACContentType is the MIME type browsers expect proxy auto-config files to
+// be served with.
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+// PACHandler serves a proxy auto-config file generated from the current
+// broker config, so it reflects config reloads without further action.
+func PACHandler(br *broker.T, l *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		b, err := PAC(br.Config(), host, l)
+		if err != nil {
+			l.Printf("error %s while serving proxy.pac", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", PACContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(b)
+	})
+}
+
+// PAC generates a proxy auto-config file for c which routes everything via
+// the SOCKSv5 forwarder except local and bypassed destinations; pac.proxy
+// entries are proxied even if bypassed. If the forwarder listens on an
+// unspecified address, reqhost (the host the file was requested from) is used
+// instead. Invalid pac.proxy and pac.bypass entries are logged to l and
+// skipped, erring on the side of proxying.
+func PAC(c *clientcfg.C, reqhost string, l *log.Logger) ([]byte, error) {
+	host, port, err := net.SplitHostPort(c.Forwarders.Socks.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarders.socks.address %q: %w", c.Forwarders.Socks.Address, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = reqhost
+		if host == "" {
+			host = "127.0.0.1"
+		}
+	}
+	// only SOCKSv5: browsers resolve names locally for SOCKSv4, leaking DNS
+	proxy := pacString("SOCKS5 " + net.JoinHostPort(host, port))
+	b := &strings.Builder{}
+	b.WriteString("// generated by wireleap from the current configuration\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tvar ipv4 = /^[0-9]+\\.[0-9]+\\.[0-9]+\\.[0-9]+$/.test(host);\n")
+	b.WriteString("\tif (isPlainHostName(host) || host == \"localhost\" || host == \"::1\" ||\n")
+	b.WriteString("\t\t(ipv4 && isInNet(host, \"127.0.0.0\", \"255.0.0.0\"))) {\n")
+	b.WriteString("\t\treturn \"DIRECT\";\n\t}\n")
+	pacRules(b, "pac.proxy", c.Pac.Proxy, proxy, l)
+	pacRules(b, "pac.bypass", c.Pac.Bypass, pacString("DIRECT"), l)
+	fmt.Fprintf(b, "\treturn %s;\n}\n", proxy)
+	return []byte(b.String()), nil
+}
+
+// pacRules writes a rule returning ret for each of the entries of the config
+// list key to b.
+func pacRules(b *strings.Builder, key string, entries []string, ret string, l *log.Logger) {
+	for _, e := range entries {
+		if strings.TrimSpace(e) == "" {
+			continue
+		}
+		cond, err := pacCondition(e)
+		if err != nil {
+			l.Printf("skipping %s entry in proxy.pac: %s", key, err)
+			continue
+		}
+		fmt.Fprintf(b, "\tif (%s) {\n\t\treturn %s;\n\t}\n", cond, ret)
+	}
+}
+
+// pacCondition returns the javascript condition matching a pac.proxy or
+// pac.bypass entry.
+// Names are never resolved to avoid leaking DNS queries, so CIDR ranges only
+// match literal IPv4 addresses.
+func pacCondition(e string) (string, error) {
+	e = strings.TrimSpace(e)
+	if strings.Contains(e, "/") {
+		ip, n, err := net.ParseCIDR(e)
+		if err != nil || ip.To4() == nil {
+			return "", fmt.Errorf("invalid entry %q: only IPv4 CIDR ranges are supported", e)
+		}
+		return fmt.Sprintf(
+			"ipv4 && isInNet(host, %s, %s)",
+			pacString(n.IP.String()), pacString(net.IP(n.Mask).String()),
+		), nil
+	}
+	if ip := net.ParseIP(strings.Trim(e, "[]")); ip != nil {
+		return "host == " + pacString(ip.String()), nil
+	}
+	d := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(e, "*"), "."))
+	if d == "" || strings.ContainsAny(d, "*/:") {
+		return "", fmt.Errorf("invalid entry %q", e)
+	}
+	return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", pacString(d), pacString("."+d)), nil
+}
+
+// pacString quotes s as a javascript string literal.
+func pacString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Wireleap
+
+package restapi
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/client/clientcfg"
+)
+
+func TestPACCondition(t *testing.T) {
+	for _, tc := range []struct {
+		entry, cond string
+	}{
+		{"10.0.0.0/8", `ipv4 && isInNet(host, "10.0.0.0", "255.0.0.0")`},
+		{" 192.168.1.77/24 ", `ipv4 && isInNet(host, "192.168.1.0", "255.255.255.0")`},
+		{"10.1.2.3", `host == "10.1.2.3"`},
+		{"[::1]", `host == "::1"`},
+		{"fd00::1", `host == "fd00::1"`},
+		{"Example.COM", `host == "example.com" || dnsDomainIs(host, ".example.com")`},
+		{".example.com", `host == "example.com" || dnsDomainIs(host, ".example.com")`},
+		{"*.example.com", `host == "example.com" || dnsDomainIs(host, ".example.com")`},
+		{`a"b.com`, `host == "a\"b.com" || dnsDomainIs(host, ".a\"b.com")`},
+	} {
+		cond, err := pacCondition(tc.entry)
+		if err != nil {
+			t.Errorf("%q: %s", tc.entry, err)
+			continue
+		}
+		if cond != tc.cond {
+			t.Errorf("%q: got %s, expected %s", tc.entry, cond, tc.cond)
+		}
+	}
+	for _, e := range []string{
+		"fd00::/8",
+		"10.0.0.0/33",
+		"example.com/8",
+		"*",
+		"*.",
+		"a.*.example.com",
+		"example.com:80",
+	} {
+		if cond, err := pacCondition(e); err == nil {
+			t.Errorf("%q: expected error, got %s", e, cond)
+		}
+	}
+}
+
+func TestPAC(t *testing.T) {
+	c := clientcfg.Defaults()
+	c.Forwarders.Socks.Address = "127.0.0.1:13491"
+	c.Pac.Bypass = []string{"example.com", "", "10.0.0.0/8", "fd00::/8"}
+	c.Pac.Proxy = []string{"secure.example.com", "a.*.b"}
+	logbuf := &bytes.Buffer{}
+	b, err := PAC(&c, "192.168.1.2", log.New(logbuf, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	proxy := `return "SOCKS5 127.0.0.1:13491";`
+	for _, want := range []string{
+		"function FindProxyForURL(url, host) {",
+		`dnsDomainIs(host, ".secure.example.com")) {` + "\n\t\t" + proxy,
+		`dnsDomainIs(host, ".example.com")) {` + "\n\t\t" + `return "DIRECT";`,
+		`isInNet(host, "10.0.0.0", "255.0.0.0")) {` + "\n\t\t" + `return "DIRECT";`,
+		"\t" + proxy + "\n}\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("generated file does not contain %q:\n%s", want, s)
+		}
+	}
+	// pac.proxy takes precedence over pac.bypass
+	if strings.Index(s, `".secure.example.com"`) > strings.Index(s, `".example.com"`) {
+		t.Errorf("pac.proxy rules are not checked first:\n%s", s)
+	}
+	// never SOCKSv4, which resolves names locally
+	if strings.Contains(s, `SOCKS `) || strings.Contains(s, "SOCKS4") {
+		t.Errorf("generated file allows SOCKSv4:\n%s", s)
+	}
+	// invalid entries are skipped and logged
+	if strings.Contains(s, "fd00") || strings.Contains(s, "a.*.b") {
+		t.Errorf("generated file contains invalid entries:\n%s", s)
+	}
+	if l := logbuf.String(); !strings.Contains(l, `pac.bypass entry in proxy.pac: invalid entry "fd00::/8"`) ||
+		!strings.Contains(l, `pac.proxy entry in proxy.pac: invalid entry "a.*.b"`) {
+		t.Errorf("invalid entries not logged: %s", l)
+	}
+}
+
+func TestPACUnspecified(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	for _, tc := range []struct {
+		addr, reqhost, proxy string
+	}{
+		{"0.0.0.0:13491", "192.168.1.2", "192.168.1.2:13491"},
+		{"[::]:13491", "fd00::2", "[fd00::2]:13491"},
+		{":13491", "wireleap.lan", "wireleap.lan:13491"},
+		{"0.0.0.0:13491", "", "127.0.0.1:13491"},
+		{"192.168.1.3:13491", "192.168.1.2", "192.168.1.3:13491"},
+	} {
+		c := clientcfg.Defaults()
+		c.Forwarders.Socks.Address = tc.addr
+		b, err := PAC(&c, tc.reqhost, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `return "SOCKS5 ` + tc.proxy + `";`; !strings.Contains(string(b), want) {
+			t.Errorf("%s requested from %q: expected %s in:\n%s", tc.addr, tc.reqhost, want, b)
+		}
+	}
+	c := clientcfg.Defaults()
+	c.Forwarders.Socks.Address = "13491"
+	if _, err := PAC(&c, "", l); err == nil {
+		t.Error("expected error for invalid forwarders.socks.address")
+	}
+}
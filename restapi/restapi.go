@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/wireleap/client/broker"
@@ -70,6 +71,37 @@ func New(br *broker.T, l *log.Logger) (t *T) {
 			}
 		}),
 	}))
+	t.mux.Handle("/contracts", provide.MethodGate(provide.Routes{
+		http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.reply(w, t.br.Contracts())
+		}),
+	}))
+	t.mux.Handle("/contracts/use", provide.MethodGate(provide.Routes{
+		http.MethodPost: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.l.Printf("error when reading contract use request body: %s", err)
+				status.ErrRequest.Wrap(err).WriteTo(w)
+				return
+			}
+			cur := ContractUseRequest{}
+			if err = json.Unmarshal(b, &cur); err != nil || cur.Contract == nil {
+				t.l.Printf("error when unmarshaling contract use request: %s", err)
+				status.ErrRequest.WriteTo(w)
+				return
+			}
+			if err = t.br.UseContract(cur.Contract); err != nil {
+				t.l.Printf("error when switching to contract %s: %s", cur.Contract, err)
+				if errors.Is(err, broker.ErrNoContract) {
+					status.ErrNotFound.Wrap(err).WriteTo(w)
+				} else {
+					status.ErrRequest.Wrap(err).WriteTo(w)
+				}
+				return
+			}
+			t.reply(w, t.br.Contracts())
+		}),
+	}))
 	t.mux.Handle("/relays", provide.MethodGate(provide.Routes{
 		http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			rs, err := t.br.Relays()
@@ -153,7 +185,60 @@ func New(br *broker.T, l *log.Logger) (t *T) {
 				return
 			}
 			go t.br.Reload()
-			t.reply(w, t.accesskeysFromPofs(aks.Pofs...))
+			t.reply(w, t.accesskeysFromPofs(t.br.ContractInfoOf(aks.Contract.Endpoint), aks.Pofs...))
+		}),
+	}))
+	t.mux.Handle("/accesskeys/export", provide.MethodGate(provide.Routes{
+		http.MethodPost: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.l.Printf("error when reading accesskeys export request body: %s", err)
+				status.ErrRequest.Wrap(err).WriteTo(w)
+				return
+			}
+			aer := AccesskeyExportRequest{}
+			if len(b) > 0 {
+				if err = json.Unmarshal(b, &aer); err != nil {
+					t.l.Printf("error when unmarshaling accesskeys export request: %s", err)
+					status.ErrRequest.WriteTo(w)
+					return
+				}
+			}
+			bundle, err := t.br.Export(aer.Passphrase)
+			if err != nil {
+				t.l.Printf("error when exporting accesskeys: %s", err)
+				status.ErrRequest.Wrap(err).WriteTo(w)
+				return
+			}
+			t.reply(w, bundle)
+		}),
+	}))
+	t.mux.Handle("/accesskeys/restore", provide.MethodGate(provide.Routes{
+		http.MethodPost: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.l.Printf("error when reading accesskeys restore request body: %s", err)
+				status.ErrRequest.Wrap(err).WriteTo(w)
+				return
+			}
+			arr := AccesskeyRestoreRequest{}
+			if err = json.Unmarshal(b, &arr); err != nil || arr.Bundle == nil {
+				t.l.Printf("error when unmarshaling accesskeys restore request: %s", err)
+				status.ErrRequest.WriteTo(w)
+				return
+			}
+			ci, ps, sk, err := t.br.Restore(arr.Bundle, arr.Passphrase)
+			if err != nil {
+				t.l.Printf("error when restoring accesskeys: %s", err)
+				status.ErrRequest.Wrap(err).WriteTo(w)
+				return
+			}
+			go t.br.Reload()
+			rs := append(t.accesskeysFromSks(ci, sk), t.accesskeysFromPofs(ci, ps...)...)
+			if rs == nil {
+				rs = make([]*AccesskeyReply, 0)
+			}
+			t.reply(w, rs)
 		}),
 	}))
 	t.mux.Handle("/accesskeys/activate", provide.MethodGate(provide.Routes{
@@ -163,7 +248,49 @@ func New(br *broker.T, l *log.Logger) (t *T) {
 				status.ErrRequest.Wrap(err).WriteTo(w)
 				return
 			}
-			t.reply(w, t.accesskeysFromSks(t.br.CurrentSK()))
+			t.reply(w, t.accesskeysFromSks(t.br.ContractInfo(), t.br.CurrentSK()))
+		}),
+	}))
+	t.mux.Handle("/accesskeys/history", provide.MethodGate(provide.Routes{
+		http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.reply(w, t.br.History())
+		}),
+	}))
+	t.mux.Handle("/accesskeys/", provide.MethodGate(provide.Routes{
+		http.MethodDelete: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			digest := strings.TrimPrefix(r.URL.Path, "/accesskeys/")
+			if digest == "" || strings.Contains(digest, "/") {
+				status.ErrNotFound.WriteTo(w)
+				return
+			}
+			p, ci, err := t.br.Remove(digest)
+			if err != nil {
+				t.l.Printf("error when removing accesskey %s: %s", digest, err)
+				if errors.Is(err, broker.ErrNoPof) {
+					status.ErrNotFound.Wrap(err).WriteTo(w)
+				} else {
+					status.ErrInternal.Wrap(err).WriteTo(w)
+				}
+				return
+			}
+			t.reply(w, t.accesskeysFromPofs(ci, p))
+		}),
+	}))
+	t.mux.Handle("/usage", provide.MethodGate(provide.Routes{
+		http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			from, to := q.Get("from"), q.Get("to")
+			for _, d := range []string{from, to} {
+				if d == "" {
+					continue
+				}
+				if _, err := time.Parse(broker.UsageDay, d); err != nil {
+					t.l.Printf("invalid usage day %q: %s", d, err)
+					status.ErrRequest.Wrap(err).WriteTo(w)
+					return
+				}
+			}
+			t.reply(w, t.br.Usage(from, to))
 		}),
 	}))
 	t.mux.Handle("/status", provide.MethodGate(provide.Routes{
@@ -173,10 +300,15 @@ func New(br *broker.T, l *log.Logger) (t *T) {
 				circList = append(circList, r.Addr.String())
 			}
 			t.reply(w, StatusReply{
-				Home:    t.br.Fd.Path(),
-				Pid:     os.Getpid(),
-				State:   "active",
-				Broker:  StatusBroker{ActiveCircuit: circList},
+				Home:  t.br.Fd.Path(),
+				Pid:   os.Getpid(),
+				State: "active",
+				Broker: StatusBroker{
+					ActiveCircuit:   circList,
+					IsolationGroups: t.br.IsolationGroups(),
+					Accesskeys:      t.br.Forecast(),
+					ClockSkew:       t.br.ClockSkew(),
+				},
 				Upgrade: &StatusUpgrade{Required: t.br.IsUpgradeable()},
 			})
 		}),
@@ -189,10 +321,15 @@ func New(br *broker.T, l *log.Logger) (t *T) {
 				circList = append(circList, r.Addr.String())
 			}
 			t.reply(w, StatusReply{
-				Home:    t.br.Fd.Path(),
-				Pid:     os.Getpid(),
-				State:   "active",
-				Broker:  StatusBroker{ActiveCircuit: circList},
+				Home:  t.br.Fd.Path(),
+				Pid:   os.Getpid(),
+				State: "active",
+				Broker: StatusBroker{
+					ActiveCircuit:   circList,
+					IsolationGroups: t.br.IsolationGroups(),
+					Accesskeys:      t.br.Forecast(),
+					ClockSkew:       t.br.ClockSkew(),
+				},
 				Upgrade: &StatusUpgrade{Required: t.br.IsUpgradeable()},
 			})
 		}),
@@ -214,6 +351,8 @@ func New(br *broker.T, l *log.Logger) (t *T) {
 	}))
 	t.registerForwarder("socks")
 	t.registerForwarder("tun")
+	t.registerForwarder("http")
+	t.registerForwarder("redirect")
 	t.Handler = http.TimeoutHandler(t.mux, 10*time.Second, "API call timed out!")
 	return
 }
@@ -1,5 +1,7 @@
 package restapi
 
+import "github.com/wireleap/client/broker"
+
 type StatusReply struct {
 	Home    string         `json:"home"`
 	Pid     int            `json:"pid"`
@@ -9,7 +11,10 @@ type StatusReply struct {
 }
 
 type StatusBroker struct {
-	ActiveCircuit []string `json:"active_circuit"`
+	ActiveCircuit   []string                `json:"active_circuit"`
+	IsolationGroups []broker.IsolationGroup `json:"isolation_groups"`
+	Accesskeys      *broker.Forecast        `json:"accesskeys,omitempty"`
+	ClockSkew       *broker.ClockSkew       `json:"clock_skew,omitempty"`
 }
 
 type StatusUpgrade struct {
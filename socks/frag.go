@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Wireleap
+
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReassemblyTimeout is how long fragments of a UDP datagram are kept around
+// waiting for the rest of it. RFC1928 requires at least 5 seconds.
+const ReassemblyTimeout = 5 * time.Second
+
+// MaxReassembledSize is the largest size of a reassembled UDP datagram.
+// Sequences exceeding it are abandoned.
+const MaxReassembledSize = 65535
+
+// FRAG field values
+const (
+	fragStandalone = 0x00
+	fragEnd        = 0x80
+	fragPosition   = 0x7f
+)
+
+// ErrReassembly is returned by Reassembler.Add if a fragment sequence had to
+// be abandoned.
+var ErrReassembly = errors.New("UDP fragment reassembly failed")
+
+// Reassembler is the reassembly queue of fragmented UDP datagrams as
+// described in RFC1928 section 7. A separate one is needed per UDP
+// association.
+type Reassembler struct {
+	mu sync.Mutex
+	// destination address of the sequence
+	dst Addr
+	// reassembled data so far
+	buf []byte
+	// highest FRAG position received so far, 0 if the queue is empty
+	last byte
+	// reassembly timer
+	timer *time.Timer
+}
+
+// Add processes a UDP request header-encapsulated datagram p. For standalone
+// datagrams and fragments completing a sequence, the destination address and
+// complete data are returned. For other fragments, nil data and no error is
+// returned. The returned data of standalone datagrams is a subslice of p.
+func (r *Reassembler) Add(p []byte) (dstaddr Addr, data []byte, err error) {
+	frag, dstaddr, data, err := dissectUDP(p)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if frag == fragStandalone {
+		// a lower FRAG value than that of any fragment, so an incomplete
+		// sequence is abandoned
+		r.reset()
+		return
+	}
+	pos := frag & fragPosition
+	switch {
+	case pos == 0:
+		return nil, nil, fmt.Errorf("%w: invalid FRAG 0x%x", ErrMalformed, frag)
+	case pos < r.last:
+		// a new sequence started, reinitialize the queue
+		r.reset()
+	case pos == r.last:
+		return nil, nil, fmt.Errorf("%w: duplicate fragment %d", ErrReassembly, pos)
+	}
+	switch {
+	case pos != r.last+1:
+		r.reset()
+		return nil, nil, fmt.Errorf("%w: fragment %d received without preceding fragments", ErrReassembly, pos)
+	case r.last > 0 && !bytes.Equal(dstaddr, r.dst):
+		r.reset()
+		return nil, nil, fmt.Errorf("%w: destination address of fragment %d differs", ErrReassembly, pos)
+	case len(r.buf)+len(data) > MaxReassembledSize:
+		r.reset()
+		return nil, nil, fmt.Errorf("%w: reassembled datagram exceeds %d bytes", ErrReassembly, MaxReassembledSize)
+	}
+	if r.last == 0 {
+		r.dst = dstaddr
+		var t *time.Timer
+		t = time.AfterFunc(ReassemblyTimeout, func() { r.expire(t) })
+		r.timer = t
+	}
+	r.buf = append(r.buf, data...)
+	r.last = pos
+	if frag&fragEnd == 0 {
+		return nil, nil, nil
+	}
+	dstaddr, data = r.dst, r.buf
+	r.reset()
+	return
+}
+
+// expire abandons the queue once its reassembly timer t has run out.
+func (r *Reassembler) expire(t *time.Timer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the queue may have been reinitialized in the meantime
+	if r.timer == t {
+		r.reset()
+	}
+}
+
+// reset reinitializes the queue. It expects r.mu to be held.
+func (r *Reassembler) reset() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	r.dst, r.buf, r.last = nil, nil, 0
+}
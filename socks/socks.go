@@ -1,12 +1,18 @@
 // Copyright (c) 2022 Wireleap
 
 // Package socks provides a barebones SOCKSv5 server handshake protocol
-// implementation according to RFC1928.
+// implementation according to RFC1928 with optional username/password
+// authentication according to RFC1929. SOCKSv4 and SOCKSv4a CONNECT requests
+// are handled as well.
 // https://datatracker.ietf.org/doc/html/rfc1928
+// https://datatracker.ietf.org/doc/html/rfc1929
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
 package socks
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +21,7 @@ import (
 )
 
 const (
+	SOCKSv4 = 0x04
 	SOCKSv5 = 0x05
 
 	CONNECT   = 0x01
@@ -26,11 +33,47 @@ const (
 	ADDR_IPV6 = 0x04
 
 	RSV = 0x00
+
+	AUTH_NONE          = 0x00
+	AUTH_USERPASS      = 0x02
+	AUTH_NO_ACCEPTABLE = 0xff
+
+	USERPASS_VERSION = 0x01
+	USERPASS_OK      = 0x00
+	USERPASS_FAILURE = 0x01
+
+	REPLYv4_VERSION  = 0x00
+	REPLYv4_GRANTED  = 0x5a
+	REPLYv4_REJECTED = 0x5b
 )
 
+// Authenticator checks username/password credentials supplied by a client.
+type Authenticator func(username, password string) bool
+
+// StaticAuth returns an Authenticator which only accepts the given
+// credentials.
+func StaticAuth(username, password string) Authenticator {
+	return func(u, p string) bool {
+		// evaluate both to avoid leaking which one was wrong via timing
+		uok := subtle.ConstantTimeCompare([]byte(u), []byte(username))
+		pok := subtle.ConstantTimeCompare([]byte(p), []byte(password))
+		return uok&pok == 1
+	}
+}
+
+// ErrAuth is returned by Handshake if the client failed to authenticate.
+var ErrAuth = errors.New("SOCKS client authentication failed")
+
+// ErrNotReply is returned by ReadReply if what was read is not a SOCKSv5
+// reply.
+var ErrNotReply = errors.New("not a SOCKSv5 reply")
+
 type SocksStatus byte
 
 func (e SocksStatus) Error() string {
+	if e > StatusAddressNotSupported {
+		return fmt.Sprintf("unknown status 0x%x", byte(e))
+	}
 	return [...]string{
 		"OK",
 		"general failure",
@@ -60,6 +103,25 @@ func WriteStatus(c net.Conn, status SocksStatus, addr Addr) (int, error) {
 	return c.Write(append([]byte{SOCKSv5, byte(status), RSV}, addr...))
 }
 
+// WriteReply is like WriteStatus but writes the reply in the format of the
+// given SOCKS version as returned by Handshake. SOCKSv4 replies only carry
+// whether the request was granted and IPv4 addresses.
+func WriteReply(c net.Conn, version byte, status SocksStatus, addr Addr) (int, error) {
+	if version != SOCKSv4 {
+		return WriteStatus(c, status, addr)
+	}
+	// VN, CD, DSTPORT, DSTIP
+	r := []byte{REPLYv4_VERSION, REPLYv4_GRANTED, 0, 0, 0, 0, 0, 0}
+	if status != StatusOK {
+		r[1] = REPLYv4_REJECTED
+	}
+	if ip, port := addr.IPPort(); ip.To4() != nil {
+		r[2], r[3] = byte(port>>8), byte(port)
+		copy(r[4:], ip.To4())
+	}
+	return c.Write(r)
+}
+
 type Addr []byte
 
 func AddrIPPort(ip net.IP, port int) (r Addr) {
@@ -119,13 +181,14 @@ func (t Addr) String() string {
 		// ip:port
 		return net.JoinHostPort(ip.String(), strconv.Itoa(port))
 	}
-	if len(t) < 2 || len(t) < int(2+t[1]+2) {
+	if len(t) < 2 || len(t) < 2+int(t[1])+2 {
 		// ???
 		return ""
 	}
 	// fqdn:port
-	port := int(t[1]+2)<<8 | int(t[1]+2+1)
-	return net.JoinHostPort(string(t[2:t[1]+2]), strconv.Itoa(port))
+	size := int(t[1])
+	port := int(t[2+size])<<8 | int(t[2+size+1])
+	return net.JoinHostPort(string(t[2:2+size]), strconv.Itoa(port))
 }
 
 func (t Addr) IPPort() (ip net.IP, port int) {
@@ -144,6 +207,51 @@ func (t Addr) IPPort() (ip net.IP, port int) {
 	return
 }
 
+// ReadAddr reads an address (ATYP, ADDR, PORT) as encoded in SOCKSv5 replies
+// from r.
+func ReadAddr(r io.Reader) (addr Addr, err error) {
+	b := make([]byte, 2)
+	// ATYP and first byte of ADDR (SIZE for fqdn)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	var rest int
+	switch b[0] {
+	case ADDR_IPV4:
+		rest = net.IPv4len - 1 + 2
+	case ADDR_IPV6:
+		rest = net.IPv6len - 1 + 2
+	case ADDR_FQDN:
+		rest = int(b[1]) + 2
+	default:
+		err = fmt.Errorf("unknown SOCKS address type: 0x%x", b[0])
+		return
+	}
+	addr = make([]byte, 2+rest)
+	copy(addr, b)
+	_, err = io.ReadFull(r, addr[2:])
+	return
+}
+
+// ReadReply reads a reply as written by WriteStatus from r. This is needed
+// by clients, e.g. to read both replies to a BIND request: the first one
+// carries the address listened on, the second one the address of the peer
+// which connected.
+func ReadReply(r io.Reader) (status SocksStatus, addr Addr, err error) {
+	b := make([]byte, 3)
+	// VER, REP, RSV
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	if b[0] != SOCKSv5 || b[2] != RSV {
+		err = fmt.Errorf("%w: unknown version 0x%x or reserved byte 0x%x", ErrNotReply, b[0], b[2])
+		return
+	}
+	status = SocksStatus(b[1])
+	addr, err = ReadAddr(r)
+	return
+}
+
 func ComposeUDP(dstaddr Addr, p []byte) (r []byte, err error) {
 	// RSV, RSV, FRAG
 	r = []byte{0, 0, 0}
@@ -154,34 +262,65 @@ func ComposeUDP(dstaddr Addr, p []byte) (r []byte, err error) {
 	return
 }
 
-var ErrFragment = errors.New("received UDP message is fragmented, fragmentation is not supported")
+var (
+	ErrFragment  = errors.New("received UDP message is a fragment")
+	ErrMalformed = errors.New("received UDP message is malformed")
+)
 
+// DissectUDP splits a UDP request header-encapsulated datagram into its
+// destination address and data. Fragments are rejected with ErrFragment, use
+// a Reassembler to handle them.
 func DissectUDP(p []byte) (dstaddr Addr, data []byte, err error) {
-	// RSV, RSV ignored
-	// FRAG -- do not process fragmentation
-	if p[2] != 0 {
-		err = ErrFragment
+	frag, dstaddr, data, err := dissectUDP(p)
+	if err == nil && frag != 0 {
+		return nil, nil, ErrFragment
+	}
+	return
+}
+
+// dissectUDP is like DissectUDP but also returns the FRAG field.
+func dissectUDP(p []byte) (frag byte, dstaddr Addr, data []byte, err error) {
+	// RSV, RSV, FRAG, ATYP
+	if len(p) < 5 {
+		err = ErrMalformed
 		return
 	}
+	// RSV, RSV ignored
+	frag = p[2]
 	// ATYP, ADDR, DATA
+	var alen int
 	switch p[3] {
 	case ADDR_IPV4, ADDR_IPV6:
-		mult := p[3]
 		// ATYP + (1 or 4) * 4 + PORT
-		dstaddr = make([]byte, 1+mult*4+2)
-		copy(dstaddr, p[3:])
-		data = p[3+len(dstaddr):]
+		alen = 1 + int(p[3])*4 + 2
 	case ADDR_FQDN:
-		// SIZE
-		size := p[4]
-		dstaddr = make([]byte, 2+size+2)
-		copy(dstaddr, p[3:])
-		data = p[2+len(dstaddr):]
+		// ATYP + SIZE + FQDN + PORT
+		alen = 2 + int(p[4]) + 2
+	default:
+		err = fmt.Errorf("%w: unknown address type 0x%x", ErrMalformed, p[3])
+		return
 	}
+	if len(p) < 3+alen {
+		err = ErrMalformed
+		return
+	}
+	dstaddr = make([]byte, alen)
+	copy(dstaddr, p[3:])
+	data = p[3+alen:]
 	return
 }
 
-func Handshake(c net.Conn) (cmd byte, address string, err error) {
+// Handshake performs the server side of a SOCKSv5 handshake on c and returns
+// the requested command and address. If auth is not nil, clients are required
+// to authenticate with credentials accepted by it. Otherwise, clients
+// offering username/password authentication are accepted with any
+// credentials. In both cases, the username used is returned.
+//
+// If the client speaks SOCKSv4 or SOCKSv4a instead, version is SOCKSv4 and
+// replies need to be written with WriteReply. Only CONNECT is supported and
+// the user ID is returned as username. As SOCKSv4 has no means of
+// authentication, such clients are rejected if auth is not nil.
+func Handshake(c net.Conn, auth Authenticator) (version, cmd byte, address string, username string, err error) {
 	b := make([]byte, 1)
 	// read auth methods
 	// SOCKS version
@@ -189,7 +328,14 @@ func Handshake(c net.Conn) (cmd byte, address string, err error) {
 	if err != nil {
 		return
 	}
-	if b[0] != SOCKSv5 {
+	switch b[0] {
+	case SOCKSv5:
+		version = SOCKSv5
+	case SOCKSv4:
+		version = SOCKSv4
+		cmd, address, username, err = handshake4(c, auth)
+		return
+	default:
 		WriteStatus(c, StatusGeneralFailure, AddrAddr(c.LocalAddr()))
 		err = fmt.Errorf("unknown SOCKS auth version: 0x%x", b)
 		return
@@ -200,15 +346,36 @@ func Handshake(c net.Conn) (cmd byte, address string, err error) {
 		return
 	}
 	methods := make([]byte, b[0])
-	// auth methods -- don't care which ones as no auth is required
 	_, err = io.ReadFull(c, methods)
 	if err != nil {
 		return
 	}
-	// tell the client no auth is needed
-	_, err = c.Write([]byte{0x05, 0x00})
-	if err != nil {
-		return
+	userpass := bytes.Contains(methods, []byte{AUTH_USERPASS})
+	switch {
+	case auth == nil && !userpass:
+		// tell the client no auth is needed
+		_, err = c.Write([]byte{SOCKSv5, AUTH_NONE})
+		if err != nil {
+			return
+		}
+	case auth == nil:
+		// credentials are accepted but not checked so that the username
+		// can be used to tell clients apart
+		auth = func(string, string) bool { return true }
+		fallthrough
+	default:
+		if !userpass {
+			c.Write([]byte{SOCKSv5, AUTH_NO_ACCEPTABLE})
+			err = fmt.Errorf("%w: client does not support username/password authentication", ErrAuth)
+			return
+		}
+		_, err = c.Write([]byte{SOCKSv5, AUTH_USERPASS})
+		if err != nil {
+			return
+		}
+		if username, err = userPass(c, auth); err != nil {
+			return
+		}
 	}
 	// read request
 	// SOCKS version
@@ -227,7 +394,7 @@ func Handshake(c net.Conn) (cmd byte, address string, err error) {
 		return
 	}
 	switch b[0] {
-	case CONNECT, UDP_ASSOC:
+	case CONNECT, BIND, UDP_ASSOC:
 		cmd = b[0]
 	default:
 		WriteStatus(c, StatusCommandNotSupported, AddrAddr(c.LocalAddr()))
@@ -293,3 +460,98 @@ func Handshake(c net.Conn) (cmd byte, address string, err error) {
 	}
 	return
 }
+
+// handshake4 performs the rest of a SOCKSv4 or SOCKSv4a handshake after the
+// version byte was read.
+func handshake4(c net.Conn, auth Authenticator) (cmd byte, address string, username string, err error) {
+	if auth != nil {
+		WriteReply(c, SOCKSv4, StatusNotAllowed, nil)
+		err = fmt.Errorf("%w: SOCKSv4 does not support authentication", ErrAuth)
+		return
+	}
+	// CD, DSTPORT, DSTIP
+	b := make([]byte, 7)
+	if _, err = io.ReadFull(c, b); err != nil {
+		return
+	}
+	if b[0] != CONNECT {
+		WriteReply(c, SOCKSv4, StatusCommandNotSupported, nil)
+		err = fmt.Errorf("unsupported SOCKSv4 command %d", b[0])
+		return
+	}
+	cmd = b[0]
+	port := int(b[1])<<8 | int(b[2])
+	ip := net.IP(b[3:7])
+	// USERID
+	if username, err = readNul(c); err != nil {
+		return
+	}
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKSv4a: hostname follows, to be resolved remotely
+		if host, err = readNul(c); err != nil {
+			return
+		}
+	}
+	address = net.JoinHostPort(host, strconv.Itoa(port))
+	return
+}
+
+// readNul reads a NUL-terminated string of at most 255 bytes.
+func readNul(c net.Conn) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			WriteReply(c, SOCKSv4, StatusGeneralFailure, nil)
+			return "", fmt.Errorf("SOCKSv4 string field is too long")
+		}
+		s = append(s, b[0])
+	}
+}
+
+// userPass performs RFC1929 username/password authentication.
+func userPass(c net.Conn, auth Authenticator) (username string, err error) {
+	b := make([]byte, 1)
+	// subnegotiation version
+	_, err = io.ReadFull(c, b)
+	if err != nil {
+		return
+	}
+	if b[0] != USERPASS_VERSION {
+		c.Write([]byte{USERPASS_VERSION, USERPASS_FAILURE})
+		err = fmt.Errorf("unknown SOCKS username/password auth version: 0x%x", b)
+		return
+	}
+	readString := func() (string, error) {
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		s := make([]byte, b[0])
+		if _, err := io.ReadFull(c, s); err != nil {
+			return "", err
+		}
+		return string(s), nil
+	}
+	user, err := readString()
+	if err != nil {
+		return
+	}
+	pass, err := readString()
+	if err != nil {
+		return
+	}
+	if !auth(user, pass) {
+		c.Write([]byte{USERPASS_VERSION, USERPASS_FAILURE})
+		err = fmt.Errorf("%w: invalid credentials for user %q", ErrAuth, user)
+		return
+	}
+	_, err = c.Write([]byte{USERPASS_VERSION, USERPASS_OK})
+	return user, err
+}
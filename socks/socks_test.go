@@ -0,0 +1,254 @@
+// Copyright (c) 2022 Wireleap
+
+package socks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+type handshakeResult struct {
+	version  byte
+	cmd      byte
+	addr     string
+	username string
+	err      error
+}
+
+// handshake runs Handshake against a client sending req and returns the
+// server's reply bytes along with the handshake results.
+func handshake(auth Authenticator, req []byte, replylen int) ([]byte, handshakeResult) {
+	c, s := net.Pipe()
+	defer c.Close()
+	res := make(chan handshakeResult, 1)
+	go func() {
+		defer s.Close()
+		var r handshakeResult
+		r.version, r.cmd, r.addr, r.username, r.err = Handshake(s, auth)
+		res <- r
+	}()
+	go c.Write(req)
+	reply := make([]byte, replylen)
+	n, _ := io.ReadFull(c, reply)
+	return reply[:n], <-res
+}
+
+var connectReq = []byte{SOCKSv5, CONNECT, RSV, ADDR_IPV4, 127, 0, 0, 1, 0, 80}
+
+func userPassReq(user, pass string) (b []byte) {
+	b = append(b, USERPASS_VERSION, byte(len(user)))
+	b = append(b, user...)
+	b = append(b, byte(len(pass)))
+	return append(b, pass...)
+}
+
+func TestHandshakeNoAuth(t *testing.T) {
+	req := append([]byte{SOCKSv5, 1, AUTH_NONE}, connectReq...)
+	reply, r := handshake(nil, req, 2)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !bytes.Equal(reply, []byte{SOCKSv5, AUTH_NONE}) {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	if r.cmd != CONNECT || r.addr != "127.0.0.1:80" {
+		t.Errorf("unexpected request %d %s", r.cmd, r.addr)
+	}
+}
+
+func TestHandshakeUserPass(t *testing.T) {
+	auth := StaticAuth("user", "pass")
+	req := append([]byte{SOCKSv5, 2, AUTH_NONE, AUTH_USERPASS}, userPassReq("user", "pass")...)
+	reply, r := handshake(auth, append(req, connectReq...), 4)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if !bytes.Equal(reply, []byte{SOCKSv5, AUTH_USERPASS, USERPASS_VERSION, USERPASS_OK}) {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	if r.username != "user" || r.addr != "127.0.0.1:80" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	// wrong password
+	req = append([]byte{SOCKSv5, 1, AUTH_USERPASS}, userPassReq("user", "wrong")...)
+	reply, r = handshake(auth, req, 4)
+	if !errors.Is(r.err, ErrAuth) {
+		t.Errorf("expected ErrAuth, got %v", r.err)
+	}
+	if !bytes.Equal(reply, []byte{SOCKSv5, AUTH_USERPASS, USERPASS_VERSION, USERPASS_FAILURE}) {
+		t.Errorf("unexpected reply %v", reply)
+	}
+	// no auth offered
+	reply, r = handshake(auth, []byte{SOCKSv5, 1, AUTH_NONE}, 2)
+	if !errors.Is(r.err, ErrAuth) {
+		t.Errorf("expected ErrAuth, got %v", r.err)
+	}
+	if !bytes.Equal(reply, []byte{SOCKSv5, AUTH_NO_ACCEPTABLE}) {
+		t.Errorf("unexpected reply %v", reply)
+	}
+}
+
+func TestDissectUDP(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:53", "[::1]:53", "example.com:5353"} {
+		dst, err := AddrString(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := ComposeUDP(dst, []byte("data"))
+		dst2, data, err := DissectUDP(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dst2.String() != addr || string(data) != "data" {
+			t.Errorf("expected %s %q, got %s %q", addr, "data", dst2, data)
+		}
+		if _, _, err = DissectUDP(p[:len(dst)+2]); !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed for truncated %s, got %v", addr, err)
+		}
+	}
+}
+
+func TestHandshakeBind(t *testing.T) {
+	req := []byte{SOCKSv5, 1, AUTH_NONE, SOCKSv5, BIND, RSV, ADDR_IPV4, 192, 0, 2, 1, 0, 21}
+	_, r := handshake(nil, req, 2)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.cmd != BIND || r.addr != "192.0.2.1:21" {
+		t.Errorf("unexpected request %d %s", r.cmd, r.addr)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		defer s.Close()
+		// both replies to a BIND request
+		WriteStatus(s, StatusOK, AddrIPPort(net.ParseIP("192.0.2.1"), 1234))
+		a, _ := AddrString("example.com:21")
+		WriteStatus(s, StatusOK, a)
+	}()
+	for _, want := range []string{"192.0.2.1:1234", "example.com:21"} {
+		st, addr, err := ReadReply(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st != StatusOK || addr.String() != want {
+			t.Errorf("expected %s, got %s %s", want, st, addr)
+		}
+	}
+}
+
+func TestReadReplyNotReply(t *testing.T) {
+	for _, b := range []string{"220 FTP server ready\r\n", "\x05\x00\x01\x01\x00\x00\x00\x00\x00\x00"} {
+		if _, _, err := ReadReply(strings.NewReader(b)); !errors.Is(err, ErrNotReply) {
+			t.Errorf("%q: expected ErrNotReply, got %v", b, err)
+		}
+	}
+}
+
+func TestHandshakeV4(t *testing.T) {
+	// SOCKSv4
+	req := []byte{SOCKSv4, CONNECT, 0, 80, 127, 0, 0, 1, 'u', 0}
+	_, r := handshake(nil, req, 0)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.version != SOCKSv4 || r.cmd != CONNECT || r.addr != "127.0.0.1:80" || r.username != "u" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	// SOCKSv4a
+	req = append([]byte{SOCKSv4, CONNECT, 0, 80, 0, 0, 0, 1, 0}, "example.com\x00"...)
+	_, r = handshake(nil, req, 0)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.addr != "example.com:80" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	// not allowed with authentication
+	reply, r := handshake(StaticAuth("user", "pass"), req, 8)
+	if !errors.Is(r.err, ErrAuth) {
+		t.Errorf("expected ErrAuth, got %v", r.err)
+	}
+	if !bytes.Equal(reply, []byte{REPLYv4_VERSION, REPLYv4_REJECTED, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("unexpected reply %v", reply)
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	dst, _ := AddrString("127.0.0.1:53")
+	frag := func(n byte, data string) []byte {
+		p, _ := ComposeUDP(dst, []byte(data))
+		p[2] = n
+		return p
+	}
+	var r Reassembler
+	for _, p := range [][]byte{frag(1, "a"), frag(2, "b"), frag(3|0x80, "c")} {
+		a, data, err := r.Add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p[2]&0x80 == 0 {
+			if data != nil {
+				t.Fatalf("unexpected data %q", data)
+			}
+			continue
+		}
+		if a.String() != "127.0.0.1:53" || string(data) != "abc" {
+			t.Errorf("unexpected result %s %q", a, data)
+		}
+	}
+	// lower FRAG reinitializes the queue
+	r.Add(frag(1, "x"))
+	r.Add(frag(2, "y"))
+	r.Add(frag(1, "a"))
+	if _, data, err := r.Add(frag(2|0x80, "b")); err != nil || string(data) != "ab" {
+		t.Errorf("unexpected result %q %v", data, err)
+	}
+	// gaps abandon the sequence
+	r.Add(frag(1, "a"))
+	if _, _, err := r.Add(frag(3|0x80, "c")); !errors.Is(err, ErrReassembly) {
+		t.Errorf("expected ErrReassembly, got %v", err)
+	}
+	// standalone datagrams pass through
+	if _, data, err := r.Add(frag(0, "s")); err != nil || string(data) != "s" {
+		t.Errorf("unexpected result %q %v", data, err)
+	}
+}
+
+func TestReassemblerStandalone(t *testing.T) {
+	dst, _ := AddrString("127.0.0.1:53")
+	frag := func(n byte, data string) []byte {
+		p, _ := ComposeUDP(dst, []byte(data))
+		p[2] = n
+		return p
+	}
+	var r Reassembler
+	r.Add(frag(1, "a"))
+	r.Add(frag(2, "b"))
+	// a standalone datagram in the middle of a sequence is passed through
+	// and reinitializes the queue
+	if _, data, err := r.Add(frag(0, "s")); err != nil || string(data) != "s" {
+		t.Fatalf("unexpected result %q %v", data, err)
+	}
+	r.mu.Lock()
+	if r.last != 0 || r.buf != nil || r.timer != nil {
+		t.Errorf("queue not reinitialized: last %d buf %q timer %v", r.last, r.buf, r.timer)
+	}
+	r.mu.Unlock()
+	// so the rest of the old sequence is not completed
+	if _, data, err := r.Add(frag(3|0x80, "c")); !errors.Is(err, ErrReassembly) {
+		t.Errorf("expected ErrReassembly, got %q %v", data, err)
+	}
+	// and a new one starts from scratch
+	r.Add(frag(1, "x"))
+	if _, data, err := r.Add(frag(2|0x80, "y")); err != nil || string(data) != "xy" {
+		t.Errorf("unexpected result %q %v", data, err)
+	}
+}
@@ -3,16 +3,27 @@
 package accesskeyscmd
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 
+	"github.com/wireleap/client/broker"
 	"github.com/wireleap/client/clientcfg"
 	"github.com/wireleap/client/clientlib"
 	"github.com/wireleap/client/filenames"
 	"github.com/wireleap/client/restapi"
+	"github.com/wireleap/common/api/accesskey"
+	"github.com/wireleap/common/api/status"
 	"github.com/wireleap/common/api/texturl"
 	"github.com/wireleap/common/cli"
 	"github.com/wireleap/common/cli/fsdir"
@@ -23,19 +34,41 @@ func Cmd() *cli.Subcmd {
 	r := &cli.Subcmd{
 		FlagSet: fs,
 		Desc:    "Manage accesskeys",
-		Sections: []cli.Section{{
-			Title: "Commands",
-			Entries: []cli.Entry{
-				{Key: "list", Value: "List accesskeys"},
-				{Key: "import", Value: "Import accesskeys from URL and set up associated contract"},
-				{Key: "activate", Value: "Trigger accesskey activation (accesskey.use_on_demand=false)"},
+		Sections: []cli.Section{
+			{
+				Title: "Commands",
+				Entries: []cli.Entry{
+					{Key: "list", Value: "List accesskeys"},
+					{Key: "import", Value: "Import accesskeys from URL, token or - (stdin) and set up associated contract"},
+					{Key: "token", Value: "Print compact token of accesskeys FILE (- for stdin)"},
+					{Key: "activate", Value: "Trigger accesskey activation (accesskey.use_on_demand=false)"},
+					{Key: "remove", Value: "Remove inactive accesskey with DIGEST"},
+					{Key: "history", Value: "List accesskey activations"},
+					{Key: "export", Value: "Back up accesskeys, servicekey and contract to FILE (- for stdout)"},
+					{Key: "restore", Value: "Restore accesskeys, servicekey and contract from FILE (- for stdin)"},
+				},
 			},
-		}},
+			{
+				Title: "Environment",
+				Entries: []cli.Entry{{
+					Key:   "WIRELEAP_PASSPHRASE",
+					Value: "Encrypt exported or decrypt restored FILE with this passphrase",
+				}},
+			},
+		},
 	}
 	r.Run = func(fm fsdir.T) {
-		if (fs.Arg(0) == "import" && fs.NArg() != 2) || (fs.Arg(0) != "import" && fs.NArg() != 1) {
-			r.Usage()
-			os.Exit(1)
+		switch fs.Arg(0) {
+		case "import", "token", "remove", "export", "restore":
+			if fs.NArg() != 2 {
+				r.Usage()
+				os.Exit(1)
+			}
+		default:
+			if fs.NArg() != 1 {
+				r.Usage()
+				os.Exit(1)
+			}
 		}
 		c := clientcfg.Defaults()
 		err := fm.Get(&c, filenames.Config)
@@ -56,15 +89,35 @@ func Cmd() *cli.Subcmd {
 		case "import":
 			u += "/import"
 			meth = http.MethodPost
-			from, err := url.Parse(fs.Arg(1))
-			if err != nil {
-				log.Fatal(err)
-			}
-			param = restapi.AccesskeyImportRequest{URL: &texturl.URL{*from}}
+			param = restapi.AccesskeyImportRequest{URL: &texturl.URL{*importURL(fs.Arg(1))}}
 		case "activate":
 			u += "/activate"
 			meth = http.MethodPost
 			out = ak
+		case "remove":
+			u += "/" + url.PathEscape(fs.Arg(1))
+			meth = http.MethodDelete
+		case "history":
+			u += "/history"
+			out = []broker.Activation{}
+		case "token":
+			token(fs.Arg(1))
+			return
+		case "export":
+			export(u+"/export", fs.Arg(1))
+			return
+		case "restore":
+			b, err := readFile(fs.Arg(1))
+			if err != nil {
+				log.Fatalf("could not read accesskey bundle: %s", err)
+			}
+			req := restapi.AccesskeyRestoreRequest{Passphrase: os.Getenv("WIRELEAP_PASSPHRASE")}
+			if err = json.Unmarshal(b, &req.Bundle); err != nil {
+				log.Fatalf("could not unmarshal accesskey bundle: %s", err)
+			}
+			u += "/restore"
+			meth = http.MethodPost
+			param = req
 		default:
 			log.Fatalf("unknown command %s", fs.Arg(0))
 		}
@@ -73,3 +126,114 @@ func Cmd() *cli.Subcmd {
 	r.SetMinimalUsage("COMMAND")
 	return r
 }
+
+// export writes the accesskey bundle from the export API at u to file.
+func export(u, file string) {
+	var (
+		req = restapi.AccesskeyExportRequest{Passphrase: os.Getenv("WIRELEAP_PASSPHRASE")}
+		out = &broker.Bundle{}
+	)
+	if err := clientlib.DefaultAPIClient.Perform(http.MethodPost, u, req, out); err != nil {
+		st := &status.T{}
+		if errors.As(err, &st) {
+			clientlib.JSONOrDie(os.Stdout, st)
+			os.Exit(1)
+		}
+		log.Fatalf("error while executing API request: %s", err)
+	}
+	if out.Sealed == nil {
+		log.Printf("WARNING: WIRELEAP_PASSPHRASE is not set, the bundle is not encrypted; keep it safe")
+	}
+	if file == "-" {
+		clientlib.JSONOrDie(os.Stdout, out)
+		return
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("could not create %s: %s", file, err)
+	}
+	clientlib.JSONOrDie(f, out)
+	if err = f.Close(); err != nil {
+		log.Fatalf("could not write %s: %s", file, err)
+	}
+	log.Printf("exported accesskeys to %s", file)
+}
+
+// readFile reads file or stdin if file is "-".
+func readFile(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// importURL returns the URL to import accesskeys from. If arg is "-", the
+// accesskey file JSON, token or base64 is read from stdin.
+func importURL(arg string) *url.URL {
+	if arg != "-" {
+		u, err := url.Parse(strings.TrimSpace(arg))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return u
+	}
+	b, err := readFile(arg)
+	if err != nil {
+		log.Fatalf("could not read accesskeys from stdin: %s", err)
+	}
+	u, err := stdinURL(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return u
+}
+
+// stdinURL returns the URL to import the accesskeys pasted as b from, which
+// is either an accesskey token or accesskey file JSON, possibly base64 or
+// base64url-encoded as when shared via chat.
+func stdinURL(b []byte) (*url.URL, error) {
+	b = bytes.TrimSpace(b)
+	if bytes.HasPrefix(b, []byte(clientlib.AccesskeyTokenScheme+":")) {
+		u, err := url.Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse accesskey token: %w", err)
+		}
+		return u, nil
+	}
+	if !bytes.HasPrefix(b, []byte("{")) {
+		// line breaks may have been added when pasting
+		s := strings.Join(strings.Fields(string(b)), "")
+		s = strings.TrimRight(s, "=")
+		var err error
+		if b, err = base64.RawStdEncoding.DecodeString(s); err != nil {
+			if b, err = base64.RawURLEncoding.DecodeString(s); err != nil {
+				return nil, fmt.Errorf("input is neither an accesskey file, a token nor base64-encoded")
+			}
+		}
+		b = bytes.TrimSpace(b)
+		if !bytes.HasPrefix(b, []byte("{")) {
+			return nil, fmt.Errorf("base64-decoded input is not an accesskey file")
+		}
+	}
+	return clientlib.DataURL(b), nil
+}
+
+// token prints the compact token of the accesskey file.
+func token(file string) {
+	b, err := readFile(file)
+	if err != nil {
+		log.Fatalf("could not read accesskey file: %s", err)
+	}
+	ak := &accesskey.T{}
+	if err = json.Unmarshal(b, ak); err != nil {
+		log.Fatalf("could not unmarshal accesskey file: %s", err)
+	}
+	if ak.Version == nil || ak.Contract == nil || ak.Pofs == nil {
+		log.Fatalf("malformed accesskey file")
+	}
+	s, err := clientlib.EncodeAccesskeyToken(ak)
+	if err != nil {
+		log.Fatalf("could not encode accesskey token: %s", err)
+	}
+	fmt.Println(s)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Wireleap
+
+package accesskeyscmd
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/client/clientlib"
+)
+
+func TestStdinURL(t *testing.T) {
+	ak := `{"version":"0.1.0","pofs":[{"type":"pof","nonce":"a?b>c"}]}`
+	std := base64.StdEncoding.EncodeToString([]byte(ak))
+	for _, tc := range []struct {
+		name, in, scheme string
+	}{
+		{"json", "\n" + ak + "\n", "data"},
+		{"token", " wlak:abc\n", clientlib.AccesskeyTokenScheme},
+		{"base64", std + "\n", "data"},
+		{"unpadded", strings.TrimRight(std, "="), "data"},
+		{"base64url", base64.RawURLEncoding.EncodeToString([]byte(ak)), "data"},
+		{"wrapped", std[:20] + "\r\n" + std[20:40] + "\n" + std[40:], "data"},
+	} {
+		u, err := stdinURL([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if u.Scheme != tc.scheme {
+			t.Errorf("%s: got %s URL", tc.name, u.Scheme)
+			continue
+		}
+		if tc.scheme != "data" {
+			continue
+		}
+		b, err := clientlib.ReadDataURL(*u)
+		if err != nil || string(b) != ak {
+			t.Errorf("%s: data URL contains %q, %v", tc.name, b, err)
+		}
+	}
+	for _, in := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("not json")),
+	} {
+		if u, err := stdinURL([]byte(in)); err == nil {
+			t.Errorf("%q: got %s, expected error", in, u)
+		}
+	}
+}
@@ -120,11 +120,16 @@ func Run(fm fsdir.T, key, val string) {
 		fmt.Println(string(b))
 		return
 	}
-	if match.Quote {
-		val = "\"" + val + "\""
-	}
-	if err := json.Unmarshal([]byte(val), match.Val); err != nil {
-		log.Fatalf("could not set %s value to %s: %s", key, val, err)
+	if p, ok := match.Val.(*string); ok && val == "null" {
+		// null leaves plain strings untouched when unmarshaling
+		*p = ""
+	} else {
+		if match.Quote && val != "null" {
+			val = "\"" + val + "\""
+		}
+		if err := json.Unmarshal([]byte(val), match.Val); err != nil {
+			log.Fatalf("could not set %s value to %s: %s", key, val, err)
+		}
 	}
 	if key == "address.socks" {
 		log.Printf("Note: address.socks changes will take effect on restart.")
@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Wireleap
+
+package contractscmd
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/wireleap/client/broker"
+	"github.com/wireleap/client/clientcfg"
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/client/restapi"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/cli"
+	"github.com/wireleap/common/cli/fsdir"
+)
+
+func Cmd() *cli.Subcmd {
+	fs := flag.NewFlagSet("contracts", flag.ExitOnError)
+	r := &cli.Subcmd{
+		FlagSet: fs,
+		Desc:    "Manage known contracts",
+		Sections: []cli.Section{
+			{
+				Title: "Commands",
+				Entries: []cli.Entry{
+					{Key: "list", Value: "List known contracts and their accesskeys"},
+					{Key: "use", Value: "Switch to the known contract at URL"},
+				},
+			},
+		},
+	}
+	r.Run = func(fm fsdir.T) {
+		switch fs.Arg(0) {
+		case "use":
+			if fs.NArg() != 2 {
+				r.Usage()
+				os.Exit(1)
+			}
+		default:
+			if fs.NArg() != 1 {
+				r.Usage()
+				os.Exit(1)
+			}
+		}
+		c := clientcfg.Defaults()
+		err := fm.Get(&c, filenames.Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var (
+			meth  = http.MethodGet
+			u     = "http://" + *c.Address + "/api/contracts"
+			param interface{}
+			out   = []broker.Contract{}
+		)
+		switch fs.Arg(0) {
+		case "list":
+			// no changes needed to what's defined above
+		case "use":
+			to, err := url.Parse(fs.Arg(1))
+			if err != nil {
+				log.Fatal(err)
+			}
+			u += "/use"
+			meth = http.MethodPost
+			param = restapi.ContractUseRequest{Contract: &texturl.URL{URL: *to}}
+		default:
+			log.Fatalf("unknown command %s", fs.Arg(0))
+		}
+		clientlib.APICallOrDie(meth, u, param, &out)
+	}
+	r.SetMinimalUsage("COMMAND")
+	return r
+}
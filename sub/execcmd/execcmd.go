@@ -6,6 +6,7 @@ import (
 	"flag"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
@@ -96,6 +97,10 @@ func Cmd() *cli.Subcmd {
 			"WIRELEAP_SOCKS_HOST="+host,
 			"WIRELEAP_SOCKS_PORT="+port,
 		)
+		if sc := c.Forwarders.Socks; sc.Username != "" || sc.Password != "" {
+			// url-encoded "user:pass@" prefix for proxy urls
+			cmd.Env = append(cmd.Env, "WIRELEAP_SOCKS_USERINFO="+url.UserPassword(sc.Username, sc.Password).String()+"@")
+		}
 		cmd.Stdin = os.Stdin
 		cmd.Stderr = os.Stderr
 		cmd.Stdout = os.Stdout
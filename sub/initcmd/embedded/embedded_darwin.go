@@ -4,5 +4,5 @@ package embedded
 
 import "embed"
 
-//go:embed wireleap_tun wireleap_socks scripts_darwin LICENSE completion.bash
+//go:embed wireleap_tun wireleap_socks wireleap_http scripts_darwin LICENSE completion.bash
 var FS embed.FS
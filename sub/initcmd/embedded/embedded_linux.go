@@ -4,5 +4,5 @@ package embedded
 
 import "embed"
 
-//go:embed wireleap_intercept.so wireleap_tun wireleap_socks scripts_linux LICENSE completion.bash
+//go:embed wireleap_intercept.so wireleap_tun wireleap_socks wireleap_http wireleap_redirect scripts_linux LICENSE completion.bash
 var FS embed.FS
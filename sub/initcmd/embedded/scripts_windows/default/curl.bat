@@ -1,3 +1,3 @@
 @echo off
-set ALL_PROXY=socks5h://%WIRELEAP_SOCKS%
+set ALL_PROXY=socks5h://%WIRELEAP_SOCKS_USERINFO%%WIRELEAP_SOCKS%
 curl %*
@@ -1,2 +1,2 @@
 @echo off
-git -c http.proxy=socks5h://%WIRELEAP_SOCKS% %*
+git -c http.proxy=socks5h://%WIRELEAP_SOCKS_USERINFO%%WIRELEAP_SOCKS% %*
@@ -3,11 +3,14 @@
 package initcmd
 
 import (
+	"errors"
 	"flag"
 	"log"
+	"os"
 	"text/tabwriter"
 
 	"github.com/wireleap/client/clientcfg"
+	"github.com/wireleap/client/clientlib"
 	"github.com/wireleap/client/filenames"
 	"github.com/wireleap/client/sub/initcmd/embedded"
 	"github.com/wireleap/common/cli"
@@ -17,6 +20,7 @@ import (
 func Cmd() *cli.Subcmd {
 	fs := flag.NewFlagSet("init", flag.ExitOnError)
 	force := fs.Bool("force-unpack-only", false, "Overwrite embedded files only")
+	passsrc := fs.String("passphrase-source", "", "Encrypt accesskeys with passphrase from `SOURCE`: "+clientlib.PassphraseSourceHelp)
 	r := &cli.Subcmd{
 		FlagSet: fs,
 		Desc:    "Initialize wireleap home directory",
@@ -24,8 +28,23 @@ func Cmd() *cli.Subcmd {
 			if err := cli.UnpackEmbedded(embedded.FS, fm, *force); err != nil {
 				log.Fatalf("error while unpacking embedded files: %s", err)
 			}
+			// only wireleap_socks and wireleap_tun are made executable by
+			// UnpackEmbedded
+			for _, bin := range []string{"wireleap_http", "wireleap_redirect"} {
+				if err := os.Chmod(fm.Path(bin), 0755); err != nil && !errors.Is(err, os.ErrNotExist) {
+					log.Fatalf("could not make %s executable: %s", bin, err)
+				}
+			}
 			if !*force {
-				if err := fm.SetIndented(clientcfg.Defaults(), filenames.Config); err != nil {
+				c := clientcfg.Defaults()
+				if *passsrc != "" {
+					// fail early rather than on start
+					if _, err := clientlib.Passphrase(*passsrc); err != nil {
+						log.Fatal(err)
+					}
+					c.Broker.Accesskey.PassphraseSource = *passsrc
+				}
+				if err := fm.SetIndented(c, filenames.Config); err != nil {
 					log.Fatalf("could not write initial config.json: %s", err)
 				}
 			}
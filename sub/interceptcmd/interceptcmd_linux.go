@@ -23,8 +23,15 @@ func Cmd() *cli.Subcmd {
 	r := &cli.Subcmd{
 		FlagSet: fs,
 		Desc:    "Run executable and redirect connections (req. SOCKS forwarder)",
+		Sections: []cli.Section{{
+			Title: "Options",
+			Entries: []cli.Entry{
+				{Key: "--netns", Value: "Run in a new network namespace routed via the broker (no SOCKS forwarder needed)"},
+			},
+		}},
 	}
-	r.SetMinimalUsage("[ARGS]")
+	netns := fs.Bool("netns", false, "Run in a new network namespace routed via the broker")
+	r.SetMinimalUsage("[OPTIONS] [ARGS]")
 	r.Run = func(fm fsdir.T) {
 		c := clientcfg.Defaults()
 		err := fm.Get(&c, filenames.Config)
@@ -35,6 +42,10 @@ func Cmd() *cli.Subcmd {
 			r.Usage()
 			os.Exit(1)
 		}
+		if *netns && os.Getenv(netnsEnv) != "" {
+			netnsChild(c, fs.Args())
+			return
+		}
 		switch runtime.GOOS {
 		case "linux":
 			conn, err := net.DialTimeout("tcp", *c.Broker.Address, time.Second)
@@ -42,6 +53,13 @@ func Cmd() *cli.Subcmd {
 				log.Fatalf("could not connect to wireleap broker at address %s: %s", *c.Broker.Address, err)
 			}
 			conn.Close()
+			if *netns {
+				netnsParent(c, fs.Args())
+				return
+			}
+			if c.Forwarders.Socks.Username != "" || c.Forwarders.Socks.Password != "" {
+				log.Fatal("wireleap_intercept.so does not support SOCKSv5 authentication, use --netns instead")
+			}
 			lib := fm.Path("wireleap_intercept.so")
 			args := fs.Args()
 
@@ -0,0 +1,317 @@
+// Copyright (c) 2022 Wireleap
+
+package interceptcmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/wireleap/client/clientcfg"
+	"github.com/wireleap/client/wireleap_tun/netsetup"
+	"github.com/wireleap/client/wireleap_tun/tun"
+	"github.com/wireleap/client/wireleap_tun/tunsplice"
+)
+
+// netnsEnv is set in the environment of the re-executed wireleap process
+// which sets up the network namespace before executing the target.
+const netnsEnv = "WIRELEAP_INTERCEPT_NETNS"
+
+const (
+	// resolvConf is the resolver configuration replaced in the namespace if
+	// it only lists loopback resolvers.
+	resolvConf = "/etc/resolv.conf"
+	// upstreamResolvConf lists the resolvers systemd-resolved forwards to.
+	upstreamResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// netnsFallbackDNS are the resolvers used in the namespace if neither
+// resolv.conf nor systemd-resolved list one reachable through the circuit.
+var netnsFallbackDNS = []string{"1.1.1.1", "9.9.9.9"}
+
+// netnsParent runs args in a new user, mount & network namespace. All traffic
+// in the namespace is routed to a tun device the fd of which is passed back to this
+// process and spliced to the broker from the host network namespace.
+func netnsParent(c clientcfg.C, args []string) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		log.Fatalf("could not create socket pair: %s", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "netns-child")
+	remote := os.NewFile(uintptr(fds[1]), "netns-parent")
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatalf("could not find own executable path: %s", err)
+	}
+	cmd := exec.Cmd{
+		Path:       self,
+		Args:       append([]string{self, "intercept", "--netns"}, args...),
+		Env:        append(os.Environ(), netnsEnv+"=1"),
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: []*os.File{remote},
+		SysProcAttr: &syscall.SysProcAttr{
+			// a mount namespace is needed to replace resolv.conf
+			Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET | syscall.CLONE_NEWNS,
+			// map to root so that the tun device can be set up
+			UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+			GidMappingsEnableSetgroups: false,
+		},
+	}
+	if err = cmd.Start(); err != nil {
+		log.Fatalf("could not start %s in a new network namespace: %s (are unprivileged user namespaces enabled?)", args[0], err)
+	}
+	remote.Close()
+	// forward signals to the child instead of dying
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for s := range sigs {
+			cmd.Process.Signal(s)
+		}
+	}()
+	tunf, lf, mtu, err := recvFds(fds[0])
+	if err != nil {
+		// child has logged the error already, if any
+		cmd.Wait()
+		log.Fatalf("could not receive tun device from network namespace: %s", err)
+	}
+	l, err := net.FileListener(lf)
+	lf.Close()
+	if err != nil {
+		log.Fatalf("could not use tcp listener from network namespace: %s", err)
+	}
+	tl := l.(*net.TCPListener)
+	go tunsplice.Serve(tl)
+	go tunsplice.MutateLoop(
+		tl.Addr().(*net.TCPAddr),
+		nil,
+		tun.NewReader(tunf),
+		tun.NewWriter(tunf),
+		tunsplice.DialFuncTo(*c.Broker.Address, "intercept"),
+		mtu,
+	)
+	// tell the child it can execute the target now
+	if _, err = local.Write([]byte{0}); err != nil {
+		log.Fatalf("could not signal network namespace readiness: %s", err)
+	}
+	cmd.Wait()
+	os.Exit(cmd.ProcessState.ExitCode())
+}
+
+// sendFds sends the tun device fd, the tcp listener fd and the tun device mtu
+// to the parent.
+func sendFds(fd int, tunf, lf *os.File, mtu int) error {
+	rights := syscall.UnixRights(int(tunf.Fd()), int(lf.Fd()))
+	return syscall.Sendmsg(fd, []byte{byte(mtu >> 8), byte(mtu)}, rights, nil, 0)
+}
+
+// recvFds receives the tun device fd, the tcp listener fd and the tun device
+// mtu from the child.
+func recvFds(fd int) (tunf, lf *os.File, mtu int, err error) {
+	var (
+		buf = make([]byte, 2)
+		oob = make([]byte, syscall.CmsgSpace(2*4))
+	)
+	n, oobn, _, _, err := syscall.Recvmsg(fd, buf, oob, 0)
+	if err != nil {
+		return
+	}
+	if n != len(buf) {
+		err = fmt.Errorf("expected %d bytes of mtu, got %d", len(buf), n)
+		return
+	}
+	mtu = int(buf[0])<<8 | int(buf[1])
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return
+	}
+	if len(msgs) != 1 {
+		err = fmt.Errorf("expected 1 control message, got %d", len(msgs))
+		return
+	}
+	rights, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return
+	}
+	if len(rights) != 2 {
+		err = fmt.Errorf("expected 2 fds, got %d", len(rights))
+		return
+	}
+	tunf = os.NewFile(uintptr(rights[0]), "tun")
+	lf = os.NewFile(uintptr(rights[1]), "listener")
+	return
+}
+
+// netnsChild runs inside the new network namespace. It sets up the tun device
+// and a tcp listener on its address, passes both to the parent and executes
+// args once the parent is ready.
+func netnsChild(c clientcfg.C, args []string) {
+	sock := os.NewFile(3, "netns-parent")
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		log.Fatalf("could not get loopback link: %s", err)
+	}
+	if err = netlink.LinkSetUp(lo); err != nil {
+		log.Fatalf("could not set loopback link up: %s", err)
+	}
+	t, err := tun.New()
+	if err != nil {
+		log.Fatalf("could not create tun device: %s", err)
+	}
+	tunaddr := c.Forwarders.Tun.Address
+	// netsetup is chatty; keep the target's stderr clean
+	log.SetOutput(io.Discard)
+	err = netsetup.Init(t, tunaddr, c.Forwarders.Tun.MTU)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Fatalf("could not configure tun device %s as %s: %s", t.Name(), tunaddr, err)
+	}
+	laddr, err := net.ResolveTCPAddr("tcp4", tunaddr)
+	if err != nil {
+		log.Fatalf("could not parse forwarders.tun.address %s: %s", tunaddr, err)
+	}
+	l, err := net.ListenTCP("tcp4", laddr)
+	if err != nil {
+		log.Fatalf("could not listen on %s: %s", laddr, err)
+	}
+	lf, err := l.File()
+	if err != nil {
+		log.Fatalf("could not get listener fd: %s", err)
+	}
+	// mtu is needed by the parent for mss clamping & fragmentation
+	if err = fixResolvConf(); err != nil {
+		log.Fatalf("could not set up DNS resolution in network namespace: %s", err)
+	}
+	tunf, ok := t.Interface.ReadWriteCloser.(*os.File)
+	if !ok {
+		log.Fatalf("tun device %s is not backed by a file", t.Name())
+	}
+	if err = sendFds(int(sock.Fd()), tunf, lf, t.NetIf.MTU); err != nil {
+		log.Fatalf("could not pass tun device to parent: %s", err)
+	}
+	if _, err = sock.Read(make([]byte, 1)); err != nil {
+		log.Fatalf("parent did not signal readiness: %s", err)
+	}
+	bin, err := exec.LookPath(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, netnsEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	// all fds opened above are close-on-exec
+	if err = syscall.Exec(bin, args, env); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fixResolvConf bind-mounts a resolv.conf listing resolvers reachable through
+// the circuit over /etc/resolv.conf if the latter only lists loopback ones,
+// such as the 127.0.0.53 stub of systemd-resolved, which are not reachable
+// from the network namespace.
+func fixResolvConf() error {
+	cur, err := os.ReadFile(resolvConf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// there is nothing to mount over
+			return nil
+		}
+		return err
+	}
+	// missing upstream configuration is fine, fallback resolvers are used
+	upstream, _ := os.ReadFile(upstreamResolvConf)
+	b, ok := reachableResolvConf(cur, upstream)
+	if !ok {
+		return nil
+	}
+	f, err := os.CreateTemp("", "wireleap-resolv-*.conf")
+	if err != nil {
+		return err
+	}
+	// the bind mount keeps the file around after it is removed
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	// do not propagate the mount to the host
+	if err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("could not make mounts private: %w", err)
+	}
+	if err = syscall.Mount(f.Name(), resolvConf, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("could not bind-mount %s: %w", resolvConf, err)
+	}
+	return nil
+}
+
+// reachableResolvConf returns the contents of a resolv.conf which lists
+// resolvers reachable through the circuit instead of the ones in cur and
+// whether cur needs replacing at all. The non-local resolvers in upstream are
+// used if there are any, netnsFallbackDNS otherwise.
+func reachableResolvConf(cur, upstream []byte) ([]byte, bool) {
+	for _, ns := range nameservers(cur) {
+		if !ns.IsLoopback() {
+			return nil, false
+		}
+	}
+	var use []string
+	for _, ns := range nameservers(upstream) {
+		// LAN resolvers are not reachable from the exit relay either
+		if !ns.IsLoopback() && !ns.IsPrivate() && !ns.IsLinkLocalUnicast() {
+			use = append(use, ns.String())
+		}
+	}
+	if len(use) == 0 {
+		use = netnsFallbackDNS
+	}
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# generated by wireleap intercept --netns")
+	sc := bufio.NewScanner(bytes.NewReader(cur))
+	for sc.Scan() {
+		// keep search domains and options
+		if f := strings.Fields(sc.Text()); len(f) > 0 && f[0] != "nameserver" && !strings.HasPrefix(f[0], "#") {
+			fmt.Fprintln(&b, sc.Text())
+		}
+	}
+	for _, ns := range use {
+		fmt.Fprintln(&b, "nameserver", ns)
+	}
+	return b.Bytes(), true
+}
+
+// nameservers returns the valid nameserver addresses in the resolv.conf b.
+func nameservers(b []byte) (r []net.IP) {
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 2 || f[0] != "nameserver" {
+			continue
+		}
+		// strip IPv6 zone, if any
+		if ip := net.ParseIP(strings.SplitN(f[1], "%", 2)[0]); ip != nil {
+			r = append(r, ip)
+		}
+	}
+	return
+}
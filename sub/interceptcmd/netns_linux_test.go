@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Wireleap
+
+package interceptcmd
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReachableResolvConf(t *testing.T) {
+	for _, c := range []struct {
+		name, cur, upstream, want string
+		ok                        bool
+	}{
+		{
+			name: "public resolver",
+			cur:  "nameserver 192.0.2.53\n",
+		},
+		{
+			name: "mixed",
+			cur:  "nameserver 127.0.0.53\nnameserver 192.0.2.53\n",
+		},
+		{
+			name:     "resolved stub",
+			cur:      "# stub\nnameserver 127.0.0.53\noptions edns0 trust-ad\nsearch lan\n",
+			upstream: "nameserver 192.168.1.1\nnameserver 198.51.100.1\nnameserver fe80::1%eth0\n",
+			want:     "# generated by wireleap intercept --netns\noptions edns0 trust-ad\nsearch lan\nnameserver 198.51.100.1\n",
+			ok:       true,
+		},
+		{
+			name:     "only lan upstream",
+			cur:      "nameserver ::1\n",
+			upstream: "nameserver 10.0.0.1\n",
+			want:     "# generated by wireleap intercept --netns\nnameserver 1.1.1.1\nnameserver 9.9.9.9\n",
+			ok:       true,
+		},
+		{
+			name: "no nameservers",
+			cur:  "nameserver bogus\n",
+			want: "# generated by wireleap intercept --netns\nnameserver 1.1.1.1\nnameserver 9.9.9.9\n",
+			ok:   true,
+		},
+	} {
+		b, ok := reachableResolvConf([]byte(c.cur), []byte(c.upstream))
+		if ok != c.ok || string(b) != c.want {
+			t.Errorf("%s: got %v %q, want %v %q", c.name, ok, b, c.ok, c.want)
+		}
+	}
+}
+
+func TestSendRecvFds(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	dir := t.TempDir()
+	var fs [2]*os.File
+	for i, name := range []string{"tun", "listener"} {
+		if fs[i], err = os.Create(dir + "/" + name); err != nil {
+			t.Fatal(err)
+		}
+		defer fs[i].Close()
+		fs[i].WriteString(name)
+	}
+	if err = sendFds(fds[1], fs[0], fs[1], 1420); err != nil {
+		t.Fatal(err)
+	}
+	tunf, lf, mtu, err := recvFds(fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunf.Close()
+	defer lf.Close()
+	if mtu != 1420 {
+		t.Errorf("got mtu %d, want 1420", mtu)
+	}
+	for f, want := range map[*os.File]string{tunf: "tun", lf: "listener"} {
+		f.Seek(0, io.SeekStart)
+		b, err := io.ReadAll(f)
+		if err != nil || string(b) != want {
+			t.Errorf("got %q (%v), want %q", b, err, want)
+		}
+	}
+}
+
+func TestRecvFdsShort(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	syscall.Write(fds[1], []byte{5})
+	syscall.Close(fds[1])
+	if _, _, _, err = recvFds(fds[0]); err == nil {
+		t.Error("expected error for missing fds")
+	}
+}
@@ -0,0 +1,6 @@
+// Copyright (c) 2022 Wireleap
+
+package redirectcmd
+
+// redirect is unsupported on Darwin
+const Available bool = false
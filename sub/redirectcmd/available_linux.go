@@ -0,0 +1,6 @@
+// Copyright (c) 2022 Wireleap
+
+package redirectcmd
+
+// redirect is supported on Linux
+const Available bool = true
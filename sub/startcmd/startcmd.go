@@ -163,11 +163,13 @@ func Cmd(arg0 string) *cli.Subcmd {
 			// combo socket?
 			if *c.Address == *c.Broker.Address {
 				mux.Handle("/api/", http.StripPrefix("/api", restapi.New(brok, restlog)))
+				mux.Handle("/proxy.pac", restapi.PACHandler(brok, restlog))
 				mux.Handle("/", http.FileServer(http.Dir(fm.Path("webroot"))))
 				restlog.Printf("listening h2c on %s", *c.Address)
 			} else {
 				restmux := http.NewServeMux()
 				restmux.Handle("/api/", http.StripPrefix("/api", restapi.New(brok, restlog)))
+				restmux.Handle("/proxy.pac", restapi.PACHandler(brok, restlog))
 				restmux.Handle("/", http.FileServer(http.Dir(fm.Path("webroot"))))
 
 				var restl net.Listener
@@ -27,6 +27,8 @@ func Cmd(arg0 string) *cli.Subcmd {
 				pidfile  = arg0 + ".pid"
 				sockspid = "wireleap_socks.pid"
 				tunpid   = "wireleap_tun.pid"
+				httppid  = "wireleap_http.pid"
+				rdrpid   = "wireleap_redirect.pid"
 			)
 			if err = fm.Get(&pid, sockspid); err == nil && process.Exists(pid) {
 				log.Fatalf("`wireleap_socks` appears to be running, stop it before stopping `wireleap`")
@@ -34,6 +36,12 @@ func Cmd(arg0 string) *cli.Subcmd {
 			if err = fm.Get(&pid, tunpid); err == nil && process.Exists(pid) {
 				log.Fatalf("`wireleap_tun` appears to be running, stop it before stopping `wireleap`")
 			}
+			if err = fm.Get(&pid, httppid); err == nil && process.Exists(pid) {
+				log.Fatalf("`wireleap_http` appears to be running, stop it before stopping `wireleap`")
+			}
+			if err = fm.Get(&pid, rdrpid); err == nil && process.Exists(pid) {
+				log.Fatalf("`wireleap_redirect` appears to be running, stop it before stopping `wireleap`")
+			}
 			if err = fm.Get(&pid, pidfile); err != nil {
 				log.Fatalf(
 					"could not get pid of %s from %s: %s",
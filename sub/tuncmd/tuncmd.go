@@ -3,6 +3,7 @@
 package tuncmd
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -38,6 +39,16 @@ func Cmd() (r *cli.Subcmd) {
 				{"status", fmt.Sprintf("Report %s daemon status", bin)},
 				{"restart", fmt.Sprintf("Restart %s daemon", bin)},
 				{"log", fmt.Sprintf("Show %s logs", bin)},
+				{Key: "capture", Value: "Capture tunnelled packets for debugging"},
+			},
+		}, {
+			Title: "Capture commands",
+			Entries: []cli.Entry{
+				{Key: "start FILE", Value: "Start capturing packets to FILE in pcapng format"},
+				{Key: "stop", Value: "Stop capturing packets"},
+				{Key: "status", Value: "Report packet capture status"},
+				{Key: "--filter", Value: "Only capture packets matching a tcpdump-like expression"},
+				{Key: "--limit", Value: "Stop capturing after this many bytes (default 64MiB)"},
 			},
 		}},
 	}
@@ -104,6 +115,9 @@ func Cmd() (r *cli.Subcmd) {
 			}
 			os.Stdout.Write(b)
 			return
+		case "capture":
+			capture(r.FlagSet.Args()[1:], url+"/capture")
+			return
 		default:
 			log.Fatalf("unknown %s subcommand: %s", name, cmd)
 		}
@@ -128,3 +142,40 @@ func Cmd() (r *cli.Subcmd) {
 	}
 	return
 }
+
+// capture controls packet capture in the running wireleap_tun.
+func capture(args []string, url string) {
+	if len(args) < 1 {
+		log.Fatalf("missing capture subcommand, expected start, stop or status")
+	}
+	var (
+		out  json.RawMessage
+		meth = http.MethodGet
+		in   interface{}
+	)
+	switch args[0] {
+	case "status":
+		// GET is used as-is
+	case "start":
+		fs := flag.NewFlagSet("capture start", flag.ExitOnError)
+		filter := fs.String("filter", "", "Capture filter expression")
+		limit := fs.Int64("limit", 64<<20, "Maximum capture file size in bytes")
+		fs.Parse(args[1:])
+		if fs.NArg() < 1 {
+			log.Fatalf("missing capture file name")
+		}
+		file := fs.Arg(0)
+		// allow options after the file name too
+		fs.Parse(fs.Args()[1:])
+		if fs.NArg() > 0 {
+			log.Fatalf("unexpected arguments: %v", fs.Args())
+		}
+		meth = http.MethodPost
+		in = map[string]interface{}{"file": file, "filter": *filter, "limit": *limit}
+	case "stop":
+		meth = http.MethodDelete
+	default:
+		log.Fatalf("unknown %s capture subcommand: %s", name, args[0])
+	}
+	clientlib.APICallOrDie(meth, url, in, &out)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Wireleap
+
+package usagecmd
+
+import (
+	"encoding/csv"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/wireleap/client/broker"
+	"github.com/wireleap/client/clientcfg"
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/filenames"
+	"github.com/wireleap/common/cli"
+	"github.com/wireleap/common/cli/fsdir"
+)
+
+func Cmd() *cli.Subcmd {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	format := fs.String("format", "json", "Output `FORMAT`: json or csv")
+	from := fs.String("from", "", "Only show usage from `DAY` (YYYY-MM-DD, UTC) on")
+	to := fs.String("to", "", "Only show usage up to `DAY` (YYYY-MM-DD, UTC)")
+	r := &cli.Subcmd{
+		FlagSet: fs,
+		Desc:    "Show traffic by servicekey, forwarder and day",
+	}
+	r.Run = func(fm fsdir.T) {
+		if fs.NArg() != 0 {
+			r.Usage()
+			os.Exit(1)
+		}
+		if *format != "json" && *format != "csv" {
+			log.Fatalf("unknown output format %s", *format)
+		}
+		c := clientcfg.Defaults()
+		err := fm.Get(&c, filenames.Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		q := url.Values{}
+		if *from != "" {
+			q.Set("from", *from)
+		}
+		if *to != "" {
+			q.Set("to", *to)
+		}
+		u := "http://" + *c.Address + "/api/usage"
+		if len(q) > 0 {
+			u += "?" + q.Encode()
+		}
+		out := []*broker.Usage{}
+		if *format == "json" {
+			clientlib.APICallOrDie(http.MethodGet, u, nil, &out)
+			return
+		}
+		clientlib.APIPerformOrDie(http.MethodGet, u, nil, &out)
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"day", "servicekey", "pof", "contract", "forwarder", "connections", "sent", "received"})
+		for _, x := range out {
+			contract := ""
+			if x.Contract != nil {
+				contract = x.Contract.String()
+			}
+			w.Write([]string{
+				x.Day,
+				x.Servicekey,
+				x.Pof,
+				contract,
+				x.Forwarder,
+				strconv.FormatInt(x.Connections, 10),
+				strconv.FormatInt(x.Sent, 10),
+				strconv.FormatInt(x.Received, 10),
+			})
+		}
+		if w.Flush(); w.Error() != nil {
+			log.Fatalf("could not write CSV output: %s", w.Error())
+		}
+	}
+	return r
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2022 Wireleap
+
+package version
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sudo runs the given command via sudo non-interactively, so it only
+// succeeds if sudo credentials are cached or no password is required.
+func sudo(args ...string) error {
+	out, err := exec.Command("sudo", append([]string{"-n"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sudo %s: %s (%s)", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// setuidRoot makes the file at path owned by root and setuid, trying
+// directly first and falling back to sudo.
+func setuidRoot(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// chown clears the setuid bit so it has to come first
+	if err = os.Chown(path, 0, 0); err == nil {
+		if err = os.Chmod(path, fi.Mode()|os.ModeSetuid); err == nil {
+			return nil
+		}
+	}
+	if err = sudo("chown", "0:0", path); err != nil {
+		return err
+	}
+	return sudo("chmod", "u+s", path)
+}
+
+// privilegeNote prints the commands which give the file at path the
+// privileges it needs, for when they could not be applied automatically.
+func privilegeNote(path string, cmds ...string) {
+	fmt.Println("===================================")
+	fmt.Printf("NOTE: to enable %s again:\n", filepath.Base(path))
+	for _, c := range cmds {
+		fmt.Println("$", c)
+	}
+	fmt.Println("===================================")
+	fmt.Println("(to return to your shell prompt just press Return)")
+}
+
+// setuidNote prints the commands which make the file at path setuid root.
+func setuidNote(path string) {
+	privilegeNote(path, "sudo chown root:root "+path, "sudo chmod u+s "+path)
+}
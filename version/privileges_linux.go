@@ -0,0 +1,50 @@
+// Copyright (c) 2022 Wireleap
+
+package version
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/wireleap/client/wireleap_tun/caps"
+)
+
+// restorePrivileges applies the privileges the previous binary at prev had
+// (CAP_NET_ADMIN file capability or setuid root) to the newly unpacked one at
+// cur. If that is not possible without a password, the commands to do so
+// manually are printed instead.
+func restorePrivileges(prev, cur string) {
+	fi, err := os.Stat(prev)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("could not check privileges of %s: %s", prev, err)
+		}
+		// nothing to restore
+		return
+	}
+	if capable, _ := caps.FileHasNetAdmin(prev); capable {
+		log.Printf("re-applying CAP_NET_ADMIN file capability to %s...", filepath.Base(cur))
+		if _, err = caps.CopyFile(prev, cur); err == nil {
+			return
+		}
+		if err = sudo("setcap", "cap_net_admin+ep", cur); err == nil {
+			return
+		}
+		log.Printf("could not set CAP_NET_ADMIN on %s: %s", cur, err)
+		privilegeNote(cur, "sudo setcap cap_net_admin+ep "+cur)
+		return
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 || fi.Mode()&os.ModeSetuid == 0 {
+		// previous binary was not privileged, keep it that way
+		return
+	}
+	log.Printf("re-applying setuid root to %s...", filepath.Base(cur))
+	if err = setuidRoot(cur); err != nil {
+		log.Printf("could not make %s setuid root: %s", cur, err)
+		setuidNote(cur)
+	}
+}
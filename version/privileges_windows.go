@@ -0,0 +1,7 @@
+// Copyright (c) 2022 Wireleap
+
+package version
+
+// restorePrivileges is a no-op as no binaries need extra privileges on
+// windows.
+func restorePrivileges(string, string) {}
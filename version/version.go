@@ -15,6 +15,7 @@ import (
 	"github.com/wireleap/client/clientlib"
 	"github.com/wireleap/client/filenames"
 	"github.com/wireleap/client/sub/tuncmd/tuncmd_platform"
+	"github.com/wireleap/client/wireleap_tun/caps"
 	"github.com/wireleap/common/api/client"
 	"github.com/wireleap/common/api/consume"
 	"github.com/wireleap/common/api/duration"
@@ -44,12 +45,23 @@ var VERSION = semver.MustParse(VERSION_STRING)
 // Hardcoded (for now) channel value for wireleap client.
 const Channel = "default"
 
+// privilegedBins returns the names of the binaries which need extra privileges
+// and have them carried over on upgrade. Ones which are not unpacked on this
+// platform are skipped as they do not exist.
+func privilegedBins() []string {
+	bins := []string{"wireleap_redirect"}
+	if tuncmd_platform.Available {
+		bins = append(bins, "wireleap_tun")
+	}
+	return bins
+}
+
 // Post-upgrade hook for superviseupgradecmd.
 func PostUpgradeHook(f fsdir.T) (err error) {
-	if tuncmd_platform.Available {
-		log.Println("moving wireleap_tun to wireleap_tun.prev for potential rollback...")
-		if err = os.Rename(f.Path("wireleap_tun"), f.Path("wireleap_tun.prev")); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			err = fmt.Errorf("error while attempting to move wireleap_tun to wireleap_tun.prev: %s", err)
+	for _, bin := range privilegedBins() {
+		log.Printf("moving %s to %s.prev for potential rollback...", bin, bin)
+		if err = os.Rename(f.Path(bin), f.Path(bin+".prev")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("error while attempting to move %s to %s.prev: %s", bin, bin, err)
 			return
 		} else {
 			// if it does not exist, that is fine
@@ -65,14 +77,9 @@ func PostUpgradeHook(f fsdir.T) (err error) {
 	if err = cli.RunChild(f.Path("wireleap"), "stop"); err != nil {
 		return
 	}
-	if tuncmd_platform.Available {
-		fp := f.Path("wireleap_tun")
-		fmt.Println("===================================")
-		fmt.Println("NOTE: to enable wireleap_tun again:")
-		fmt.Println("$ sudo chown 0:0", fp)
-		fmt.Println("$ sudo chmod u+s", fp)
-		fmt.Println("===================================")
-		fmt.Println("(to return to your shell prompt just press Return)")
+	for _, bin := range privilegedBins() {
+		// keep the previously used privilege mode
+		restorePrivileges(f.Path(bin+".prev"), f.Path(bin))
 	}
 	return
 }
@@ -84,21 +91,26 @@ func PostRollbackHook(f fsdir.T) (err error) {
 	if err = cli.RunChild(f.Path("wireleap"), "init", "--force-unpack-only"); err != nil {
 		return
 	}
-	if tuncmd_platform.Available {
-		log.Println("moving wireleap_tun.prev to wireleap_tun...")
-		if err = os.Rename(f.Path("wireleap_tun.prev"), f.Path("wireleap_tun")); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			fp := f.Path("wireleap_tun")
+	for _, bin := range privilegedBins() {
+		log.Printf("moving %s.prev to %s...", bin, bin)
+		if err1 := os.Rename(f.Path(bin+".prev"), f.Path(bin)); err1 != nil && !errors.Is(err1, fs.ErrNotExist) {
+			fp := f.Path(bin)
 			fmt.Println("===================================")
-			fmt.Println("no wireleap_tun.prev found")
-			fmt.Println("NOTE: to enable wireleap_tun again:")
+			fmt.Printf("no %s.prev found\n", bin)
+			fmt.Printf("NOTE: to enable %s again:\n", bin)
 			fmt.Println("$ sudo chown 0:0", fp)
 			fmt.Println("$ sudo chmod u+s", fp)
+			if bin == "wireleap_tun" && caps.Supported {
+				fmt.Println("or, without setuid root:")
+				fmt.Println("$ sudo setcap cap_net_admin+ep", fp)
+			}
 			fmt.Println("===================================")
 			fmt.Println("(to return to your shell prompt just press Return)")
-		} else {
-			// if it does not exist, that is fine
-			err = nil
+			if err == nil {
+				err = err1
+			}
 		}
+		// if it does not exist, that is fine
 	}
 	return
 }
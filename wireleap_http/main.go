@@ -0,0 +1,258 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/wireleap/client/acl"
+	"github.com/wireleap/client/restapi"
+	"github.com/wireleap/client/socks"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/h2conn"
+	"golang.org/x/net/http2"
+)
+
+var tt = &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+	ReadIdleTimeout: 10 * time.Second,
+	PingTimeout:     10 * time.Second,
+}
+
+type DialFunc func(proto, addr string) (*h2conn.T, error)
+
+func dialFuncTo(h2caddr string) DialFunc {
+	return func(proto, addr string) (*h2conn.T, error) {
+		return h2conn.New(tt, h2caddr, map[string]string{
+			"Wl-Dial-Protocol": proto,
+			"Wl-Dial-Target":   addr,
+			"Wl-Forwarder":     "http",
+		})
+	}
+}
+
+// Proxy is a HTTP proxy handling CONNECT and absolute-URI requests, all
+// connections of which are dialed through the broker.
+type Proxy struct {
+	dialer DialFunc
+	rp     *httputil.ReverseProxy
+	// if auth is not nil, clients are required to authenticate
+	auth socks.Authenticator
+	// requests from sources not permitted by acls are rejected
+	acls *acl.T
+}
+
+func NewProxy(dialer DialFunc, auth socks.Authenticator, acls *acl.T) *Proxy {
+	return &Proxy{
+		dialer: dialer,
+		auth:   auth,
+		acls:   acls,
+		rp: &httputil.ReverseProxy{
+			// the request URI is absolute already
+			Director: func(r *http.Request) {
+				if _, ok := r.Header["User-Agent"]; !ok {
+					// do not add the default Go user agent
+					r.Header.Set("User-Agent", "")
+				}
+				// do not leak the client address through the circuit
+				r.Header["X-Forwarded-For"] = nil
+			},
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, addr string) (net.Conn, error) {
+					return dialer("tcp", addr)
+				},
+				MaxIdleConns:    100,
+				IdleConnTimeout: 90 * time.Second,
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("error proxying %s %s through the circuit: %s", r.Method, r.URL, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+	}
+}
+
+func (t *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil && !t.acls.Permits(addr.IP) {
+		t.acls.Reject("HTTP proxy request", addr)
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if t.auth != nil {
+		user, pass, ok := proxyAuth(r)
+		if !ok || !t.auth(user, pass) {
+			if ok {
+				log.Printf("HTTP proxy authentication from %s failed", r.RemoteAddr)
+			}
+			w.Header().Set("Proxy-Authenticate", `Basic realm="wireleap"`)
+			http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	switch {
+	case r.Method == http.MethodConnect:
+		t.connect(w, r)
+	case r.URL.IsAbs() && (r.URL.Scheme == "http" || r.URL.Scheme == "https"):
+		// not to be passed on
+		r.Header.Del("Proxy-Connection")
+		r.Header.Del("Proxy-Authorization")
+		t.rp.ServeHTTP(w, r)
+	default:
+		http.Error(w, "only CONNECT and absolute-URI proxy requests are supported", http.StatusBadRequest)
+	}
+}
+
+// proxyAuth returns the credentials from the Basic Proxy-Authorization
+// header of r, if any.
+func proxyAuth(r *http.Request) (user, pass string, ok bool) {
+	r2 := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	return r2.BasicAuth()
+}
+
+// connect handles a HTTP CONNECT request by splicing the client connection
+// with a connection to the requested address.
+func (t *Proxy) connect(w http.ResponseWriter, r *http.Request) {
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		http.Error(w, fmt.Sprintf("invalid CONNECT address %s: %s", r.Host, err), http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("HTTP CONNECT accepted: %s -> %s", r.RemoteAddr, r.Host)
+	c1, err := t.dialer("tcp", r.Host)
+	if err != nil {
+		log.Printf("error dialing tcp through the circuit: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer c1.Close()
+	c0, buf, err := hj.Hijack()
+	if err != nil {
+		log.Printf("error hijacking CONNECT connection: %s", err)
+		return
+	}
+	defer c0.Close()
+	if _, err = io.WriteString(c0, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// pass on anything the client sent right after the request
+	if n := buf.Reader.Buffered(); n > 0 {
+		if _, err = io.CopyN(c1, buf, int64(n)); err != nil {
+			log.Printf("error writing initial data to %s: %s", r.Host, err)
+			return
+		}
+	}
+	if err = wlnet.Splice(context.Background(), c0, c1, 0, 32768); err != nil {
+		log.Printf("error splicing CONNECT connection: %s", err)
+	}
+}
+
+// ListenHTTP serves the HTTP proxy on addr.
+func ListenHTTP(addr string, dialer DialFunc, auth socks.Authenticator, acls *acl.T) (err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		err = fmt.Errorf("could not listen on requested tcp address %s: %w", addr, err)
+		return
+	}
+	srv := &http.Server{
+		Handler:           NewProxy(dialer, auth, acls),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			log.Fatalf("error serving HTTP proxy: %s", err)
+		}
+	}()
+	return
+}
+
+func main() {
+	// set up state API
+	state := "activating"
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("could not find own executable path: %s", err)
+	}
+	// windows...
+	exe = strings.TrimSuffix(exe, ".exe")
+	var auth socks.Authenticator
+	user, pass := os.Getenv("WIRELEAP_HTTP_USERNAME"), os.Getenv("WIRELEAP_HTTP_PASSWORD")
+	switch {
+	case user == "" && pass == "":
+		// no auth
+	case user == "" || pass == "":
+		log.Fatal("both forwarders.http.username and forwarders.http.password need to be set to enable authentication")
+	case strings.Contains(user, ":"):
+		log.Fatal("forwarders.http.username cannot contain a colon")
+	default:
+		auth = socks.StaticAuth(user, pass)
+		log.Printf("HTTP proxy authentication is enabled")
+	}
+	var acls *acl.T
+	if allow, deny := os.Getenv("WIRELEAP_HTTP_ALLOW"), os.Getenv("WIRELEAP_HTTP_DENY"); allow != "" || deny != "" {
+		if acls, err = acl.Parse(allow, deny); err != nil {
+			log.Fatalf("invalid forwarders.http access control: %s", err)
+		}
+		log.Printf("HTTP proxy access control is enabled (allow: %q, deny: %q)", allow, deny)
+	}
+	err = restapi.UnixServer(exe+".sock", provide.Routes{"/state": provide.MethodGate(provide.Routes{
+		http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			st := restapi.FwderState{State: state, Denied: acls.Denied()}
+			b, err := json.Marshal(st)
+			if err != nil {
+				log.Printf("error while serving /state reply: %s", err)
+				status.ErrInternal.WriteTo(w)
+				return
+			}
+			w.Write(b)
+		}),
+	})})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// set up graceful signal handling
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	var ok bool
+	var h2caddr, httpaddr string
+
+	if h2caddr, ok = os.LookupEnv("WIRELEAP_ADDR_H2C"); !ok {
+		log.Fatal("WIRELEAP_ADDR_H2C is not defined")
+	}
+	if httpaddr, ok = os.LookupEnv("WIRELEAP_ADDR_HTTP"); !ok {
+		log.Fatal("WIRELEAP_ADDR_HTTP is not defined")
+	}
+	h2caddr = "http://" + h2caddr
+	if err := ListenHTTP(httpaddr, dialFuncTo(h2caddr), auth, acls); err != nil {
+		log.Fatalf("listening on http://%s failed: %s", httpaddr, err)
+	}
+	log.Printf("listening for HTTP proxy connections on %s, state queries on %s", httpaddr, exe+".sock")
+	state = "active"
+	select {
+	case <-sigs:
+		state = "deactivating"
+		log.Printf("shutting down gracefully...")
+	}
+}
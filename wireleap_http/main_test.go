@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wireleap/client/acl"
+	"github.com/wireleap/client/socks"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/flushwriter"
+	"github.com/wireleap/common/wlnet/h2rwc"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// origin starts a HTTP server replying with the request headers it got.
+func origin(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// stubDialer returns a DialFunc connecting via a stand-in broker which dials
+// the requested target directly. The targets dialed are sent to dialed.
+func stubDialer(t *testing.T, dialed chan<- string) DialFunc {
+	s := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Wl-Forwarder") != "http" || r.Header.Get("Wl-Dial-Protocol") != "tcp" {
+			t.Errorf("unexpected dial headers %v", r.Header)
+		}
+		target := r.Header.Get("Wl-Dial-Target")
+		dialed <- target
+		c, err := net.Dial("tcp", target)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		wlnet.Splice(context.Background(), h2rwc.T{Writer: flushwriter.T{Writer: w}, ReadCloser: r.Body}, c, 0, 32768)
+	}), &http2.Server{}))
+	t.Cleanup(s.Close)
+	return dialFuncTo(s.URL)
+}
+
+// proxy starts a HTTP proxy server dialing via a stand-in broker.
+func proxy(t *testing.T, auth socks.Authenticator, acls *acl.T) (*url.URL, chan string) {
+	dialed := make(chan string, 16)
+	s := httptest.NewServer(NewProxy(stubDialer(t, dialed), auth, acls))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, dialed
+}
+
+func TestAbsoluteURI(t *testing.T) {
+	o := origin(t)
+	p, dialed := proxy(t, nil, nil)
+	req, err := http.NewRequest(http.MethodGet, o.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "192.168.1.2")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(p)}}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", res.Status)
+	}
+	var h http.Header
+	if err = json.NewDecoder(res.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"X-Forwarded-For", "Proxy-Connection", "Proxy-Authorization"} {
+		if v, ok := h[k]; ok {
+			t.Errorf("origin got %s: %v", k, v)
+		}
+	}
+	if v := h.Get("User-Agent"); v != "Go-http-client/1.1" {
+		t.Errorf("origin got unexpected User-Agent %q", v)
+	}
+	if got := <-dialed; got != o.Listener.Addr().String() {
+		t.Errorf("dialed %s, expected %s", got, o.Listener.Addr())
+	}
+}
+
+func TestConnect(t *testing.T) {
+	o := origin(t)
+	p, dialed := proxy(t, nil, nil)
+	c, err := net.Dial("tcp", p.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	target := o.Listener.Addr().String()
+	// the tunneled request is sent right away along with CONNECT
+	_, err = io.WriteString(c, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: "+target+"\r\nX-Forwarded-For: 192.168.1.2\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	res, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected CONNECT status %s", res.Status)
+	}
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var h http.Header
+	if err = json.NewDecoder(res.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	// CONNECT tunnels are passed through unmodified
+	if v := h.Get("X-Forwarded-For"); v != "192.168.1.2" {
+		t.Errorf("origin got unexpected X-Forwarded-For %q", v)
+	}
+	if got := <-dialed; got != target {
+		t.Errorf("dialed %s, expected %s", got, target)
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	p, _ := proxy(t, nil, nil)
+	for _, req := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET ftp://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		if code := rawStatus(t, p.Host, req); code != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, expected %d", req, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	o := origin(t)
+	p, _ := proxy(t, socks.StaticAuth("user", "pass"), nil)
+	for _, tc := range []struct {
+		user *url.Userinfo
+		code int
+	}{
+		{nil, http.StatusProxyAuthRequired},
+		{url.UserPassword("user", "wrong"), http.StatusProxyAuthRequired},
+		{url.UserPassword("other", "pass"), http.StatusProxyAuthRequired},
+		{url.UserPassword("user", "pass"), http.StatusOK},
+	} {
+		pu := *p
+		pu.User = tc.user
+		c := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&pu)}}
+		res, err := c.Get(o.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.code {
+			t.Errorf("%v: got status %s, expected %d", tc.user, res.Status, tc.code)
+		}
+		if tc.code == http.StatusProxyAuthRequired && res.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("%v: no Proxy-Authenticate header", tc.user)
+		}
+	}
+	// CONNECT requires authentication as well
+	req := "CONNECT " + o.Listener.Addr().String() + " HTTP/1.1\r\nHost: x\r\n\r\n"
+	if code := rawStatus(t, p.Host, req); code != http.StatusProxyAuthRequired {
+		t.Errorf("unauthenticated CONNECT: got status %d", code)
+	}
+}
+
+func TestACL(t *testing.T) {
+	o := origin(t)
+	for _, tc := range []struct {
+		allow, deny string
+		code        int
+	}{
+		{"", "127.0.0.1", http.StatusForbidden},
+		{"192.168.0.0/16", "", http.StatusForbidden},
+		{"127.0.0.0/8", "", http.StatusOK},
+	} {
+		acls, err := acl.Parse(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := proxy(t, nil, acls)
+		req := "CONNECT " + o.Listener.Addr().String() + " HTTP/1.1\r\nHost: x\r\n\r\n"
+		if code := rawStatus(t, p.Host, req); code != tc.code {
+			t.Errorf("allow %q deny %q: got status %d, expected %d", tc.allow, tc.deny, code, tc.code)
+		}
+		if tc.code == http.StatusForbidden && acls.Denied() != 1 {
+			t.Errorf("allow %q deny %q: %d denied", tc.allow, tc.deny, acls.Denied())
+		}
+	}
+}
+
+// rawStatus sends req to the proxy at addr and returns the response status.
+func rawStatus(t *testing.T, addr, req string) int {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = io.WriteString(c, req); err != nil {
+		t.Fatal(err)
+	}
+	method := strings.Fields(req)[0]
+	res, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/wireleap/client/restapi"
+	"github.com/wireleap/common/api/provide"
+	"github.com/wireleap/common/api/status"
+)
+
+func main() {
+	// set up state API
+	// the bypass API handler changes it as well
+	var state atomic.Value
+	state.Store("activating")
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("could not find own executable path: %s", err)
+	}
+	sh := os.Getenv("WIRELEAP_HOME")
+	h2caddr := os.Getenv("WIRELEAP_ADDR_H2C")
+	raddr := os.Getenv("WIRELEAP_ADDR_REDIRECT")
+	if sh == "" || h2caddr == "" || raddr == "" {
+		log.Fatal("Running wireleap_redirect separately from wireleap is not supported. Please use `wireleap redirect start`.")
+	}
+	addr, err := net.ResolveTCPAddr("tcp4", raddr)
+	if err != nil {
+		log.Fatalf("invalid WIRELEAP_ADDR_REDIRECT value %s: %s", raddr, err)
+	}
+	if !addr.IP.IsLoopback() {
+		// redirected connections arrive on the loopback address
+		log.Fatalf("WIRELEAP_ADDR_REDIRECT %s is not a loopback address", raddr)
+	}
+	rs := &rules{addr: addr}
+	pidfile := path.Join(sh, "wireleap_redirect.pid")
+	finalize := func() {
+		// leftover rules would blackhole traffic, so every exit path
+		// after installing them has to go through here
+		if err := rs.Down(); err != nil {
+			log.Printf("could not clean up redirect rules: %s", err)
+		}
+		os.Remove(pidfile)
+	}
+	err = restapi.UnixServer(exe+".sock", provide.Routes{
+		"/state": provide.MethodGate(provide.Routes{
+			http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				st := restapi.FwderState{State: state.Load().(string)}
+				b, err := json.Marshal(st)
+				if err != nil {
+					log.Printf("error while serving /state reply: %s", err)
+					status.ErrInternal.WriteTo(w)
+					return
+				}
+				w.Write(b)
+			}),
+		}),
+		"/bypass": provide.MethodGate(provide.Routes{
+			http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := json.Marshal(rs.Get())
+				if err != nil {
+					log.Printf("error while serving /bypass GET reply: %s", err)
+					status.ErrInternal.WriteTo(w)
+					return
+				}
+				w.Write(b)
+			}),
+			http.MethodPost: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ips := []net.IP{}
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					log.Printf("error while reading /bypass POST request body: %s", err)
+					status.ErrRequest.WriteTo(w)
+					return
+				}
+				if err = json.Unmarshal(b, &ips); err != nil {
+					log.Printf("error while unmarshaling /bypass POST request body: %s", err)
+					status.ErrRequest.WriteTo(w)
+					return
+				}
+				started, err := rs.Set(ips...)
+				if err != nil {
+					// hard fail here to avoid looping relay traffic
+					finalize()
+					log.Fatalf("could not configure bypass set: %s", err)
+				}
+				if started {
+					log.Printf("bypass set received, redirecting tcp and udp traffic to %s", raddr)
+					state.Store("active")
+				}
+				status.OK.WriteTo(w)
+			}),
+		}),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// nftables and policy routing need root
+	if err = syscall.Seteuid(0); err != nil {
+		log.Fatal("could not gain privileges; check if setuid flag is set?")
+	}
+	os.Chmod(exe+".sock", 0660)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer finalize()
+	os.Remove(pidfile)
+	if err = ioutil.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		finalize()
+		log.Fatalf("could not write pidfile %s: %s", pidfile, err)
+	}
+	// listen before redirecting anything
+	errc := make(chan error, 2)
+	if err = ListenRedirect(raddr, dialFuncTo("http://"+h2caddr), errc); err != nil {
+		finalize()
+		log.Fatal(err)
+	}
+	started, err := rs.Up()
+	if err != nil {
+		finalize()
+		log.Fatalf("could not set up redirect rules: %s", err)
+	}
+	if started {
+		log.Printf("redirecting tcp and udp traffic to %s, listening for state queries on %s", raddr, exe+".sock")
+		state.Store("active")
+	} else {
+		// nothing is redirected until the broker posts the bypass set
+		log.Printf("waiting for the bypass set before redirecting traffic to %s, listening for state queries on %s", raddr, exe+".sock")
+	}
+	for {
+		select {
+		case s := <-sig:
+			state.Store("deactivating")
+			log.Printf("terminating on signal %s", s)
+			return
+		case err = <-errc:
+			finalize()
+			log.Fatal(err)
+		}
+	}
+}
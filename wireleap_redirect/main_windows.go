@@ -0,0 +1,7 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import "log"
+
+func main() { log.Fatal("wireleap_redirect is only supported on Linux") }
@@ -0,0 +1,326 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/h2conn"
+	"golang.org/x/net/http2"
+	"golang.org/x/sys/unix"
+)
+
+// udpIdle is how long a UDP session without traffic in either direction is
+// kept open.
+const udpIdle = 2 * time.Minute
+
+// udpbufsize is the largest UDP datagram size.
+const udpbufsize = 65535
+
+var tt = &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, addr)
+	},
+	ReadIdleTimeout: 10 * time.Second,
+	PingTimeout:     10 * time.Second,
+}
+
+type DialFunc func(proto, addr string) (*h2conn.T, error)
+
+func dialFuncTo(h2caddr string) DialFunc {
+	return func(proto, addr string) (*h2conn.T, error) {
+		return h2conn.New(tt, h2caddr, map[string]string{
+			"Wl-Dial-Protocol": proto,
+			"Wl-Dial-Target":   addr,
+			"Wl-Forwarder":     "redirect",
+		})
+	}
+}
+
+// sockopt is a boolean socket option.
+type sockopt struct{ level, opt int }
+
+var (
+	ipTransparent     = sockopt{unix.SOL_IP, unix.IP_TRANSPARENT}
+	ipRecvOrigDstAddr = sockopt{unix.SOL_IP, unix.IP_RECVORIGDSTADDR}
+	soReuseAddr       = sockopt{unix.SOL_SOCKET, unix.SO_REUSEADDR}
+)
+
+// control enables socket options before binding.
+func control(opts ...sockopt) func(string, string, syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) (err error) {
+		cerr := c.Control(func(fd uintptr) {
+			for _, o := range opts {
+				if err = unix.SetsockoptInt(int(fd), o.level, o.opt, 1); err != nil {
+					err = fmt.Errorf("setsockopt %d failed: %w", o.opt, err)
+					return
+				}
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return
+	}
+}
+
+// originalDst returns the destination of a connection redirected by the
+// nat table before it was rewritten.
+func originalDst(c *net.TCPConn) (addr *net.TCPAddr, err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	var mreq *unix.IPv6Mreq
+	cerr := rc.Control(func(fd uintptr) {
+		// struct sockaddr_in fits into ipv6_mreq, which is what the
+		// helper happens to read
+		mreq, err = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get SO_ORIGINAL_DST: %w", err)
+	}
+	b := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+		Port: int(binary.BigEndian.Uint16(b[2:4])),
+	}, nil
+}
+
+// ProxyTCP accepts redirected connections on l and splices them with
+// connections to their original destinations dialed through the broker.
+func ProxyTCP(l *net.TCPListener, dialer DialFunc) error {
+	for {
+		c, err := l.AcceptTCP()
+		if err != nil {
+			return fmt.Errorf("error accepting redirected tcp connection: %w", err)
+		}
+		go func() {
+			defer c.Close()
+			dst, err := originalDst(c)
+			if err != nil {
+				log.Printf("error handling connection from %s: %s", c.RemoteAddr(), err)
+				return
+			}
+			if dst.String() == l.Addr().String() {
+				// not redirected, connected to the listener directly
+				log.Printf("rejecting direct connection from %s", c.RemoteAddr())
+				return
+			}
+			c1, err := dialer("tcp", dst.String())
+			if err != nil {
+				log.Printf("error dialing tcp %s->%s through the circuit: %s", c.RemoteAddr(), dst, err)
+				return
+			}
+			defer c1.Close()
+			if err = wlnet.Splice(context.Background(), c, c1, 0, 32768); err != nil {
+				log.Printf("error splicing tcp %s->%s: %s", c.RemoteAddr(), dst, err)
+			}
+		}()
+	}
+}
+
+// udpSession is a flow of datagrams between a local source and a single
+// original destination.
+type udpSession struct {
+	src, dst *net.UDPAddr
+	used     time.Time
+	q        chan []byte
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (s *udpSession) close() { s.once.Do(func() { close(s.done) }) }
+
+// udpProxy relays datagrams diverted by tproxy through the broker.
+type udpProxy struct {
+	l        *net.UDPConn
+	dialer   DialFunc
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// ProxyUDP reads tproxied datagrams from l and relays them via per-source and
+// destination sessions.
+func ProxyUDP(l *net.UDPConn, dialer DialFunc) error {
+	t := &udpProxy{l: l, dialer: dialer, sessions: map[string]*udpSession{}}
+	go func() {
+		for range time.Tick(udpIdle / 4) {
+			t.expire()
+		}
+	}()
+	var (
+		buf = make([]byte, udpbufsize)
+		oob = make([]byte, 64)
+	)
+	for {
+		n, oobn, _, src, err := l.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return fmt.Errorf("error reading tproxied udp datagram: %w", err)
+		}
+		dst, err := origDstAddr(oob[:oobn])
+		if err != nil {
+			log.Printf("dropping datagram from %s: %s", src, err)
+			continue
+		}
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		s := t.session(src, dst)
+		select {
+		case s.q <- p:
+		default:
+			log.Printf("dropping datagram %s->%s: queue full", src, dst)
+		}
+	}
+}
+
+// origDstAddr parses the original destination from IP_RECVORIGDSTADDR
+// control messages.
+func origDstAddr(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level != unix.SOL_IP || m.Header.Type != unix.IP_ORIGDSTADDR {
+			continue
+		}
+		sa, err := unix.ParseOrigDstAddr(&m)
+		if err != nil {
+			return nil, err
+		}
+		if sa4, ok := sa.(*unix.SockaddrInet4); ok {
+			return &net.UDPAddr{IP: net.IP(sa4.Addr[:]).To16(), Port: sa4.Port}, nil
+		}
+	}
+	return nil, fmt.Errorf("no original destination address")
+}
+
+func (t *udpProxy) session(src, dst *net.UDPAddr) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := src.String() + "->" + dst.String()
+	if s := t.sessions[k]; s != nil {
+		s.used = time.Now()
+		return s
+	}
+	s := &udpSession{
+		src:  src,
+		dst:  dst,
+		used: time.Now(),
+		q:    make(chan []byte, 64),
+		done: make(chan struct{}),
+	}
+	t.sessions[k] = s
+	go t.run(k, s)
+	return s
+}
+
+func (t *udpProxy) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, s := range t.sessions {
+		if time.Since(s.used) > udpIdle {
+			delete(t.sessions, k)
+			s.close()
+		}
+	}
+}
+
+func (t *udpProxy) touch(s *udpSession) {
+	t.mu.Lock()
+	s.used = time.Now()
+	t.mu.Unlock()
+}
+
+// run dials the tunnel of s and relays datagrams in both directions. Replies
+// are sent from a transparent socket bound to the original destination so
+// they reach the client as if they came from there.
+func (t *udpProxy) run(k string, s *udpSession) {
+	defer func() {
+		t.mu.Lock()
+		if t.sessions[k] == s {
+			delete(t.sessions, k)
+		}
+		t.mu.Unlock()
+		s.close()
+	}()
+	conn, err := t.dialer("udp", s.dst.String())
+	if err != nil {
+		log.Printf("error dialing udp %s->%s through the circuit: %s", s.src, s.dst, err)
+		return
+	}
+	defer conn.Close()
+	lc := net.ListenConfig{Control: control(ipTransparent, soReuseAddr)}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", s.dst.String())
+	if err != nil {
+		log.Printf("error binding reply socket for udp %s->%s: %s", s.src, s.dst, err)
+		return
+	}
+	defer pc.Close()
+	go func() {
+		defer s.close()
+		obuf := make([]byte, udpbufsize)
+		for {
+			n, err := conn.Read(obuf)
+			if err != nil {
+				select {
+				case <-s.done:
+				default:
+					if err != io.EOF {
+						log.Printf("error reading %s<-%s via udp: %s", s.src, s.dst, err)
+					}
+				}
+				return
+			}
+			t.touch(s)
+			if _, err = pc.WriteTo(obuf[:n], s.src); err != nil {
+				log.Printf("error writing %s<-%s via udp: %s", s.src, s.dst, err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case p := <-s.q:
+			if _, err = conn.Write(p); err != nil {
+				log.Printf("error writing %s->%s via udp: %s", s.src, s.dst, err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// ListenRedirect sets up the tcp and tproxy udp listeners on addr. Errors
+// which stop either of them are sent to errc.
+func ListenRedirect(addr string, dialer DialFunc, errc chan<- error) (err error) {
+	tl, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on requested tcp address %s: %w", addr, err)
+	}
+	lc := net.ListenConfig{Control: control(ipTransparent, ipRecvOrigDstAddr)}
+	ul, err := lc.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		tl.Close()
+		return fmt.Errorf("could not listen on requested udp address %s: %w", addr, err)
+	}
+	go func() { errc <- ProxyTCP(tl.(*net.TCPListener), dialer) }()
+	go func() { errc <- ProxyUDP(ul.(*net.UDPConn), dialer) }()
+	return
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftables table holding all rules
+	table = "wireleap"
+	// firewall mark of udp packets to be diverted to the tproxy listener
+	tproxyMark = 0x1349
+	// routing table delivering marked packets locally
+	routeTable = 1349
+)
+
+// excluded are the destinations never redirected in addition to local
+// addresses and the bypass set: private, link-local and multicast ranges
+// which the exit relay cannot reach on our behalf anyway.
+var excluded = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255",
+}
+
+// rules manages the nftables rules and policy routing diverting traffic to
+// the redirect listener, along with the set of bypassed addresses.
+type rules struct {
+	addr *net.TCPAddr
+	mu   sync.Mutex
+	m    []net.IP
+	rule *netlink.Rule
+	rt   *netlink.Route
+	// up is set once the table is installed, hooked once the chains
+	// diverting traffic are
+	up, hooked bool
+}
+
+// nft runs the nft command with script as input.
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft failed: %w: %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// script returns the nftables script setting up the redirect table. It does
+// not divert anything yet as the chains are not hooked.
+func (t *rules) script() string {
+	return fmt.Sprintf(`table ip %[1]s
+delete table ip %[1]s
+table ip %[1]s {
+	set bypass {
+		type ipv4_addr
+	}
+	chain exclude {
+		fib daddr type { local, broadcast, multicast } accept
+		ip daddr { %[2]s } accept
+		ip daddr @bypass accept
+	}
+}
+`, table, strings.Join(excluded, ", "))
+}
+
+// hooks returns the nftables script adding the chains diverting traffic to
+// the redirect listener.
+func (t *rules) hooks() string {
+	return fmt.Sprintf(`table ip %[1]s {
+	chain output_tcp {
+		type nat hook output priority -100; policy accept;
+		meta l4proto tcp jump exclude
+		meta l4proto tcp redirect to :%[2]d
+	}
+	chain output_udp {
+		type route hook output priority -150; policy accept;
+		meta l4proto udp jump exclude
+		meta l4proto udp meta mark set %#[3]x
+	}
+	chain prerouting_udp {
+		type filter hook prerouting priority -150; policy accept;
+		meta l4proto udp meta mark %#[3]x tproxy to %[4]s
+	}
+}
+`, table, t.addr.Port, tproxyMark, t.addr)
+}
+
+// setScript returns the nftables script replacing the bypass set with the
+// IPv4 addresses among ips and whether it contains any. Traffic is diverted
+// only once the bypass set is populated, as the relay, contract and
+// directory traffic of the broker would loop back into the listener
+// otherwise, so the chains are hooked in the same transaction then.
+func (t *rules) setScript(ips []net.IP) (script string, populated bool) {
+	var elems []string
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			elems = append(elems, ip4.String())
+		}
+	}
+	script = fmt.Sprintf("flush set ip %s bypass\n", table)
+	if len(elems) == 0 {
+		return script, false
+	}
+	script += fmt.Sprintf("add element ip %s bypass { %s }\n", table, strings.Join(elems, ", "))
+	if !t.hooked {
+		script += t.hooks()
+	}
+	return script, true
+}
+
+// Up installs the policy routing needed for tproxy and the redirect table.
+// Traffic is only diverted if a non-empty bypass set was passed to Set
+// already, which is reported by started.
+func (t *rules) Up() (started bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		return false, fmt.Errorf("could not get loopback link: %w", err)
+	}
+	t.rule = netlink.NewRule()
+	t.rule.Family = netlink.FAMILY_V4
+	t.rule.Mark = tproxyMark
+	t.rule.Table = routeTable
+	if err = netlink.RuleAdd(t.rule); err != nil {
+		t.rule = nil
+		return false, fmt.Errorf("could not add fwmark %#x routing rule: %w", tproxyMark, err)
+	}
+	t.rt = &netlink.Route{
+		LinkIndex: lo.Attrs().Index,
+		Dst:       &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+		Table:     routeTable,
+		Type:      unix.RTN_LOCAL,
+		Scope:     netlink.SCOPE_HOST,
+	}
+	if err = netlink.RouteReplace(t.rt); err != nil {
+		t.rt = nil
+		return false, fmt.Errorf("could not add local route to table %d: %w", routeTable, err)
+	}
+	setup, populated := t.setScript(t.m)
+	if err = nft(t.script() + setup); err != nil {
+		return false, err
+	}
+	t.up, t.hooked = true, populated
+	return populated, nil
+}
+
+// Set replaces the bypass set with ips. Only IPv4 addresses are kept as
+// IPv6 traffic is not redirected. The first non-empty set after Up starts
+// diverting traffic, which is reported by started.
+func (t *rules) Set(ips ...net.IP) (started bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.up {
+		// applied by Up
+		t.m = ips
+		return false, nil
+	}
+	script, populated := t.setScript(ips)
+	if err = nft(script); err != nil {
+		return false, err
+	}
+	t.m = ips
+	started = populated && !t.hooked
+	t.hooked = t.hooked || populated
+	return
+}
+
+func (t *rules) Get() []net.IP {
+	t.mu.Lock()
+	r := make([]net.IP, len(t.m))
+	copy(r, t.m)
+	t.mu.Unlock()
+	return r
+}
+
+// Down removes everything installed by Up.
+func (t *rules) Down() (err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.m = []net.IP{}
+	t.up, t.hooked = false, false
+	if err = nft(fmt.Sprintf("table ip %[1]s\ndelete table ip %[1]s\n", table)); err != nil {
+		err = fmt.Errorf("could not remove nftables rules: %w", err)
+	}
+	if t.rt != nil {
+		if err2 := netlink.RouteDel(t.rt); err2 != nil && err == nil {
+			err = fmt.Errorf("could not remove local route from table %d: %w", routeTable, err2)
+		}
+		t.rt = nil
+	}
+	if t.rule != nil {
+		if err2 := netlink.RuleDel(t.rule); err2 != nil && err == nil {
+			err = fmt.Errorf("could not remove fwmark %#x routing rule: %w", tproxyMark, err2)
+		}
+		t.rule = nil
+	}
+	return
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testRules() *rules {
+	return &rules{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 13494}}
+}
+
+func TestScript(t *testing.T) {
+	rs := testRules()
+	s := rs.script()
+	for _, want := range []string{
+		"delete table ip wireleap\n",
+		"set bypass {",
+		"ip daddr @bypass accept",
+		"127.0.0.0/8, 169.254.0.0/16",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("table script does not contain %q:\n%s", want, s)
+		}
+	}
+	// nothing is diverted before the bypass set is known
+	if strings.Contains(s, "hook") {
+		t.Errorf("table script hooks chains:\n%s", s)
+	}
+	h := rs.hooks()
+	for _, want := range []string{
+		"meta l4proto tcp jump exclude\n\t\tmeta l4proto tcp redirect to :13494\n",
+		"meta l4proto udp jump exclude\n\t\tmeta l4proto udp meta mark set 0x1349\n",
+		"meta l4proto udp meta mark 0x1349 tproxy to 127.0.0.1:13494\n",
+	} {
+		if !strings.Contains(h, want) {
+			t.Errorf("hooks script does not contain %q:\n%s", want, h)
+		}
+	}
+	if strings.Contains(h, "delete") || strings.Contains(h, "set bypass") {
+		t.Errorf("hooks script replaces the table:\n%s", h)
+	}
+}
+
+func TestSetScript(t *testing.T) {
+	rs := testRules()
+	// no IPv4 addresses: flushed, not hooked
+	for _, ips := range [][]net.IP{nil, {net.ParseIP("fd00::1")}} {
+		s, populated := rs.setScript(ips)
+		if populated || s != "flush set ip wireleap bypass\n" {
+			t.Errorf("%v: unexpected script (populated %v):\n%s", ips, populated, s)
+		}
+	}
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("fd00::1"), net.IPv4(198, 51, 100, 2).To4()}
+	s, populated := rs.setScript(ips)
+	if !populated {
+		t.Error("set with IPv4 addresses is not populated")
+	}
+	elems := "add element ip wireleap bypass { 192.0.2.1, 198.51.100.2 }\n"
+	if !strings.HasPrefix(s, "flush set ip wireleap bypass\n"+elems) {
+		t.Errorf("unexpected set script:\n%s", s)
+	}
+	// hooked in the same transaction, after the elements are added
+	if !strings.HasSuffix(s, rs.hooks()) {
+		t.Errorf("first populated set does not hook chains:\n%s", s)
+	}
+	rs.hooked = true
+	if s, _ = rs.setScript(ips); s != "flush set ip wireleap bypass\n"+elems {
+		t.Errorf("chains hooked again:\n%s", s)
+	}
+}
+
+func TestSetBeforeUp(t *testing.T) {
+	rs := testRules()
+	ips := []net.IP{net.ParseIP("192.0.2.1")}
+	// kept for Up without running nft
+	started, err := rs.Set(ips...)
+	if err != nil || started {
+		t.Fatalf("Set before Up: started %v, err %v", started, err)
+	}
+	if got := rs.Get(); len(got) != 1 || !got[0].Equal(ips[0]) {
+		t.Errorf("bypass set not kept: %v", got)
+	}
+}
+
+func TestScriptSyntax(t *testing.T) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft not available")
+	}
+	rs := testRules()
+	setup, _ := rs.setScript([]net.IP{net.ParseIP("192.0.2.1")})
+	cmd := exec.Command("nft", "-c", "-f", "-")
+	cmd.Stdin = strings.NewReader(rs.script() + setup)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if strings.Contains(string(out), "Operation not permitted") {
+			t.Skipf("nft -c needs privileges: %s", out)
+		}
+		t.Errorf("nft rejected the script: %s: %s", err, out)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/wireleap/client/clientlib"
+	"github.com/wireleap/client/socks"
+	"github.com/wireleap/common/api/jsonb"
+	"github.com/wireleap/common/api/relayentry"
+	"github.com/wireleap/common/api/servicekey"
+	"github.com/wireleap/common/api/status"
+	"github.com/wireleap/common/api/texturl"
+	"github.com/wireleap/common/wlnet"
+	"github.com/wireleap/common/wlnet/flushwriter"
+	"github.com/wireleap/common/wlnet/h2conn"
+	"github.com/wireleap/common/wlnet/h2rwc"
+	"github.com/wireleap/common/wlnet/transport"
+)
+
+// behaviours of the stand-in exit relay
+const (
+	// supports BIND
+	bindOK = iota
+	// supports BIND but fails to listen
+	bindFailed
+	// rejects the unknown command like relays checking commands do
+	bindRejected
+	// ignores the command and connects to the peer address like older
+	// relays do, which sends data which is no SOCKSv5 reply
+	bindIgnored
+)
+
+// standinRelay starts an exit relay handling BIND as given by mode.
+func standinRelay(t *testing.T, mode int) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Trailer", status.Header)
+		c := h2rwc.T{Writer: flushwriter.T{Writer: w}, ReadCloser: r.Body}
+		defer c.Close()
+		p, err := wlnet.InitFromHeaders(r.Header)
+		if err != nil {
+			t.Errorf("stand-in relay: %s", err)
+			return
+		}
+		reply := func(st socks.SocksStatus, a net.Addr) {
+			c.Write(append([]byte{socks.SOCKSv5, byte(st), socks.RSV}, socks.AddrAddr(a)...))
+		}
+		switch {
+		case mode == bindIgnored:
+			c.Write([]byte("220 FTP server ready\r\n"))
+			return
+		case mode == bindRejected || p.Command != "BIND":
+			(&status.T{
+				Code:   http.StatusBadRequest,
+				Desc:   "unknown command in payload: " + p.Command,
+				Origin: "stand-in",
+			}).ToHeader(h)
+			return
+		case mode == bindFailed:
+			reply(socks.StatusGeneralFailure, &net.TCPAddr{IP: net.IPv4zero})
+			return
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Errorf("stand-in relay: %s", err)
+			return
+		}
+		defer l.Close()
+		reply(socks.StatusOK, l.Addr())
+		pc, err := l.Accept()
+		if err != nil {
+			t.Errorf("stand-in relay: %s", err)
+			return
+		}
+		reply(socks.StatusOK, pc.RemoteAddr())
+		wlnet.Splice(context.Background(), c, pc, 0, 32768)
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// socksVia starts a SOCKS forwarder dialing through a single-hop circuit
+// consisting of the relay at relayURL and returns its address.
+func socksVia(t *testing.T, relayURL string) string {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "wireleap"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		sk    = servicekey.New(priv)
+		relay = &relayentry.T{Role: "backing", Addr: &texturl.URL{URL: *u}, Pubkey: jsonb.PK(pub)}
+		tt    = transport.New(transport.Options{Timeout: 5 * time.Second})
+	)
+	dialer := clientlib.CircuitCommandDialer(
+		func() (*servicekey.T, error) { return sk, nil },
+		func() ([]*relayentry.T, error) { return []*relayentry.T{relay}, nil },
+		tt.DialWL,
+	)
+	dialf := func(cmd, proto, addr, _ string) (*h2conn.T, error) {
+		c, err := dialer(cmd, proto, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c.(*h2conn.T), nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go ProxyTCP(l, dialf, l.Addr(), nil, nil, nil)
+	return l.Addr().String()
+}
+
+// socksBind sends a BIND request for a peer at 192.0.2.1:20 to the SOCKS
+// server at addr and returns the connection.
+func socksBind(t *testing.T, addr string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	c.Write([]byte{socks.SOCKSv5, 1, 0})
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(c, b); err != nil || b[1] != 0 {
+		t.Fatalf("method selection failed: %v %v", b, err)
+	}
+	c.Write(append([]byte{socks.SOCKSv5, socks.BIND, socks.RSV}, socks.AddrIPPort(net.ParseIP("192.0.2.1"), 20)...))
+	return c
+}
+
+func TestBind(t *testing.T) {
+	c := socksBind(t, socksVia(t, standinRelay(t, bindOK).URL))
+	st, la, err := socks.ReadReply(c)
+	if err != nil || st != socks.StatusOK {
+		t.Fatalf("first reply: %s %v", st, err)
+	}
+	// the peer connects to the address the relay listens on
+	pc, err := net.Dial("tcp", la.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(10 * time.Second))
+	st, pa, err := socks.ReadReply(c)
+	if err != nil || st != socks.StatusOK {
+		t.Fatalf("second reply: %s %v", st, err)
+	}
+	if pa.String() != pc.LocalAddr().String() {
+		t.Errorf("peer address %s, want %s", pa, pc.LocalAddr())
+	}
+	// data flows both ways
+	for _, dir := range []struct {
+		from, to net.Conn
+		msg      string
+	}{
+		{pc, c, "from peer"},
+		{c, pc, "to peer"},
+	} {
+		if _, err = dir.from.Write([]byte(dir.msg)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(dir.msg))
+		if _, err = io.ReadFull(dir.to, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != dir.msg {
+			t.Errorf("got %q, want %q", b, dir.msg)
+		}
+	}
+}
+
+func TestBindFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		mode int
+		want socks.SocksStatus
+	}{
+		{"failed", bindFailed, socks.StatusGeneralFailure},
+		{"rejected", bindRejected, socks.StatusCommandNotSupported},
+		{"ignored", bindIgnored, socks.StatusCommandNotSupported},
+	} {
+		c := socksBind(t, socksVia(t, standinRelay(t, tc.mode).URL))
+		if st, _, err := socks.ReadReply(c); err != nil || st != tc.want {
+			t.Errorf("%s: got reply %s %v, want %s", tc.name, st, err, tc.want)
+		}
+	}
+}
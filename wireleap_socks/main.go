@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +18,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/wireleap/client/acl"
 	"github.com/wireleap/client/restapi"
 	"github.com/wireleap/client/socks"
 	"github.com/wireleap/common/api/provide"
@@ -26,7 +28,8 @@ import (
 	"golang.org/x/net/http2"
 )
 
-const udpbufsize = 4096 // change if bigger datagrams are expected
+// udpbufsize is the largest UDP datagram size.
+const udpbufsize = 65535
 
 var tt = &http2.Transport{
 	AllowHTTP: true,
@@ -37,20 +40,29 @@ var tt = &http2.Transport{
 	PingTimeout:     10 * time.Second,
 }
 
-type DialFunc func(string, string) (*h2conn.T, error)
+type DialFunc func(cmd, proto, addr, isolation string) (*h2conn.T, error)
 
 func dialFuncTo(h2caddr string) DialFunc {
-	return func(proto, addr string) (*h2conn.T, error) {
-		return h2conn.New(tt, h2caddr, map[string]string{
+	return func(cmd, proto, addr, isolation string) (*h2conn.T, error) {
+		hdrs := map[string]string{
+			"Wl-Dial-Command":  cmd,
 			"Wl-Dial-Protocol": proto,
 			"Wl-Dial-Target":   addr,
 			"Wl-Forwarder":     "socks",
-		})
+		}
+		if isolation != "" {
+			// pin connections from distinct socks usernames to distinct circuits
+			hdrs["Wl-Isolation"] = isolation
+		}
+		return h2conn.New(tt, h2caddr, hdrs)
 	}
 }
 
 // handle everything SOCKSv5-related on the same address
-func ListenSOCKS(addr string, dialer DialFunc) (err error) {
+// if auth is not nil, clients are required to authenticate and udp packets
+// are only accepted from hosts which did so when associating
+// connections and packets from sources not permitted by acls are dropped
+func ListenSOCKS(addr string, dialer DialFunc, auth socks.Authenticator, acls *acl.T) (err error) {
 	var udpl net.PacketConn
 	var tcpl net.Listener
 	udpl, err = net.ListenPacket("udp", addr)
@@ -63,13 +75,14 @@ func ListenSOCKS(addr string, dialer DialFunc) (err error) {
 		err = fmt.Errorf("could not listen on requested tcp address %s: %w", addr, err)
 		return
 	}
-	go ProxyUDP(udpl, dialer)
-	go ProxyTCP(tcpl, dialer, udpl.LocalAddr())
+	assocs := newUDPAssocs(udpl, dialer, auth != nil)
+	go ProxyUDP(udpl, assocs, acls)
+	go ProxyTCP(tcpl, dialer, udpl.LocalAddr(), auth, assocs, acls)
 	return
 }
 
 // handle TCP socks connections
-func ProxyTCP(l net.Listener, dialer DialFunc, udpaddr net.Addr) {
+func ProxyTCP(l net.Listener, dialer DialFunc, udpaddr net.Addr, auth socks.Authenticator, assocs *udpAssocs, acls *acl.T) {
 	pause := 1 * time.Second
 	for {
 		c0, err := l.Accept()
@@ -78,9 +91,14 @@ func ProxyTCP(l net.Listener, dialer DialFunc, udpaddr net.Addr) {
 			time.Sleep(pause)
 			continue
 		}
+		if !acls.Permits(c0.RemoteAddr().(*net.TCPAddr).IP) {
+			acls.Reject("SOCKSv5 tcp connection", c0.RemoteAddr())
+			c0.Close()
+			continue
+		}
 		go func() {
 			log.Printf("SOCKSv5 tcp socket accepted: %s -> %s", c0.RemoteAddr(), c0.LocalAddr())
-			cmd, addr, err := socks.Handshake(c0)
+			ver, cmd, addr, user, err := socks.Handshake(c0, auth)
 			if err != nil {
 				log.Printf("SOCKSv5 tcp socket handshake error: %s", err)
 				c0.Close()
@@ -89,18 +107,53 @@ func ProxyTCP(l net.Listener, dialer DialFunc, udpaddr net.Addr) {
 			switch cmd {
 			case socks.CONNECT:
 				defer c0.Close()
-				c1, err := dialer("tcp", addr)
+				c1, err := dialer("CONNECT", "tcp", addr, user)
 				if err != nil {
 					log.Printf("error dialing tcp through the circuit: %s", err)
-					socks.WriteStatus(c0, socks.StatusGeneralFailure, socks.AddrAddr(c0.LocalAddr()))
+					socks.WriteReply(c0, ver, socks.StatusGeneralFailure, socks.AddrAddr(c0.LocalAddr()))
 					return
 				}
-				socks.WriteStatus(c0, socks.StatusOK, socks.AddrAddr(c0.LocalAddr()))
+				socks.WriteReply(c0, ver, socks.StatusOK, socks.AddrAddr(c0.LocalAddr()))
 				if err = wlnet.Splice(context.Background(), c0, c1, 0, 32768); err != nil {
 					log.Printf("error splicing initial connection: %s", err)
 				}
+			case socks.BIND:
+				defer c0.Close()
+				c1, err := dialer("BIND", "tcp", addr, user)
+				if err != nil {
+					log.Printf("error dialing tcp bind through the circuit: %s", err)
+					socks.WriteStatus(c0, socks.StatusGeneralFailure, socks.AddrAddr(c0.LocalAddr()))
+					return
+				}
+				defer c1.Close()
+				// the exit relay sends a reply carrying the address it
+				// listens on and, once a connection from the peer was
+				// accepted, another one carrying the peer address
+				for i, what := range []string{"listening", "peer"} {
+					st, a, err := socks.ReadReply(c1)
+					if err != nil {
+						log.Printf("error reading %s reply of tcp bind to %s: %s", what, addr, err)
+						st = socks.StatusGeneralFailure
+						if i == 0 {
+							st = bindStatus(err)
+						}
+						socks.WriteStatus(c0, st, socks.AddrAddr(c0.LocalAddr()))
+						return
+					}
+					if _, err = socks.WriteStatus(c0, st, a); err != nil || st != socks.StatusOK {
+						return
+					}
+				}
+				if err = wlnet.Splice(context.Background(), c0, c1, 0, 32768); err != nil {
+					log.Printf("error splicing bound connection: %s", err)
+				}
 			case socks.UDP_ASSOC:
+				defer c0.Close()
+				a := assocs.associate(c0.RemoteAddr().(*net.TCPAddr).IP, user, addr)
 				socks.WriteStatus(c0, socks.StatusOK, socks.AddrAddr(udpaddr))
+				// association lasts as long as the control connection
+				io.Copy(io.Discard, c0)
+				assocs.release(a)
 			default:
 				socks.WriteStatus(c0, socks.StatusCommandNotSupported, socks.AddrAddr(l.Addr()))
 				c0.Close()
@@ -109,59 +162,67 @@ func ProxyTCP(l net.Listener, dialer DialFunc, udpaddr net.Addr) {
 	}
 }
 
+// bindStatus returns the status to reply to a BIND request with when reading
+// the first reply of the exit relay failed with err. Relays supporting BIND
+// always reply, so the stream ending without one means the relay rejected
+// the unknown command (its status does not always make it through as the
+// stream is reset). Older relays ignore the command and connect to the peer
+// address instead, in which case the data read is no reply.
+func bindStatus(err error) socks.SocksStatus {
+	var (
+		st  *status.T
+		ser http2.StreamError
+	)
+	switch {
+	case errors.Is(err, socks.ErrNotReply):
+		return socks.StatusCommandNotSupported
+	case errors.As(err, &st):
+		if st.Code == http.StatusNotImplemented || (st.Code == http.StatusBadRequest && strings.Contains(st.Desc, "unknown command")) {
+			return socks.StatusCommandNotSupported
+		}
+		return socks.StatusGeneralFailure
+	case errors.As(err, &ser) && ser.Code == http2.ErrCodeNo, errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return socks.StatusCommandNotSupported
+	default:
+		return socks.StatusGeneralFailure
+	}
+}
+
 // handle UDP packets
-func ProxyUDP(l net.PacketConn, dialer DialFunc) {
+func ProxyUDP(l net.PacketConn, assocs *udpAssocs, acls *acl.T) {
 	l.(*net.UDPConn).SetWriteBuffer(2147483647)
 	l.(*net.UDPConn).SetReadBuffer(2147483647)
+	ibuf := make([]byte, udpbufsize)
 	for {
-		ibuf, obuf := make([]byte, udpbufsize), make([]byte, udpbufsize)
 		n, laddr, err := l.ReadFrom(ibuf)
 		if err != nil {
 			log.Printf("error while reading udp packet from %s: %s", laddr, err)
 			continue
 		}
-		go func() {
-			dstaddr, data, err := socks.DissectUDP(ibuf[:n])
-			if err != nil {
-				log.Printf("SOCKSv5 failed dissecting UDP packet: %s", err)
-				return
-			}
-			conn, err := dialer("udp", dstaddr.String())
-			if err != nil {
-				log.Printf(
-					"error dialing udp %s->%s->%s through the circuit: %s",
-					laddr, l.LocalAddr(), dstaddr, err,
-				)
-				return
-			}
-			_, err = conn.Write(data)
-			if err != nil {
-				log.Printf(
-					"error when writing initial data to %s->%s->%s udp tunnel: %s",
-					laddr, l.LocalAddr(), dstaddr, err,
-				)
-				return
-			}
-			for {
-				n, err := conn.Read(obuf)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("error reading %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
-					}
-					break
-				}
-				b, err := socks.ComposeUDP(dstaddr, obuf[:n])
-				if err != nil {
-					log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
-					break
-				}
-				_, err = l.WriteTo(b, laddr)
-				if err != nil {
-					log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, l.LocalAddr(), dstaddr, err)
-					break
-				}
-			}
-		}()
+		if !acls.Permits(laddr.(*net.UDPAddr).IP) {
+			acls.Reject("SOCKSv5 udp packet", laddr)
+			continue
+		}
+		a, err := assocs.find(laddr.(*net.UDPAddr))
+		if err != nil {
+			log.Printf("SOCKSv5 udp packet from %s dropped: %s", laddr, err)
+			continue
+		}
+		dstaddr, data, err := a.frags.Add(ibuf[:n])
+		if err != nil {
+			log.Printf("SOCKSv5 failed dissecting UDP packet: %s", err)
+			continue
+		}
+		if data == nil {
+			// fragment of an incomplete datagram
+			continue
+		}
+		s := assocs.session(a, dstaddr)
+		select {
+		case s.q <- append([]byte(nil), data...):
+		default:
+			log.Printf("SOCKSv5 udp queue for %s->%s full, dropping packet", laddr, dstaddr)
+		}
 	}
 }
 
@@ -174,9 +235,29 @@ func main() {
 	}
 	// windows...
 	exe = strings.TrimSuffix(exe, ".exe")
+	var auth socks.Authenticator
+	user, pass := os.Getenv("WIRELEAP_SOCKS_USERNAME"), os.Getenv("WIRELEAP_SOCKS_PASSWORD")
+	switch {
+	case user == "" && pass == "":
+		// no auth
+	case user == "" || pass == "":
+		log.Fatal("both forwarders.socks.username and forwarders.socks.password need to be set to enable authentication")
+	case len(user) > 255 || len(pass) > 255:
+		log.Fatal("forwarders.socks.username and forwarders.socks.password can be at most 255 bytes long")
+	default:
+		auth = socks.StaticAuth(user, pass)
+		log.Printf("SOCKSv5 username/password authentication is enabled")
+	}
+	var acls *acl.T
+	if allow, deny := os.Getenv("WIRELEAP_SOCKS_ALLOW"), os.Getenv("WIRELEAP_SOCKS_DENY"); allow != "" || deny != "" {
+		if acls, err = acl.Parse(allow, deny); err != nil {
+			log.Fatalf("invalid forwarders.socks access control: %s", err)
+		}
+		log.Printf("SOCKSv5 access control is enabled (allow: %q, deny: %q)", allow, deny)
+	}
 	err = restapi.UnixServer(exe+".sock", provide.Routes{"/state": provide.MethodGate(provide.Routes{
 		http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			st := restapi.FwderState{State: state}
+			st := restapi.FwderState{State: state, Denied: acls.Denied()}
 			b, err := json.Marshal(st)
 			if err != nil {
 				log.Printf("error while serving /state reply: %s", err)
@@ -203,7 +284,7 @@ func main() {
 		log.Fatal("WIRELEAP_ADDR_SOCKS is not defined")
 	}
 	h2caddr = "http://" + h2caddr
-	if err := ListenSOCKS(socksaddr, dialFuncTo(h2caddr)); err != nil {
+	if err := ListenSOCKS(socksaddr, dialFuncTo(h2caddr), auth, acls); err != nil {
 		log.Fatalf("listening on socks5://%s failed: %s", socksaddr, err)
 	}
 	log.Printf("listening for SOCKSv5 connections on %s, state queries on %s", socksaddr, exe+".sock")
@@ -0,0 +1,289 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wireleap/client/socks"
+	"github.com/wireleap/common/wlnet/h2conn"
+)
+
+// udpIdle is how long a UDP session without traffic in either direction is
+// kept open.
+const udpIdle = 2 * time.Minute
+
+// udpQueueLen is how many datagrams are buffered per session, e.g. while its
+// tunnel is being dialed. Datagrams exceeding it are dropped.
+const udpQueueLen = 64
+
+// udpAssoc is a SOCKSv5 UDP association. It lasts as long as the TCP control
+// connection which requested it.
+type udpAssoc struct {
+	// socks username used when associating
+	user string
+	// client host the association was requested from
+	ip net.IP
+	// address datagrams are expected from; if the client did not specify
+	// it when associating, it is bound to the source of the first datagram
+	addr *net.UDPAddr
+	// whether the association was created by a datagram without control
+	// connection, only possible if authentication is disabled
+	implicit bool
+	// sessions by destination address
+	sessions map[string]*udpSession
+	// reassembly queue for fragmented datagrams
+	frags socks.Reassembler
+}
+
+// udpSession is a flow of datagrams between an association and a single
+// destination, all of which are tunneled via the same connection.
+type udpSession struct {
+	// unix nanoseconds of last activity, accessed atomically
+	used int64
+	a    *udpAssoc
+	dst  socks.Addr
+	q    chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *udpSession) touch() { atomic.StoreInt64(&s.used, time.Now().UnixNano()) }
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.used)))
+}
+
+// udpAssocs keeps track of the UDP associations and their sessions.
+type udpAssocs struct {
+	mu     sync.Mutex
+	assocs []*udpAssoc
+	// udp socket datagrams are received and replied on
+	l      net.PacketConn
+	dialer DialFunc
+	// whether datagrams are only accepted for associations created via an
+	// authenticated control connection
+	enforce bool
+}
+
+func newUDPAssocs(l net.PacketConn, dialer DialFunc, enforce bool) (t *udpAssocs) {
+	t = &udpAssocs{l: l, dialer: dialer, enforce: enforce}
+	go func() {
+		for range time.Tick(udpIdle / 4) {
+			t.expire()
+		}
+	}()
+	return
+}
+
+// associate creates a new association for a control connection from ip
+// authenticated as user. expected is the address the client announced it
+// would send datagrams from, "" if unknown.
+func (t *udpAssocs) associate(ip net.IP, user, expected string) *udpAssoc {
+	a := &udpAssoc{user: user, ip: ip, sessions: map[string]*udpSession{}}
+	if _, portstr, err := net.SplitHostPort(expected); err == nil {
+		// the announced host is not trusted, datagrams have to come from
+		// the host which associated
+		if port, err := strconv.Atoi(portstr); err == nil && port != 0 {
+			a.addr = &net.UDPAddr{IP: ip, Port: port}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.assocs = append(t.assocs, a)
+	return a
+}
+
+// release removes an association and closes all of its sessions.
+func (t *udpAssocs) release(a *udpAssoc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(a)
+}
+
+// remove removes an association and closes all of its sessions. It expects
+// t.mu to be held.
+func (t *udpAssocs) remove(a *udpAssoc) {
+	for i, b := range t.assocs {
+		if a == b {
+			t.assocs = append(t.assocs[:i], t.assocs[i+1:]...)
+			break
+		}
+	}
+	for k, s := range a.sessions {
+		delete(a.sessions, k)
+		s.once.Do(func() { close(s.done) })
+	}
+}
+
+// find returns the association datagrams from laddr belong to.
+func (t *udpAssocs) find(laddr *net.UDPAddr) (*udpAssoc, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var unbound []*udpAssoc
+	for _, a := range t.assocs {
+		switch {
+		case a.addr != nil && a.addr.IP.Equal(laddr.IP) && a.addr.Port == laddr.Port:
+			return a, nil
+		case a.addr == nil && a.ip.Equal(laddr.IP):
+			unbound = append(unbound, a)
+		}
+	}
+	if len(unbound) == 0 {
+		if t.enforce {
+			return nil, fmt.Errorf("no authenticated association")
+		}
+		a := &udpAssoc{ip: laddr.IP, addr: laddr, implicit: true, sessions: map[string]*udpSession{}}
+		t.assocs = append(t.assocs, a)
+		return a, nil
+	}
+	for _, a := range unbound[1:] {
+		if a.user != unbound[0].user {
+			// the datagram cannot be attributed to one of several pending
+			// associations; do not risk crossing isolation groups
+			return nil, fmt.Errorf("%d pending associations with different usernames", len(unbound))
+		}
+	}
+	unbound[0].addr = laddr
+	return unbound[0], nil
+}
+
+// session returns the session of a for dst, creating it if needed.
+func (t *udpAssocs) session(a *udpAssoc, dst socks.Addr) *udpSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := dst.String()
+	if s := a.sessions[k]; s != nil {
+		return s
+	}
+	s := &udpSession{
+		a:    a,
+		dst:  dst,
+		q:    make(chan []byte, udpQueueLen),
+		done: make(chan struct{}),
+	}
+	s.touch()
+	a.sessions[k] = s
+	go t.run(s)
+	return s
+}
+
+// closeSession removes s from its association and stops it.
+func (t *udpAssocs) closeSession(s *udpSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := s.dst.String()
+	if s.a.sessions[k] == s {
+		delete(s.a.sessions, k)
+	}
+	s.once.Do(func() { close(s.done) })
+}
+
+// expire closes idle sessions and removes implicit associations left without
+// any sessions.
+func (t *udpAssocs) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, a := range append([]*udpAssoc{}, t.assocs...) {
+		for k, s := range a.sessions {
+			if s.idle() > udpIdle {
+				delete(a.sessions, k)
+				s.once.Do(func() { close(s.done) })
+			}
+		}
+		if a.implicit && len(a.sessions) == 0 {
+			t.remove(a)
+		}
+	}
+}
+
+// run dials the tunnel of s and relays datagrams in both directions until s
+// is closed or the tunnel fails.
+func (t *udpAssocs) run(s *udpSession) {
+	defer t.closeSession(s)
+	laddr, dstaddr := s.a.addr, s.dst
+	conn, err := t.dialer("CONNECT", "udp", dstaddr.String(), s.a.user)
+	if err != nil {
+		log.Printf(
+			"error dialing udp %s->%s->%s through the circuit: %s",
+			laddr, t.l.LocalAddr(), dstaddr, err,
+		)
+		return
+	}
+	defer conn.Close()
+	go t.reply(s, conn)
+	for {
+		select {
+		case p := <-s.q:
+			if _, err = conn.Write(p); err != nil {
+				log.Printf("error writing %s->%s->%s via udp: %s", laddr, t.l.LocalAddr(), dstaddr, err)
+				return
+			}
+			s.touch()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// reply relays datagrams received via the tunnel of s back to the client.
+func (t *udpAssocs) reply(s *udpSession, conn *h2conn.T) {
+	defer t.closeSession(s)
+	laddr, dstaddr := s.a.addr, s.dst
+	obuf := make([]byte, udpbufsize)
+	for {
+		n, err := conn.Read(obuf)
+		if err != nil {
+			select {
+			case <-s.done:
+				// closed on purpose
+			default:
+				if err != io.EOF {
+					log.Printf("error reading %s<-%s<-%s via udp: %s", laddr, t.l.LocalAddr(), dstaddr, err)
+				}
+			}
+			return
+		}
+		s.touch()
+		b, err := composeReply(dstaddr, obuf[:n], laddr)
+		if err != nil {
+			if errors.Is(err, errOversize) {
+				log.Printf("dropping %s<-%s<-%s udp reply: %s", laddr, t.l.LocalAddr(), dstaddr, err)
+				continue
+			}
+			log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, t.l.LocalAddr(), dstaddr, err)
+			return
+		}
+		if _, err = t.l.WriteTo(b, laddr); err != nil {
+			log.Printf("error writing %s<-%s<-%s via udp: %s", laddr, t.l.LocalAddr(), dstaddr, err)
+			return
+		}
+	}
+}
+
+// errOversize is returned by composeReply for replies which do not fit in a
+// single datagram once the SOCKS UDP header is added.
+var errOversize = errors.New("reply is too large for a single datagram")
+
+// composeReply returns the SOCKS UDP datagram relaying p from dstaddr to the
+// client at laddr.
+func composeReply(dstaddr socks.Addr, p []byte, laddr *net.UDPAddr) ([]byte, error) {
+	// largest UDP payload without jumbograms
+	max := 65527
+	if laddr.IP.To4() != nil {
+		max = 65507
+	}
+	b, err := socks.ComposeUDP(dstaddr, p)
+	if err == nil && len(b) > max {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d fit", errOversize, len(b), max)
+	}
+	return b, err
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/wireleap/client/socks"
+)
+
+func TestComposeReply(t *testing.T) {
+	v4 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	v6 := &net.UDPAddr{IP: net.IPv6loopback, Port: 5000}
+	ipdst := socks.AddrIPPort(net.IPv4(192, 0, 2, 1), 53)
+	namedst, err := socks.AddrString("example.com:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		dst   socks.Addr
+		laddr *net.UDPAddr
+		size  int
+		ok    bool
+	}{
+		// header is 3 + 7 bytes for an IPv4 address
+		{"v4 largest", ipdst, v4, 65507 - 10, true},
+		{"v4 oversize", ipdst, v4, 65507 - 9, false},
+		{"v6 largest", ipdst, v6, 65527 - 10, true},
+		{"v6 oversize", ipdst, v6, 65527 - 9, false},
+		// header is 3 + 1 + 1 + 11 + 2 bytes for example.com
+		{"name largest", namedst, v4, 65507 - 18, true},
+		{"name oversize", namedst, v4, 65507 - 17, false},
+		{"full read", ipdst, v4, 65535, false},
+	} {
+		b, err := composeReply(tc.dst, make([]byte, tc.size), tc.laddr)
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%s: %s", tc.name, err)
+				continue
+			}
+			dst, data, err := socks.DissectUDP(b)
+			if err != nil || dst.String() != tc.dst.String() || len(data) != tc.size {
+				t.Errorf("%s: composed %s with %d bytes, %v", tc.name, dst, len(data), err)
+			}
+		} else if !errors.Is(err, errOversize) {
+			t.Errorf("%s: got error %v, expected %v", tc.name, err, errOversize)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2022 Wireleap
+
+package caps
+
+// Supported is true if file capabilities are supported on this platform.
+const Supported = false
+
+// FileHasNetAdmin always returns false as file capabilities are Linux-only.
+func FileHasNetAdmin(string) (bool, error) { return false, nil }
+
+// CopyFile always returns false as file capabilities are Linux-only.
+func CopyFile(string, string) (bool, error) { return false, nil }
+
+// HaveNetAdmin always returns false as file capabilities are Linux-only.
+func HaveNetAdmin() bool { return false }
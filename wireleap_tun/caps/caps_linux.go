@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Wireleap
+
+// Package caps provides helpers for checking whether wireleap_tun can be run
+// using Linux file capabilities instead of being setuid root.
+package caps
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported is true if file capabilities are supported on this platform.
+const Supported = true
+
+const (
+	xattrName = "security.capability"
+	// VFS_CAP_FLAGS_EFFECTIVE from linux/capability.h
+	flagEffective = 0x000001
+)
+
+// FileHasNetAdmin returns whether the file at path has CAP_NET_ADMIN in its
+// permitted set with the effective flag set, i.e. `setcap cap_net_admin+ep`.
+func FileHasNetAdmin(path string) (bool, error) {
+	b, err := readCaps(path)
+	if err != nil || b == nil {
+		return false, err
+	}
+	return hasNetAdmin(b), nil
+}
+
+// CopyFile copies the file capabilities of src (if any) to dst. It returns
+// whether there were any capabilities to copy.
+func CopyFile(src, dst string) (bool, error) {
+	b, err := readCaps(src)
+	if err != nil || b == nil {
+		return false, err
+	}
+	return true, unix.Setxattr(dst, xattrName, b, 0)
+}
+
+// readCaps returns the raw vfs_cap_data of the file at path or nil if it has
+// none.
+func readCaps(path string) ([]byte, error) {
+	// vfs_cap_data is at most 24 bytes (v3)
+	b := make([]byte, 24)
+	n, err := unix.Getxattr(path, xattrName, b)
+	if err != nil {
+		if errors.Is(err, unix.ENODATA) || errors.Is(err, unix.EOPNOTSUPP) {
+			// no capabilities set at all or not supported by the filesystem
+			return nil, nil
+		}
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// hasNetAdmin parses raw vfs_cap_data and returns whether CAP_NET_ADMIN is in
+// the permitted set with the effective flag set.
+func hasNetAdmin(b []byte) bool {
+	if len(b) < 8 {
+		return false
+	}
+	var (
+		magic     = binary.LittleEndian.Uint32(b[0:4])
+		permitted = binary.LittleEndian.Uint32(b[4:8])
+	)
+	return magic&flagEffective != 0 && permitted&(1<<unix.CAP_NET_ADMIN) != 0
+}
+
+// HaveNetAdmin returns whether the current process has CAP_NET_ADMIN in its
+// effective set.
+func HaveNetAdmin() bool {
+	var (
+		hdr  = unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		data [2]unix.CapUserData
+	)
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false
+	}
+	return data[0].Effective&(1<<unix.CAP_NET_ADMIN) != 0
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2022 Wireleap
+
+package caps
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// vfs_cap_data as written by setcap(8)
+var (
+	// cap_net_admin+ep, VFS_CAP_REVISION_2
+	netAdminEPv2 = []byte{
+		0x01, 0x00, 0x00, 0x02, 0x00, 0x10, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	// cap_net_admin+ep with rootid 0, VFS_CAP_REVISION_3
+	netAdminEPv3 = []byte{
+		0x01, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	// cap_net_admin+p, no effective flag
+	netAdminP = []byte{
+		0x00, 0x00, 0x00, 0x02, 0x00, 0x10, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	// cap_net_raw+ep
+	netRawEP = []byte{
+		0x01, 0x00, 0x00, 0x02, 0x00, 0x20, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	}
+)
+
+func TestHasNetAdmin(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		b    []byte
+		want bool
+	}{
+		{"v2 ep", netAdminEPv2, true},
+		{"v3 ep", netAdminEPv3, true},
+		{"no effective", netAdminP, false},
+		{"other cap", netRawEP, false},
+		{"short", netAdminEPv2[:7], false},
+		{"empty", nil, false},
+	} {
+		if got := hasNetAdmin(tc.b); got != tc.want {
+			t.Errorf("%s: hasNetAdmin() = %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFileCaps(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		src = filepath.Join(dir, "src")
+		dst = filepath.Join(dir, "dst")
+	)
+	for _, fn := range []string{src, dst} {
+		if err := os.WriteFile(fn, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no xattr at all
+	if capable, err := FileHasNetAdmin(src); err != nil || capable {
+		t.Fatalf("FileHasNetAdmin() on plain file = %t, %v", capable, err)
+	}
+	if copied, err := CopyFile(src, dst); err != nil || copied {
+		t.Fatalf("CopyFile() from plain file = %t, %v", copied, err)
+	}
+	if _, err := FileHasNetAdmin(filepath.Join(dir, "missing")); err == nil {
+		t.Error("FileHasNetAdmin() on missing file did not return an error")
+	}
+	// setting security.capability needs CAP_SETFCAP
+	if err := unix.Setxattr(src, xattrName, netAdminEPv2, 0); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EOPNOTSUPP) {
+			t.Skipf("cannot set file capabilities here: %s", err)
+		}
+		t.Fatal(err)
+	}
+	if capable, err := FileHasNetAdmin(src); err != nil || !capable {
+		t.Fatalf("FileHasNetAdmin() after setcap = %t, %v", capable, err)
+	}
+	if copied, err := CopyFile(src, dst); err != nil || !copied {
+		t.Fatalf("CopyFile() = %t, %v", copied, err)
+	}
+	if capable, err := FileHasNetAdmin(dst); err != nil || !capable {
+		t.Errorf("FileHasNetAdmin() on copy = %t, %v", capable, err)
+	}
+}
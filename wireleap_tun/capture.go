@@ -0,0 +1,106 @@
+// Copyright (c) 2022 Wireleap
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/wireleap/client/wireleap_tun/tunsplice"
+	"github.com/wireleap/common/api/status"
+)
+
+// defaultCaptureLimit is the default maximum size of a capture file.
+const defaultCaptureLimit = 64 << 20
+
+// captureReq is the body of a POST /capture request.
+type captureReq struct {
+	File   string `json:"file"`
+	Filter string `json:"filter"`
+	Limit  int64  `json:"limit"`
+}
+
+// openCapture creates a new capture file in dir owned by the invoking user.
+// Since wireleap_tun runs privileged, only plain file names are accepted and
+// existing files or symlinks are never written to.
+func openCapture(dir, name string) (*os.File, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("capture file name %q must be a plain file name", name)
+	}
+	p := filepath.Join(dir, name)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chown(os.Getuid(), os.Getgid()); err != nil {
+		f.Close()
+		os.Remove(p)
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeCaptureState(w http.ResponseWriter, st tunsplice.CaptureState) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("error while serving /capture reply: %s", err)
+		status.ErrInternal.WriteTo(w)
+		return
+	}
+	w.Write(b)
+}
+
+func captureGet(w http.ResponseWriter, r *http.Request) {
+	writeCaptureState(w, tunsplice.GetCaptureState())
+}
+
+func capturePost(sh string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := captureReq{Limit: defaultCaptureLimit}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error while reading /capture POST request body: %s", err)
+			status.ErrRequest.WriteTo(w)
+			return
+		}
+		if err = json.Unmarshal(b, &req); err != nil {
+			log.Printf("error while unmarshaling /capture POST request body: %s", err)
+			status.ErrRequest.WriteTo(w)
+			return
+		}
+		filter, err := tunsplice.CompileFilter(req.Filter)
+		if err != nil {
+			status.ErrRequest.Wrap(err).WriteTo(w)
+			return
+		}
+		f, err := openCapture(sh, req.File)
+		if err != nil {
+			status.ErrRequest.Wrap(err).WriteTo(w)
+			return
+		}
+		if err = tunsplice.StartCapture(f, f.Name(), filter, req.Limit); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			status.ErrRequest.Wrap(err).WriteTo(w)
+			return
+		}
+		log.Printf("started capturing packets to %s", f.Name())
+		writeCaptureState(w, tunsplice.GetCaptureState())
+	}
+}
+
+func captureDelete(w http.ResponseWriter, r *http.Request) {
+	st, err := tunsplice.StopCapture()
+	if err != nil {
+		status.ErrRequest.Wrap(err).WriteTo(w)
+		return
+	}
+	log.Printf("stopped capturing packets to %s: %d packets, %d bytes", st.File, st.Packets, st.Written)
+	writeCaptureState(w, st)
+}
@@ -16,8 +16,10 @@ import (
 	"syscall"
 
 	"github.com/wireleap/client/restapi"
+	"github.com/wireleap/client/wireleap_tun/caps"
 	"github.com/wireleap/client/wireleap_tun/netsetup"
 	"github.com/wireleap/client/wireleap_tun/tun"
+	"github.com/wireleap/client/wireleap_tun/tunsplice"
 	"github.com/wireleap/common/api/provide"
 	"github.com/wireleap/common/api/status"
 
@@ -33,6 +35,7 @@ func main() {
 		log.Fatalf("could not find own executable path: %s", err)
 	}
 	bypass := bypassList{}
+	sh := os.Getenv("WIRELEAP_HOME")
 	err = restapi.UnixServer(exe+".sock", provide.Routes{
 		"/state": provide.MethodGate(provide.Routes{
 			http.MethodGet: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -82,38 +85,72 @@ func main() {
 				status.OK.WriteTo(w)
 			}),
 		}),
+		"/capture": provide.MethodGate(provide.Routes{
+			http.MethodGet:    http.HandlerFunc(captureGet),
+			http.MethodPost:   capturePost(sh),
+			http.MethodDelete: http.HandlerFunc(captureDelete),
+		}),
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := syscall.Seteuid(0); err != nil {
-		log.Fatal("could not gain privileges; check if setuid flag is set?")
+	// either setuid root or running with CAP_NET_ADMIN from file capabilities
+	setuid := syscall.Seteuid(0) == nil
+	if !setuid && !caps.HaveNetAdmin() {
+		log.Fatal("could not gain privileges; check if setuid flag or cap_net_admin file capability is set?")
 	}
 	os.Chmod(exe+".sock", 0660)
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	sh := os.Getenv("WIRELEAP_HOME")
 	h2caddr := os.Getenv("WIRELEAP_ADDR_H2C")
 	tunaddr := os.Getenv("WIRELEAP_ADDR_TUN")
 	if sh == "" || h2caddr == "" || tunaddr == "" {
 		log.Fatal("Running wireleap_tun separately from wireleap is not supported. Please use `sudo wireleap tun start`.")
 	}
+	mtu := 0
+	if mtustr := os.Getenv("WIRELEAP_TUN_MTU"); mtustr != "" {
+		if mtu, err = strconv.Atoi(mtustr); err != nil {
+			log.Fatalf("invalid WIRELEAP_TUN_MTU value: %s", mtustr)
+		}
+	}
 	t, err := tun.New()
 	if err != nil {
 		log.Fatalf("could not create tun device: %s", err)
 	}
 	rlim := syscall.Rlimit{Cur: 65535, Max: 65535}
 	if err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
-		log.Fatalf("could not set RLIMIT_NOFILE to %+v", rlim)
+		if setuid {
+			log.Fatalf("could not set RLIMIT_NOFILE to %+v", rlim)
+		}
+		// raising the hard limit needs more than CAP_NET_ADMIN, use what we have
+		if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err == nil {
+			rlim.Cur = rlim.Max
+			err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
+		}
+		if err != nil {
+			log.Fatalf("could not set RLIMIT_NOFILE to %+v", rlim)
+		}
+		log.Printf("running without root, RLIMIT_NOFILE is limited to %d", rlim.Cur)
 	}
-	if err = netsetup.Init(t, tunaddr); err != nil {
+	if err = netsetup.Init(t, tunaddr, mtu); err != nil {
 		log.Fatalf("could not configure tun device %s as %s: %s", t.Name(), tunaddr, err)
 	}
+	restoreForwarding := func() error { return nil }
+	if os.Getenv("WIRELEAP_TUN_GATEWAY") != "" {
+		if restoreForwarding, err = netsetup.EnableForwarding(); err != nil {
+			log.Fatalf("could not enable gateway mode: %s", err)
+		}
+		tunsplice.Gateway = true
+	}
 	pidfile := path.Join(sh, "wireleap_tun.pid")
 	finalize := func() {
 		// don't need to delete catch-all routes via tun dev as they will be
 		// removed when the device is down
 		bypass.Clear()
+		tunsplice.StopCapture()
+		if err := restoreForwarding(); err != nil {
+			log.Printf("could not restore ip forwarding setting: %s", err)
+		}
 		os.Remove(pidfile)
 	}
 	defer finalize()
@@ -127,7 +164,7 @@ func main() {
 	defer os.Remove(pidfile)
 	// setup debugging & profiling
 	if os.Getenv("WIRELEAP_TUN_DEBUG") != "" {
-		DEBUG = true
+		tunsplice.DEBUG = true
 	}
 	if os.Getenv("WIRELEAP_TUN_PPROF") != "" {
 		go func() { log.Println(http.ListenAndServe("localhost:6060", nil)) }()
@@ -147,7 +184,7 @@ func main() {
 		runtime.SetMutexProfileFraction(n)
 	}
 	log.Printf("listening for state queries on %s", exe+".sock")
-	if err = tunsplice(t, h2caddr, tunaddr); err != nil {
+	if err = tunsplice.Splice(t, h2caddr, tunaddr, mtu); err != nil {
 		log.Fatal("tunsplice returned error:", err)
 	}
 	state = "active"
@@ -0,0 +1,10 @@
+// Copyright (c) 2022 Wireleap
+
+package netsetup
+
+import "fmt"
+
+// EnableForwarding is not supported on darwin.
+func EnableForwarding() (restore func() error, err error) {
+	return nil, fmt.Errorf("gateway mode is not supported on darwin")
+}
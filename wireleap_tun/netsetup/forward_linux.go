@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Wireleap
+
+package netsetup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"log"
+)
+
+// variable for testing
+var ipForward = "/proc/sys/net/ipv4/ip_forward"
+
+// EnableForwarding enables IPv4 forwarding so that traffic from other hosts
+// using this one as gateway is routed via the tun device. The returned
+// function restores the previous setting.
+func EnableForwarding() (restore func() error, err error) {
+	prev, err := ioutil.ReadFile(ipForward)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", ipForward, err)
+	}
+	prev = bytes.TrimSpace(prev)
+	restore = func() error { return nil }
+	if string(prev) == "1" {
+		return
+	}
+	if err = ioutil.WriteFile(ipForward, []byte("1\n"), 0644); err != nil {
+		return nil, forwardingError(err)
+	}
+	log.Printf("enabled ip forwarding via %s", ipForward)
+	restore = func() error {
+		log.Printf("restoring %s to %s", ipForward, prev)
+		return ioutil.WriteFile(ipForward, append(prev, '\n'), 0644)
+	}
+	return
+}
+
+// forwardingError explains a failure to write ipForward. Files under
+// /proc/sys are only writable by root, CAP_NET_ADMIN is not enough.
+func forwardingError(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf(
+			"could not enable ip forwarding via %s: only root can write it, so it does not work with CAP_NET_ADMIN alone; enable it beforehand with `sudo sysctl -w net.ipv4.ip_forward=1` or make wireleap_tun setuid root (%s)",
+			ipForward, err,
+		)
+	}
+	return fmt.Errorf("could not enable ip forwarding via %s: %s", ipForward, err)
+}
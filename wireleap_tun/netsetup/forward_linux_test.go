@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Wireleap
+
+package netsetup
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestEnableForwarding(t *testing.T) {
+	defer func(orig string) { ipForward = orig }(ipForward)
+	for _, prev := range []string{"0", "1"} {
+		ipForward = filepath.Join(t.TempDir(), "ip_forward")
+		if err := ioutil.WriteFile(ipForward, []byte(prev+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		restore, err := EnableForwarding()
+		if err != nil {
+			t.Fatalf("EnableForwarding() with %s: %s", prev, err)
+		}
+		if b, _ := ioutil.ReadFile(ipForward); string(b) != "1\n" {
+			t.Errorf("with %s: ip_forward is %q after enabling", prev, b)
+		}
+		if err = restore(); err != nil {
+			t.Fatalf("restore() with %s: %s", prev, err)
+		}
+		if b, _ := ioutil.ReadFile(ipForward); string(b) != prev+"\n" {
+			t.Errorf("with %s: ip_forward is %q after restoring", prev, b)
+		}
+	}
+}
+
+func TestEnableForwardingMissing(t *testing.T) {
+	defer func(orig string) { ipForward = orig }(ipForward)
+	ipForward = filepath.Join(t.TempDir(), "missing")
+	if _, err := EnableForwarding(); err == nil {
+		t.Error("EnableForwarding() without ip_forward did not return an error")
+	}
+}
+
+func TestForwardingError(t *testing.T) {
+	perm := forwardingError(&fs.PathError{Op: "open", Path: ipForward, Err: syscall.EACCES})
+	if !strings.Contains(perm.Error(), "CAP_NET_ADMIN") {
+		t.Errorf("permission error does not explain CAP_NET_ADMIN: %s", perm)
+	}
+	other := forwardingError(&fs.PathError{Op: "open", Path: ipForward, Err: syscall.EIO})
+	if strings.Contains(other.Error(), "CAP_NET_ADMIN") {
+		t.Errorf("unrelated error mentions CAP_NET_ADMIN: %s", other)
+	}
+}
@@ -199,7 +199,7 @@ func mkroutes(ips []net.IP) (routes []*route.RouteMessage, err error) {
 	return
 }
 
-func Init(t *tun.T, tunaddr string) error {
+func Init(t *tun.T, tunaddr string, mtu int) error {
 	tunhost, _, err := net.SplitHostPort(tunaddr)
 	if err != nil {
 		return fmt.Errorf("could not parse WIRELEAP_ADDR_TUN `%s`: %s", tunaddr, err)
@@ -211,6 +211,12 @@ func Init(t *tun.T, tunaddr string) error {
 	if err = exec.Command("ifconfig", t.Name(), tunhost, NextIP(ip).String(), "netmask", "0xffffffff").Run(); err != nil {
 		return fmt.Errorf("tun device %s configuration failed: %s", t.Name(), err)
 	}
+	if mtu > 0 {
+		if err = exec.Command("ifconfig", t.Name(), "mtu", strconv.Itoa(mtu)).Run(); err != nil {
+			return fmt.Errorf("could not set mtu of tun device %s to %d: %s", t.Name(), mtu, err)
+		}
+		t.NetIf.MTU = mtu
+	}
 	gw4, gw6, err := getgws()
 	if err != nil {
 		return err
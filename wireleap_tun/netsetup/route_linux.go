@@ -53,7 +53,7 @@ func mkroutes(ips []net.IP) (routes []netlink.Route, err error) {
 	return
 }
 
-func Init(t *tun.T, tunaddr string) error {
+func Init(t *tun.T, tunaddr string, mtu int) error {
 	// set tun device up & add defined address
 	tunhost, _, err := net.SplitHostPort(tunaddr)
 	if err != nil {
@@ -71,6 +71,12 @@ func Init(t *tun.T, tunaddr string) error {
 	if err != nil {
 		return fmt.Errorf("could not set address of %s to %s: %s", link, addr, err)
 	}
+	if mtu > 0 {
+		if err = netlink.LinkSetMTU(link, mtu); err != nil {
+			return fmt.Errorf("could not set link mtu for %s to %d: %s", t.Name(), mtu, err)
+		}
+		t.NetIf.MTU = mtu
+	}
 	err = netlink.LinkSetTxQLen(link, 1000)
 	if err != nil {
 		return fmt.Errorf("could not set link txqueue length for %s to %d: %s", t.Name(), 1000, err)
@@ -14,9 +14,13 @@ const (
 	TCP Family = iota
 	UDP
 	nfamilies
-	nports = 65535
+	// ports 0-65535 inclusive
+	nports = 65536
 )
 
+// lowest port to allocate when translating source ports
+const minNatPort = 1024
+
 type Entry struct {
 	SrcIP, DstIP     net.IP
 	SrcPort, DstPort int
@@ -25,10 +29,30 @@ type Entry struct {
 	conn net.Conn
 }
 
-type T [nfamilies * nports]atomic.Value
+// flow identifies the original source address of a connection.
+type flow struct {
+	f    Family
+	ip   [net.IPv6len]byte
+	port int
+}
+
+func mkflow(f Family, ip net.IP, port int) (k flow) {
+	k.f, k.port = f, port
+	copy(k.ip[:], ip.To16())
+	return
+}
+
+type T struct {
+	ents [nfamilies * nports]atomic.Value
+
+	// source nat bookkeeping
+	mu   sync.Mutex
+	snat map[flow]int
+	next [nfamilies]int
+}
 
 func (t *T) Get(f Family, port int) (e *Entry) {
-	v := t[int(f*nports)+port].Load()
+	v := t.ents[int(f*nports)+port].Load()
 	if v == nil || v.(*Entry) == nil {
 		return (*Entry)(nil)
 	}
@@ -38,7 +62,7 @@ func (t *T) Get(f Family, port int) (e *Entry) {
 
 func (t *T) Set(f Family, port int, e *Entry, init func() (net.Conn, error)) {
 	e.mu.Lock()
-	t[int(f*nports)+port].Store(e)
+	t.ents[int(f*nports)+port].Store(e)
 	go func() {
 		defer e.mu.Unlock()
 		if c, err := init(); err == nil {
@@ -50,9 +74,51 @@ func (t *T) Set(f Family, port int, e *Entry, init func() (net.Conn, error)) {
 }
 
 func (t *T) Del(f Family, port int) {
+	e := t.Get(f, port)
 	// remove reference
 	// it will get garbage collected after it goes out of scope
-	t[int(f*nports)+port].Store((*Entry)(nil))
+	t.ents[int(f*nports)+port].Store((*Entry)(nil))
+	if e != nil {
+		k := mkflow(f, e.SrcIP, e.SrcPort)
+		t.mu.Lock()
+		if t.snat[k] == port {
+			delete(t.snat, k)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Alloc returns the port under which the flow from ip:port is stored. The
+// original port is used if it is free, otherwise another free port is
+// allocated so that flows from different hosts using the same source port do
+// not clash. If no port is free, ok is false.
+func (t *T) Alloc(f Family, ip net.IP, port int) (natport int, ok bool) {
+	k := mkflow(f, ip, port)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.snat == nil {
+		t.snat = map[flow]int{}
+	}
+	if p, ok := t.snat[k]; ok {
+		if e := t.Get(f, p); e != nil && e.SrcPort == port && e.SrcIP.Equal(ip) {
+			return p, true
+		}
+		// stale mapping
+		delete(t.snat, k)
+	}
+	if port > 0 && t.Get(f, port) == nil {
+		t.snat[k] = port
+		return port, true
+	}
+	for i := 0; i < nports-minNatPort; i++ {
+		p := minNatPort + (t.next[f]+i)%(nports-minNatPort)
+		if t.Get(f, p) == nil {
+			t.next[f] = p - minNatPort + 1
+			t.snat[k] = p
+			return p, true
+		}
+	}
+	return 0, false
 }
 
 func (e *Entry) Conn() net.Conn {
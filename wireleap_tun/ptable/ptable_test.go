@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Wireleap
+
+package ptable
+
+import (
+	"net"
+	"testing"
+)
+
+// set stores an entry for the flow like tunsplice does after Alloc.
+func set(t *T, f Family, natport int, ip net.IP, port int) {
+	t.Set(f, natport, &Entry{SrcIP: ip, SrcPort: port}, func() (net.Conn, error) { return nil, nil })
+}
+
+func TestAlloc(t *testing.T) {
+	var (
+		pt = &T{}
+		a  = net.ParseIP("10.0.0.2")
+		b  = net.ParseIP("10.0.0.3")
+	)
+	// original port is kept if free
+	p, ok := pt.Alloc(TCP, a, 40000)
+	if !ok || p != 40000 {
+		t.Fatalf("Alloc(a:40000) = %d, %t; want 40000, true", p, ok)
+	}
+	set(pt, TCP, p, a, 40000)
+	// same flow maps to the same port
+	if p, ok = pt.Alloc(TCP, a, 40000); !ok || p != 40000 {
+		t.Errorf("Alloc(a:40000) again = %d, %t; want 40000, true", p, ok)
+	}
+	// same port from another host is translated
+	pb, ok := pt.Alloc(TCP, b, 40000)
+	if !ok || pb == 40000 || pb < minNatPort {
+		t.Fatalf("Alloc(b:40000) = %d, %t; want a free port >= %d", pb, ok, minNatPort)
+	}
+	set(pt, TCP, pb, b, 40000)
+	if p, _ = pt.Alloc(TCP, b, 40000); p != pb {
+		t.Errorf("Alloc(b:40000) again = %d, want %d", p, pb)
+	}
+	// families are independent
+	if p, ok = pt.Alloc(UDP, b, 40000); !ok || p != 40000 {
+		t.Errorf("Alloc(udp b:40000) = %d, %t; want 40000, true", p, ok)
+	}
+	// deleting frees the translation
+	pt.Del(TCP, pb)
+	if _, ok = pt.snat[mkflow(TCP, b, 40000)]; ok {
+		t.Error("snat entry for b:40000 still present after Del")
+	}
+	pt.Del(TCP, 40000)
+	if p, ok = pt.Alloc(TCP, b, 40000); !ok || p != 40000 {
+		t.Errorf("Alloc(b:40000) after Del = %d, %t; want 40000, true", p, ok)
+	}
+}
+
+func TestAllocStale(t *testing.T) {
+	var (
+		pt = &T{}
+		a  = net.ParseIP("10.0.0.2")
+		b  = net.ParseIP("10.0.0.3")
+	)
+	set(pt, UDP, 5353, a, 5353)
+	p, _ := pt.Alloc(UDP, b, 5353)
+	set(pt, UDP, p, b, 5353)
+	// port reused by another flow without Del, e.g. after a race
+	pt.Set(UDP, p, &Entry{SrcIP: a, SrcPort: 1}, func() (net.Conn, error) { return nil, nil })
+	if p2, ok := pt.Alloc(UDP, b, 5353); !ok || p2 == p {
+		t.Errorf("Alloc(b:5353) with stale mapping = %d, %t; want a new port", p2, ok)
+	}
+}
+
+func TestAllocEdges(t *testing.T) {
+	pt := &T{}
+	ip := net.ParseIP("2001:db8::1")
+	for _, f := range []Family{TCP, UDP} {
+		if p, ok := pt.Alloc(f, ip, 65535); !ok || p != 65535 {
+			t.Errorf("Alloc(%d, 65535) = %d, %t; want 65535, true", f, p, ok)
+		}
+		set(pt, f, 65535, ip, 65535)
+		if e := pt.Get(f, 65535); e == nil || e.SrcPort != 65535 {
+			t.Errorf("Get(%d, 65535) = %+v", f, e)
+		}
+	}
+	if e := pt.Get(UDP, 0); e != nil {
+		t.Errorf("TCP port 65535 overlaps UDP port 0: %+v", e)
+	}
+	// port 0 is never kept
+	if p, ok := pt.Alloc(TCP, ip, 0); !ok || p < minNatPort {
+		t.Errorf("Alloc(0) = %d, %t; want a port >= %d", p, ok, minNatPort)
+	}
+}
+
+func TestAllocExhausted(t *testing.T) {
+	pt := &T{}
+	for p := minNatPort; p < nports; p++ {
+		set(pt, TCP, p, net.ParseIP("10.0.0.2"), p)
+	}
+	if p, ok := pt.Alloc(TCP, net.ParseIP("10.0.0.3"), 40000); ok {
+		t.Errorf("Alloc() with all ports taken = %d, true; want false", p)
+	}
+	// ports below minNatPort can still be used as is
+	if p, ok := pt.Alloc(TCP, net.ParseIP("10.0.0.3"), 80); !ok || p != 80 {
+		t.Errorf("Alloc(80) = %d, %t; want 80, true", p, ok)
+	}
+	pt.Del(TCP, 50000)
+	if p, ok := pt.Alloc(TCP, net.ParseIP("10.0.0.3"), 40000); !ok || p != 50000 {
+		t.Errorf("Alloc() with one free port = %d, %t; want 50000, true", p, ok)
+	}
+}
@@ -2,11 +2,14 @@
 
 package tun
 
-import "log"
+import (
+	"io"
+	"log"
+)
 
 type Reader struct{ queue chan []byte }
 
-func NewReader(tunif *T) *Reader {
+func NewReader(tunif io.Reader) *Reader {
 	t := &Reader{queue: make(chan []byte, 1024)}
 	buf := make([]byte, 65535) // max IP packet size
 	go func() {
@@ -2,11 +2,14 @@
 
 package tun
 
-import "log"
+import (
+	"io"
+	"log"
+)
 
 type Writer struct{ queue chan []byte }
 
-func NewWriter(tunif *T) *Writer {
+func NewWriter(tunif io.Writer) *Writer {
 	t := &Writer{queue: make(chan []byte, 1024)}
 	go func() {
 		for data := range t.queue {
@@ -0,0 +1,174 @@
+// Copyright (c) 2022 Wireleap
+
+package tunsplice
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapng interface indices for packets before and after NAT rewriting.
+const (
+	capturePre = iota
+	capturePost
+)
+
+// CaptureState describes the state of an ongoing or finished packet capture.
+type CaptureState struct {
+	Active  bool   `json:"active"`
+	File    string `json:"file,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	Limit   int64  `json:"limit,omitempty"`
+	Written int64  `json:"written"`
+	Packets int64  `json:"packets"`
+	Started int64  `json:"started,omitempty"`
+}
+
+type capture struct {
+	mu     sync.Mutex
+	wc     io.WriteCloser
+	w      *pcapgo.NgWriter
+	filter *Filter
+	state  CaptureState
+}
+
+var (
+	captMu sync.RWMutex
+	capt   *capture
+)
+
+// StartCapture starts writing packets matching filter to wc in pcapng format
+// until limit bytes have been written or StopCapture is called. A zero limit
+// means no limit. Packets are written before NAT rewriting on interface
+// "pre-nat" and after it on interface "post-nat". Rewritten packets are also
+// captured if the original packet matched the filter. The name is only used
+// for reporting.
+func StartCapture(wc io.WriteCloser, name string, filter *Filter, limit int64) (err error) {
+	captMu.Lock()
+	defer captMu.Unlock()
+	if capt != nil {
+		// a capture which hit its limit can be replaced
+		capt.mu.Lock()
+		st := capt.state
+		capt.mu.Unlock()
+		if st.Active {
+			return fmt.Errorf("capture to %s is already active", st.File)
+		}
+	}
+	w, err := pcapgo.NewNgWriterInterface(wc, pcapgo.NgInterface{
+		Name:                "pre-nat",
+		Description:         "packets read from tun device",
+		Filter:              filter.String(),
+		LinkType:            layers.LinkTypeRaw,
+		TimestampResolution: 9,
+	}, pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		return
+	}
+	if _, err = w.AddInterface(pcapgo.NgInterface{
+		Name:                "post-nat",
+		Description:         "packets written to tun device",
+		Filter:              filter.String(),
+		LinkType:            layers.LinkTypeRaw,
+		TimestampResolution: 9,
+	}); err != nil {
+		return
+	}
+	capt = &capture{
+		wc:     wc,
+		w:      w,
+		filter: filter,
+		state: CaptureState{
+			Active:  true,
+			File:    name,
+			Filter:  filter.String(),
+			Limit:   limit,
+			Started: time.Now().Unix(),
+		},
+	}
+	return
+}
+
+// StopCapture stops the active capture and returns its final state.
+func StopCapture() (st CaptureState, err error) {
+	captMu.Lock()
+	c := capt
+	capt = nil
+	captMu.Unlock()
+	if c == nil {
+		return st, fmt.Errorf("no capture is active")
+	}
+	return c.close()
+}
+
+// GetCaptureState returns the state of the active capture, if any.
+func GetCaptureState() (st CaptureState) {
+	captMu.RLock()
+	c := capt
+	captMu.RUnlock()
+	if c != nil {
+		c.mu.Lock()
+		st = c.state
+		c.mu.Unlock()
+	}
+	return
+}
+
+func (c *capture) close() (st CaptureState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state.Active {
+		c.state.Active = false
+		if err = c.w.Flush(); err == nil {
+			err = c.wc.Close()
+		} else {
+			c.wc.Close()
+		}
+	}
+	return c.state, err
+}
+
+// capturePacket writes data to the active capture on interface iface. If
+// match is true, the packet is only written if it matches the filter. The
+// return value is whether the packet was written.
+func capturePacket(iface int, data []byte, match bool) bool {
+	captMu.RLock()
+	c := capt
+	captMu.RUnlock()
+	if c == nil || (match && !c.filter.Match(data)) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.state.Active {
+		return false
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: iface,
+	}
+	// enhanced packet block overhead is 32 bytes + padding
+	size := int64(32 + len(data) + (4-len(data)&3)&3)
+	if c.state.Limit > 0 && c.state.Written+size > c.state.Limit {
+		c.state.Active = false
+		c.w.Flush()
+		c.wc.Close()
+		return false
+	}
+	if err := c.w.WritePacket(ci, data); err != nil {
+		c.state.Active = false
+		c.wc.Close()
+		return false
+	}
+	c.state.Written += size
+	c.state.Packets++
+	return true
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2022 Wireleap
+
+package tunsplice
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Filter is a compiled packet filter expression. It supports a subset of the
+// BPF (tcpdump) filter syntax:
+//
+//	ip, ip6, tcp, udp
+//	[src|dst] host ADDR
+//	[src|dst] port PORT
+//	[src|dst] net CIDR
+//
+// Primitives can be combined using `and` (`&&`), `or` (`||`), `not` (`!`)
+// and parentheses. An empty expression matches all packets.
+type Filter struct {
+	expr string
+	root node
+}
+
+// summary is the part of a packet which filters are evaluated on.
+type summary struct {
+	v6       bool
+	proto    layers.IPProtocol
+	src, dst net.IP
+	sp, dp   int
+}
+
+type node func(*summary) bool
+
+// CompileFilter parses a filter expression.
+func CompileFilter(expr string) (f *Filter, err error) {
+	f = &Filter{expr: expr}
+	p := &filterParser{toks: tokenize(expr)}
+	if len(p.toks) == 0 {
+		return
+	}
+	if f.root, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if p.i != len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q in filter expression", p.toks[p.i])
+	}
+	return
+}
+
+// String returns the original filter expression.
+func (f *Filter) String() string { return f.expr }
+
+// Match returns whether the raw IP packet matches the filter.
+func (f *Filter) Match(data []byte) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+	s, ok := summarize(data)
+	if !ok {
+		return false
+	}
+	return f.root(s)
+}
+
+func summarize(data []byte) (*summary, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	var (
+		s = &summary{}
+		p gopacket.Packet
+	)
+	switch data[0] >> 4 {
+	case 4:
+		p = gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		ip, ok := p.NetworkLayer().(*layers.IPv4)
+		if !ok {
+			return nil, false
+		}
+		s.proto, s.src, s.dst = ip.Protocol, ip.SrcIP, ip.DstIP
+	case 6:
+		p = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		ip, ok := p.NetworkLayer().(*layers.IPv6)
+		if !ok {
+			return nil, false
+		}
+		s.v6, s.proto, s.src, s.dst = true, ip.NextHeader, ip.SrcIP, ip.DstIP
+	default:
+		return nil, false
+	}
+	switch l := p.TransportLayer().(type) {
+	case *layers.TCP:
+		s.sp, s.dp = int(l.SrcPort), int(l.DstPort)
+	case *layers.UDP:
+		s.sp, s.dp = int(l.SrcPort), int(l.DstPort)
+	}
+	return s, true
+}
+
+func tokenize(expr string) (toks []string) {
+	r := strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ")
+	return strings.Fields(r.Replace(expr))
+}
+
+type filterParser struct {
+	toks []string
+	i    int
+}
+
+func (p *filterParser) peek() string {
+	if p.i < len(p.toks) {
+		return p.toks[p.i]
+	}
+	return ""
+}
+
+func (p *filterParser) next() (tok string, err error) {
+	if p.i >= len(p.toks) {
+		return "", fmt.Errorf("unexpected end of filter expression")
+	}
+	tok = p.toks[p.i]
+	p.i++
+	return
+}
+
+// expr := term ("or" term)*
+func (p *filterParser) expr() (n node, err error) {
+	if n, err = p.term(); err != nil {
+		return
+	}
+	for p.peek() == "or" {
+		p.i++
+		l, r := n, node(nil)
+		if r, err = p.term(); err != nil {
+			return
+		}
+		n = func(s *summary) bool { return l(s) || r(s) }
+	}
+	return
+}
+
+// term := factor ("and" factor)*
+func (p *filterParser) term() (n node, err error) {
+	if n, err = p.factor(); err != nil {
+		return
+	}
+	for p.peek() == "and" {
+		p.i++
+		l, r := n, node(nil)
+		if r, err = p.factor(); err != nil {
+			return
+		}
+		n = func(s *summary) bool { return l(s) && r(s) }
+	}
+	return
+}
+
+// factor := "not" factor | "(" expr ")" | primitive
+func (p *filterParser) factor() (n node, err error) {
+	switch p.peek() {
+	case "not":
+		p.i++
+		if n, err = p.factor(); err != nil {
+			return
+		}
+		inner := n
+		return func(s *summary) bool { return !inner(s) }, nil
+	case "(":
+		p.i++
+		if n, err = p.expr(); err != nil {
+			return
+		}
+		if tok, _ := p.next(); tok != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis in filter expression")
+		}
+		return
+	}
+	return p.primitive()
+}
+
+func (p *filterParser) primitive() (n node, err error) {
+	tok, err := p.next()
+	if err != nil {
+		return
+	}
+	switch tok {
+	case "ip":
+		return func(s *summary) bool { return !s.v6 }, nil
+	case "ip6":
+		return func(s *summary) bool { return s.v6 }, nil
+	case "tcp":
+		return func(s *summary) bool { return s.proto == layers.IPProtocolTCP }, nil
+	case "udp":
+		return func(s *summary) bool { return s.proto == layers.IPProtocolUDP }, nil
+	}
+	src, dst := true, true
+	switch tok {
+	case "src":
+		dst = false
+		tok, err = p.next()
+	case "dst":
+		src = false
+		tok, err = p.next()
+	}
+	if err != nil {
+		return
+	}
+	arg, err := p.next()
+	if err != nil {
+		return
+	}
+	switch tok {
+	case "host":
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host address %q in filter expression", arg)
+		}
+		return func(s *summary) bool {
+			return (src && ip.Equal(s.src)) || (dst && ip.Equal(s.dst))
+		}, nil
+	case "port":
+		port, err := strconv.Atoi(arg)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q in filter expression", arg)
+		}
+		return func(s *summary) bool {
+			return (src && s.sp == port) || (dst && s.dp == port)
+		}, nil
+	case "net":
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid net %q in filter expression: %w", arg, err)
+		}
+		return func(s *summary) bool {
+			return (src && ipnet.Contains(s.src)) || (dst && ipnet.Contains(s.dst))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown filter primitive %q", tok)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2022 Wireleap
+
+package tunsplice
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testPacket(t *testing.T, src, dst string, sp, dp int) []byte {
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP(src),
+		DstIP:    net.ParseIP(dst),
+	}
+	tcp := &layers.TCP{SrcPort: layers.TCPPort(sp), DstPort: layers.TCPPort(dp), SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFilter(t *testing.T) {
+	pkt := testPacket(t, "10.0.0.1", "192.0.2.1", 40000, 443)
+	for expr, want := range map[string]bool{
+		"":                                 true,
+		"tcp":                              true,
+		"udp":                              false,
+		"ip6":                              false,
+		"host 192.0.2.1":                   true,
+		"src host 192.0.2.1":               false,
+		"dst port 443":                     true,
+		"port 40000 and not port 443":      false,
+		"net 10.0.0.0/8 && (udp || tcp)":   true,
+		"!(src net 10.0.0.0/8) or port 53": false,
+	} {
+		f, err := CompileFilter(expr)
+		if err != nil {
+			t.Fatalf("%q: %s", expr, err)
+		}
+		if got := f.Match(pkt); got != want {
+			t.Errorf("%q: got %t, want %t", expr, got, want)
+		}
+	}
+	for _, expr := range []string{"tcp and", "(tcp", "host x", "port 70000", "foo"} {
+		if _, err := CompileFilter(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Wireleap
+
+package tunsplice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxUDPPayload is the largest UDP payload which fits in an IP packet.
+const maxUDPPayload = 65535
+
+// fragTimeout is how long incomplete IPv4 fragments are kept around.
+const fragTimeout = 30 * time.Second
+
+// fragment identification counter
+var fragid uint32
+
+// networkLayer is the type of network layers which can be serialized.
+type networkLayer interface {
+	gopacket.NetworkLayer
+	gopacket.SerializableLayer
+}
+
+// mssFor returns the largest TCP MSS which fits into mtu for the network
+// layer given or 0 if mtu is not set.
+func mssFor(nl networkLayer, mtu int) int {
+	if mtu <= 0 {
+		return 0
+	}
+	switch nl.(type) {
+	case *layers.IPv6:
+		return mtu - 40 - 20
+	default:
+		return mtu - 20 - 20
+	}
+}
+
+// clampMSS lowers the MSS option of a SYN packet to at most mss.
+func clampMSS(tcp *layers.TCP, mss int) {
+	if !tcp.SYN || mss <= 0 {
+		return
+	}
+	for _, o := range tcp.Options {
+		if o.OptionType == layers.TCPOptionKindMSS && len(o.OptionData) == 2 {
+			if int(binary.BigEndian.Uint16(o.OptionData)) > mss {
+				// option data is a subslice of the packet, mutate in place
+				binary.BigEndian.PutUint16(o.OptionData, uint16(mss))
+			}
+		}
+	}
+}
+
+// isFragment returns whether the IPv4 packet is a fragment.
+func isFragment(ip4 *layers.IPv4) bool {
+	return ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0
+}
+
+// serializeUDP serializes an UDP datagram into one or more IP packets no
+// larger than mtu, fragmenting it if needed. If mtu is not set, no
+// fragmentation is performed.
+func serializeUDP(nl networkLayer, udp *layers.UDP, payload []byte, mtu int) (pkts [][]byte, err error) {
+	var (
+		buf  = gopacket.NewSerializeBuffer()
+		opts = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	)
+	udp.SetNetworkLayerForChecksum(nl)
+	if err = gopacket.SerializeLayers(buf, opts, nl, udp, gopacket.Payload(payload)); err != nil {
+		return
+	}
+	if out := buf.Bytes(); mtu <= 0 || len(out) <= mtu {
+		// copy bytes
+		dup := make([]byte, len(out))
+		copy(dup, out)
+		return [][]byte{dup}, nil
+	}
+	var (
+		id      = atomic.AddUint32(&fragid, 1)
+		iphdr   int
+		maxfrag int
+	)
+	switch nl.(type) {
+	case *layers.IPv4:
+		iphdr, maxfrag = 20, (mtu-20)&^7
+	case *layers.IPv6:
+		// fragment extension header is 8 bytes
+		iphdr, maxfrag = 40, (mtu-40-8)&^7
+	default:
+		return nil, fmt.Errorf("cannot fragment unknown network layer %s", nl.LayerType())
+	}
+	if maxfrag <= 0 {
+		return nil, fmt.Errorf("mtu %d is too small to fragment into", mtu)
+	}
+	// udp header and payload with the checksum computed above
+	transport := make([]byte, len(buf.Bytes())-iphdr)
+	copy(transport, buf.Bytes()[iphdr:])
+	for off := 0; off < len(transport); off += maxfrag {
+		end := off + maxfrag
+		more := end < len(transport)
+		if !more {
+			end = len(transport)
+		}
+		var l gopacket.SerializableLayer
+		data := transport[off:end]
+		switch v := nl.(type) {
+		case *layers.IPv4:
+			f := *v
+			f.Id = uint16(id)
+			f.FragOffset = uint16(off / 8)
+			f.Flags = 0
+			if more {
+				f.Flags = layers.IPv4MoreFragments
+			}
+			l = &f
+		case *layers.IPv6:
+			f := *v
+			f.NextHeader = layers.IPProtocolIPv6Fragment
+			fh := make([]byte, 8, 8+len(data))
+			fh[0] = byte(layers.IPProtocolUDP)
+			offm := uint16(off/8) << 3
+			if more {
+				offm |= 1
+			}
+			binary.BigEndian.PutUint16(fh[2:4], offm)
+			binary.BigEndian.PutUint32(fh[4:8], id)
+			data = append(fh, data...)
+			l = &f
+		}
+		if err = gopacket.SerializeLayers(buf, opts, l, gopacket.Payload(data)); err != nil {
+			return nil, err
+		}
+		out := buf.Bytes()
+		dup := make([]byte, len(out))
+		copy(dup, out)
+		pkts = append(pkts, dup)
+	}
+	return
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2022 Wireleap
+
+package tunsplice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// checksum computes the internet checksum of data with the IP pseudo-header
+// for src, dst and proto prepended. It is 0 for data with a valid checksum.
+func checksum(src, dst net.IP, proto layers.IPProtocol, data []byte) uint16 {
+	var ph []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		ph = append(append(ph, src4...), dst4...)
+	} else {
+		ph = append(append(ph, src.To16()...), dst.To16()...)
+	}
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(data)))
+	ph = append(append(ph, l...), 0, 0, 0, byte(proto))
+	b := append(ph, data...)
+	if len(b)%2 == 1 {
+		b = append(b, 0)
+	}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func testIPv4() *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP("10.0.0.1").To4(),
+		DstIP:    net.ParseIP("192.0.2.1").To4(),
+	}
+}
+
+func testIPv6() *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("fd00::1"),
+		DstIP:      net.ParseIP("2001:db8::1"),
+	}
+}
+
+func TestMSSFor(t *testing.T) {
+	for _, tc := range []struct {
+		nl   networkLayer
+		mtu  int
+		want int
+	}{
+		{testIPv4(), 1500, 1460},
+		{testIPv6(), 1500, 1440},
+		{testIPv4(), 1280, 1240},
+		{testIPv6(), 1280, 1220},
+		{testIPv4(), 0, 0},
+		{testIPv6(), -1, 0},
+	} {
+		if got := mssFor(tc.nl, tc.mtu); got != tc.want {
+			t.Errorf("mssFor(%s, %d) = %d, want %d", tc.nl.LayerType(), tc.mtu, got, tc.want)
+		}
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		syn       bool
+		mss, clmp int
+		want      int
+	}{
+		{"lowered", true, 1460, 1400, 1400},
+		{"already lower", true, 1200, 1400, 1200},
+		{"equal", true, 1400, 1400, 1400},
+		{"not syn", false, 1460, 1400, 1460},
+		{"no mtu", true, 1460, 0, 1460},
+	} {
+		ip := testIPv4()
+		ip.Protocol = layers.IPProtocolTCP
+		opt := make([]byte, 2)
+		binary.BigEndian.PutUint16(opt, uint16(tc.mss))
+		tcp := &layers.TCP{
+			SrcPort: 40000,
+			DstPort: 443,
+			SYN:     tc.syn,
+			ACK:     !tc.syn,
+			Window:  64240,
+			Options: []layers.TCPOption{
+				{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: opt},
+				{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+				{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+			},
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, ip, tcp); err != nil {
+			t.Fatal(err)
+		}
+		// decode, clamp in place and reserialize like the splice loop does
+		var (
+			ip4 layers.IPv4
+			dec layers.TCP
+		)
+		p := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip4, &dec)
+		decoded := []gopacket.LayerType{}
+		if err := p.DecodeLayers(buf.Bytes(), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		dec.SetNetworkLayerForChecksum(&ip4)
+		clampMSS(&dec, tc.clmp)
+		out := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(out, opts, &ip4, &dec, gopacket.Payload(dec.Payload)); err != nil {
+			t.Fatal(err)
+		}
+		pkt := gopacket.NewPacket(out.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+		res, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			t.Fatalf("%s: no tcp layer in clamped packet", tc.name)
+		}
+		if len(res.Options) != 3 {
+			t.Fatalf("%s: got %d options, want 3", tc.name, len(res.Options))
+		}
+		if got := int(binary.BigEndian.Uint16(res.Options[0].OptionData)); got != tc.want {
+			t.Errorf("%s: mss = %d, want %d", tc.name, got, tc.want)
+		}
+		if !bytes.Equal(res.Options[2].OptionData, []byte{7}) {
+			t.Errorf("%s: window scale option changed: %v", tc.name, res.Options[2].OptionData)
+		}
+		if c := checksum(ip4.SrcIP, ip4.DstIP, layers.IPProtocolTCP, out.Bytes()[20:]); c != 0 {
+			t.Errorf("%s: invalid tcp checksum (residue %#04x)", tc.name, c)
+		}
+	}
+}
+
+// reassemble checks the fragments produced by serializeUDP and returns the
+// transport data (udp header and payload) they carry.
+func reassemble(t *testing.T, pkts [][]byte, v6 bool, mtu int) []byte {
+	var (
+		transport []byte
+		id        uint32
+	)
+	for i, pkt := range pkts {
+		if len(pkt) > mtu {
+			t.Errorf("packet %d is %d bytes, larger than mtu %d", i, len(pkt), mtu)
+		}
+		var (
+			off  int
+			more bool
+			data []byte
+		)
+		if v6 {
+			p := gopacket.NewPacket(pkt, layers.LayerTypeIPv6, gopacket.Default)
+			ip6, _ := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+			if ip6 == nil || ip6.NextHeader != layers.IPProtocolIPv6Fragment {
+				t.Fatalf("packet %d is not an IPv6 fragment", i)
+			}
+			if int(ip6.Length) != len(pkt)-40 {
+				t.Errorf("packet %d payload length %d, want %d", i, ip6.Length, len(pkt)-40)
+			}
+			fh := pkt[40:48]
+			if fh[0] != byte(layers.IPProtocolUDP) {
+				t.Errorf("packet %d fragment next header %d, want udp", i, fh[0])
+			}
+			offm := binary.BigEndian.Uint16(fh[2:4])
+			off, more = int(offm>>3)*8, offm&1 != 0
+			if fid := binary.BigEndian.Uint32(fh[4:8]); i == 0 {
+				id = fid
+			} else if fid != id {
+				t.Errorf("packet %d fragment id %d, want %d", i, fid, id)
+			}
+			data = pkt[48:]
+		} else {
+			p := gopacket.NewPacket(pkt, layers.LayerTypeIPv4, gopacket.Default)
+			ip4, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if ip4 == nil {
+				t.Fatalf("packet %d is not IPv4", i)
+			}
+			if int(ip4.Length) != len(pkt) {
+				t.Errorf("packet %d total length %d, want %d", i, ip4.Length, len(pkt))
+			}
+			off, more = int(ip4.FragOffset)*8, ip4.Flags&layers.IPv4MoreFragments != 0
+			if i == 0 {
+				id = uint32(ip4.Id)
+			} else if uint32(ip4.Id) != id {
+				t.Errorf("packet %d fragment id %d, want %d", i, ip4.Id, id)
+			}
+			data = pkt[20:]
+		}
+		if off != len(transport) {
+			t.Errorf("packet %d offset %d, want %d", i, off, len(transport))
+		}
+		if last := i == len(pkts)-1; more == last {
+			t.Errorf("packet %d more fragments flag %t, want %t", i, more, !last)
+		}
+		if more && len(data)%8 != 0 {
+			t.Errorf("packet %d non-final fragment size %d is not a multiple of 8", i, len(data))
+		}
+		transport = append(transport, data...)
+	}
+	return transport
+}
+
+func TestSerializeUDP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		v6      bool
+		mtu     int
+		payload int
+		frags   int
+	}{
+		{"v4 fits exactly", false, 1500, 1472, 1},
+		{"v4 one byte over", false, 1500, 1473, 2},
+		{"v4 no mtu", false, 0, 8000, 1},
+		{"v4 large", false, 1500, 8000, 6},
+		{"v4 max payload", false, 1500, maxUDPPayload - 28, 45},
+		{"v6 fits exactly", true, 1280, 1232, 1},
+		{"v6 one byte over", true, 1280, 1233, 2},
+		{"v6 large", true, 1500, 8000, 6},
+	} {
+		var nl networkLayer = testIPv4()
+		if tc.v6 {
+			nl = testIPv6()
+		}
+		udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+		payload := make([]byte, tc.payload)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		pkts, err := serializeUDP(nl, udp, payload, tc.mtu)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if len(pkts) != tc.frags {
+			t.Fatalf("%s: got %d packets, want %d", tc.name, len(pkts), tc.frags)
+		}
+		var transport []byte
+		if tc.frags == 1 {
+			hdr := 20
+			if tc.v6 {
+				hdr = 40
+			}
+			if want := hdr + 8 + tc.payload; len(pkts[0]) != want {
+				t.Errorf("%s: packet is %d bytes, want %d", tc.name, len(pkts[0]), want)
+			}
+			transport = pkts[0][hdr:]
+		} else {
+			transport = reassemble(t, pkts, tc.v6, tc.mtu)
+		}
+		if len(transport) != 8+tc.payload {
+			t.Fatalf("%s: transport is %d bytes, want %d", tc.name, len(transport), 8+tc.payload)
+		}
+		if l := int(binary.BigEndian.Uint16(transport[4:6])); l != len(transport) {
+			t.Errorf("%s: udp length %d, want %d", tc.name, l, len(transport))
+		}
+		if !bytes.Equal(transport[8:], payload) {
+			t.Errorf("%s: payload mismatch after reassembly", tc.name)
+		}
+		src, dst := nl.NetworkFlow().Endpoints()
+		if c := checksum(net.IP(src.Raw()), net.IP(dst.Raw()), layers.IPProtocolUDP, transport); c != 0 {
+			t.Errorf("%s: invalid udp checksum (residue %#04x)", tc.name, c)
+		}
+	}
+}
+
+func TestSerializeUDPSmallMTU(t *testing.T) {
+	for _, nl := range []networkLayer{testIPv4(), testIPv6()} {
+		if _, err := serializeUDP(nl, &layers.UDP{SrcPort: 1, DstPort: 2}, make([]byte, 100), 27); err == nil {
+			t.Errorf("%s: no error for mtu too small to fragment into", nl.LayerType())
+		}
+	}
+}
@@ -1,6 +1,8 @@
 // Copyright (c) 2022 Wireleap
 
-package main
+// Package tunsplice mediates between raw packets read from a tun device and
+// connections dialed through the wireleap broker.
+package tunsplice
 
 import (
 	"crypto/tls"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
 	"github.com/wireleap/client/wireleap_tun/netsetup"
 	"github.com/wireleap/client/wireleap_tun/ptable"
@@ -21,8 +24,14 @@ import (
 )
 
 var pt = &ptable.T{}
+
+// DEBUG enables verbose logging of packet handling.
 var DEBUG = false
 
+// Gateway enables tunnelling of TCP traffic forwarded from other hosts, not
+// just traffic originating from the tun device address.
+var Gateway = false
+
 // spliceconn copies one accepted TCP connection's i/o to the stored connection
 // for this port table entry.
 func spliceconn(c net.Conn) {
@@ -48,9 +57,9 @@ func spliceconn(c net.Conn) {
 	}
 }
 
-// tcpfwd mediates between routed raw packets on the tun device and TCP
+// Serve mediates between routed raw packets on the tun device and TCP
 // connections to wireleap.
-func tcpfwd(l *net.TCPListener) {
+func Serve(l *net.TCPListener) {
 	pause := 1 * time.Second // avoid spam if ulimit is exhausted
 	for {
 		c, err := l.AcceptTCP()
@@ -103,7 +112,7 @@ func listenDual(tunif *tun.T, tunaddr string) (if4, if6 *net.TCPAddr, err error)
 			return nil, nil, fmt.Errorf("could not listen v4 on %s: %s", if4, err)
 		}
 		log.Printf("listening on tcp4 socket %s", l4.Addr())
-		go tcpfwd(l4)
+		go Serve(l4)
 	}
 	if if6 != nil {
 		// get rid of ipv6 bind heisenbug
@@ -113,18 +122,54 @@ func listenDual(tunif *tun.T, tunaddr string) (if4, if6 *net.TCPAddr, err error)
 			return nil, nil, fmt.Errorf("could not listen v6 on %s: %s", if6, err)
 		}
 		log.Printf("listening on tcp6 socket %s", l6.Addr())
-		go tcpfwd(l6)
+		go Serve(l6)
 	}
 	return
 }
 
-type dialFunc func(string, string) (*h2conn.T, error)
+// DialFunc is the type of functions dialing a target through the broker.
+type DialFunc func(string, string) (*h2conn.T, error)
+
+// DialFuncTo returns a DialFunc connecting to the h2c broker address given,
+// identifying itself as forwarder fwdr.
+func DialFuncTo(h2caddr, fwdr string) DialFunc {
+	h2caddr = "http://" + h2caddr
+	// h2c-enabled transport
+	tt := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+		ReadIdleTimeout: 10 * time.Second,
+		PingTimeout:     10 * time.Second,
+	}
+	return func(proto, addr string) (*h2conn.T, error) {
+		return h2conn.New(tt, h2caddr, map[string]string{
+			"Wl-Dial-Protocol": proto,
+			"Wl-Dial-Target":   addr,
+			"Wl-Forwarder":     fwdr,
+		})
+	}
+}
 
-func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialFunc) {
+// MutateLoop reads packets from r, rewrites them so that TCP is redirected to
+// the listening sockets at if4/if6 and UDP is dialed through dialf, and
+// writes the resulting packets to w. Either of if4 and if6 can be nil in which
+// case packets of the respective IP family are ignored. If mtu is non-zero,
+// the MSS of TCP SYN packets is clamped and UDP packets written are
+// fragmented to fit it.
+// Flows are tracked in the port table under their source port, which is
+// translated if it is already used by a flow from another address. If Gateway
+// is set, TCP from other hosts which is routed via the tun device is handled
+// as well.
+func MutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf DialFunc, mtu int) {
 	var (
 		buf  = gopacket.NewSerializeBuffer()
 		opts = gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 
+		defrag      = ip4defrag.NewIPv4Defragmenter()
+		lastDiscard = time.Now()
+
 		ip4     layers.IPv4
 		ip6     layers.IPv6
 		tcp     layers.TCP
@@ -133,10 +178,7 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 		v6p     = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ip6, &tcp, &udp)
 		decoded = make([]gopacket.LayerType, 0, 3)
 
-		ipl interface {
-			gopacket.NetworkLayer
-			gopacket.SerializableLayer
-		}
+		ipl          networkLayer
 		tunaddr      *net.TCPAddr
 		srcip, dstip *net.IP
 		err          error
@@ -146,6 +188,8 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 
 	for {
 		data := r.Recv()
+		// post-nat packets are captured if either they or the original match
+		captured := capturePacket(capturePre, data, true)
 
 		switch data[0] >> 4 {
 		case 4:
@@ -157,6 +201,38 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 			log.Println("error while decoding packet:", err)
 			continue
 		}
+		if len(decoded) == 1 && decoded[0] == layers.LayerTypeIPv4 && isFragment(&ip4) {
+			// oversized datagram fragmented by the kernel, reassemble it
+			if time.Since(lastDiscard) > fragTimeout {
+				lastDiscard = time.Now()
+				defrag.DiscardOlderThan(lastDiscard.Add(-fragTimeout))
+			}
+			frag := ip4
+			whole, err := defrag.DefragIPv4(&frag)
+			if err != nil {
+				if DEBUG {
+					log.Printf("could not reassemble fragment from %s: %s", ip4.SrcIP, err)
+				}
+				continue
+			}
+			if whole == nil {
+				// waiting for more fragments
+				continue
+			}
+			ip4 = *whole
+			switch ip4.Protocol {
+			case layers.IPProtocolTCP:
+				err = tcp.DecodeFromBytes(ip4.Payload, gopacket.NilDecodeFeedback)
+				decoded = append(decoded, layers.LayerTypeTCP)
+			case layers.IPProtocolUDP:
+				err = udp.DecodeFromBytes(ip4.Payload, gopacket.NilDecodeFeedback)
+				decoded = append(decoded, layers.LayerTypeUDP)
+			}
+			if err != nil {
+				log.Println("error while decoding reassembled packet:", err)
+				continue
+			}
+		}
 		if len(decoded) != 2 {
 			continue
 		}
@@ -169,17 +245,19 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 			case layers.LayerTypeTCP:
 				tcp.SetNetworkLayerForChecksum(ipl)
 
-				if !srcip.Equal(tunaddr.IP) {
+				if tunaddr == nil || (!Gateway && !srcip.Equal(tunaddr.IP)) {
 					// not interested
 					continue
 				}
-				if tcp.SrcPort == layers.TCPPort(tunaddr.Port) {
+				if srcip.Equal(tunaddr.IP) && tcp.SrcPort == layers.TCPPort(tunaddr.Port) {
 					// packet from tcp socket to virtual nexthop
-					if nat := pt.Get(ptable.TCP, int(tcp.DstPort)); nat != nil {
-						// redirect to client
+					natport := int(tcp.DstPort)
+					if nat := pt.Get(ptable.TCP, natport); nat != nil {
+						// redirect to client, which is either local or
+						// a host using this one as gateway
 						var (
 							newsrc = netsetup.CopyIP(nat.DstIP)
-							newdst = netsetup.CopyIP(tunaddr.IP)
+							newdst = netsetup.CopyIP(nat.SrcIP)
 						)
 						if (newsrc.To4() == nil) != (newdst.To4() == nil) {
 							log.Printf(
@@ -188,13 +266,14 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 								srcip, tcp.SrcPort,
 								newsrc, nat.DstPort,
 								dstip, tcp.DstPort,
-								newdst, tcp.DstPort,
+								newdst, nat.SrcPort,
 							)
 						}
-						*srcip, *dstip, tcp.SrcPort = newsrc, newdst, layers.TCPPort(nat.DstPort)
+						*srcip, *dstip = newsrc, newdst
+						tcp.SrcPort, tcp.DstPort = layers.TCPPort(nat.DstPort), layers.TCPPort(nat.SrcPort)
 						if tcp.FIN || tcp.RST {
 							// clean up finished connection
-							pt.Del(ptable.TCP, int(tcp.DstPort))
+							pt.Del(ptable.TCP, natport)
 						}
 					} else {
 						continue
@@ -202,7 +281,11 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 				} else {
 					// original packet from client to destination
 					// redirect to tcp socket with spoofed nexthop srcaddr
-					natport := int(tcp.SrcPort)
+					natport, ok := pt.Alloc(ptable.TCP, *srcip, int(tcp.SrcPort))
+					if !ok {
+						log.Printf("no free tcp port to translate %s:%d to, dropping", srcip, tcp.SrcPort)
+						continue
+					}
 					if nat := pt.Get(ptable.TCP, natport); nat == nil {
 						dstaddr := net.JoinHostPort(
 							ipl.NetworkFlow().Dst().String(),
@@ -211,7 +294,7 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 						pt.Set(ptable.TCP, natport, &ptable.Entry{
 							SrcIP:   netsetup.CopyIP(*srcip),
 							DstIP:   netsetup.CopyIP(*dstip),
-							SrcPort: natport,
+							SrcPort: int(tcp.SrcPort),
 							DstPort: int(tcp.DstPort),
 						}, func() (c net.Conn, err error) {
 							if c, err = dialf("tcp", dstaddr); err != nil {
@@ -222,8 +305,9 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 					}
 					*srcip = netsetup.NextIP(tunaddr.IP)
 					*dstip = netsetup.CopyIP(tunaddr.IP)
-					tcp.DstPort = layers.TCPPort(tunaddr.Port)
+					tcp.SrcPort, tcp.DstPort = layers.TCPPort(natport), layers.TCPPort(tunaddr.Port)
 				}
+				clampMSS(&tcp, mssFor(ipl, mtu))
 				err = gopacket.SerializeLayers(buf, opts, ipl, &tcp, gopacket.Payload(tcp.Payload))
 				if err != nil {
 					log.Printf("could not serialize tcp: %s %+v %+v", err, srcip, dstip)
@@ -233,17 +317,26 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 				out := buf.Bytes()
 				dup := make([]byte, len(out))
 				copy(dup, out)
+				capturePacket(capturePost, dup, !captured)
 				w.Send(dup)
 			case layers.LayerTypeUDP:
+				if tunaddr == nil {
+					// no address of this family configured
+					continue
+				}
 				udp.SetNetworkLayerForChecksum(ipl)
-				natport := int(udp.SrcPort)
+				natport, ok := pt.Alloc(ptable.UDP, *srcip, int(udp.SrcPort))
+				if !ok {
+					log.Printf("no free udp port to translate %s:%d to, dropping", srcip, udp.SrcPort)
+					continue
+				}
 				if nat := pt.Get(ptable.UDP, natport); nat == nil {
 					// copy stored variables
 					srcip, dstip, srcport, dstport := netsetup.CopyIP(*srcip), netsetup.CopyIP(*dstip), udp.SrcPort, udp.DstPort
 					nat = &ptable.Entry{
 						SrcIP:   srcip,
 						DstIP:   dstip,
-						SrcPort: natport,
+						SrcPort: int(srcport),
 						DstPort: int(dstport),
 					}
 					dstaddr := net.JoinHostPort(
@@ -266,12 +359,8 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 								return
 							}
 							var (
-								nl interface {
-									gopacket.NetworkLayer
-									gopacket.SerializableLayer
-								}
-								sbuf = gopacket.NewSerializeBuffer()
-								rbuf = make([]byte, 4096) // is this enough?
+								nl   networkLayer
+								rbuf = make([]byte, maxUDPPayload)
 								v4l  = layers.IPv4{Version: 4, Protocol: layers.IPProtocolUDP, TTL: 64}
 								v6l  = layers.IPv6{Version: 6, NextHeader: layers.IPProtocolUDP, HopLimit: 64}
 								udp  = layers.UDP{}
@@ -294,19 +383,17 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 								}
 								udp.SrcPort = layers.UDPPort(dstport)
 								udp.DstPort = layers.UDPPort(srcport)
-								udp.SetNetworkLayerForChecksum(nl)
-								err = gopacket.SerializeLayers(sbuf, opts, nl, &udp, gopacket.Payload(rbuf[:n]))
+								pkts, err := serializeUDP(nl, &udp, rbuf[:n], mtu)
 								if err != nil {
 									if DEBUG {
 										log.Printf("could not serialize udp: %s %+v %+v", err, v4l, v6l)
 									}
 									return
 								}
-								// copy bytes
-								out := sbuf.Bytes()
-								dup := make([]byte, len(out))
-								copy(dup, out)
-								w.Send(dup)
+								for _, pkt := range pkts {
+									capturePacket(capturePost, pkt, true)
+									w.Send(pkt)
+								}
 							}
 						}()
 						return
@@ -326,32 +413,17 @@ func mutateLoop(if4, if6 *net.TCPAddr, r *tun.Reader, w *tun.Writer, dialf dialF
 	}
 }
 
-// tunsplice reads packets on the tun device and forwards them to wireleap in
-// appropriate form.
-func tunsplice(t *tun.T, h2caddr, tunaddr string) error {
+// Splice reads packets on the tun device and forwards them to wireleap in
+// appropriate form. If mtu is 0, the MTU of the tun device is used.
+func Splice(t *tun.T, h2caddr, tunaddr string, mtu int) error {
 	log.Printf("capturing packets from %s and proxying via h2c://%s", t.Name(), h2caddr)
 	if4, if6, err := listenDual(t, tunaddr)
 	if err != nil {
 		return fmt.Errorf("couldn't listen on v4/v6 tcp socket: %s", err)
 	}
-
-	h2caddr = "http://" + h2caddr
-	// h2c-enabled transport
-	tt := &http2.Transport{
-		AllowHTTP: true,
-		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-			return net.Dial(network, addr)
-		},
-		ReadIdleTimeout: 10 * time.Second,
-		PingTimeout:     10 * time.Second,
-	}
-	dialf := func(proto, addr string) (*h2conn.T, error) {
-		return h2conn.New(tt, h2caddr, map[string]string{
-			"Wl-Dial-Protocol": proto,
-			"Wl-Dial-Target":   addr,
-			"Wl-Forwarder":     "tun",
-		})
+	if mtu == 0 {
+		mtu = t.NetIf.MTU
 	}
-	go mutateLoop(if4, if6, tun.NewReader(t), tun.NewWriter(t), dialf)
+	go MutateLoop(if4, if6, tun.NewReader(t), tun.NewWriter(t), DialFuncTo(h2caddr, "tun"), mtu)
 	return nil
 }